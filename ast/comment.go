@@ -0,0 +1,7 @@
+package ast
+
+// Comment is a line comment ('#' or '//') or a block comment ('/* */').
+type Comment struct {
+	Span
+	Text string // comment text, including the comment delimiters
+}
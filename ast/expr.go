@@ -2,6 +2,7 @@ package ast
 
 // Expr represents kaleigo's ast node.
 type Expr interface {
+	Node
 	ExprKind() ExprType
 }
 
@@ -11,6 +12,7 @@ type ExprType int
 const (
 	ExprError ExprType = iota
 	ExprNumber
+	ExprString
 	ExprUnary
 	ExprBinary
 	ExprCall
@@ -18,51 +20,107 @@ const (
 	ExprBlock
 	ExprIf
 	ExprFor
+	ExprVar
 )
 
 type (
+	// ErrorExpr is a placeholder for an expression that contains syntax errors.
+	ErrorExpr struct {
+		Span
+	}
+
 	NumberExpr struct {
+		Span
 		Val float64
 	}
 
+	// StringExpr is a string literal. Val is the value with the escape sequences interpreted.
+	StringExpr struct {
+		Span
+		Val string
+	}
+
 	VariableExpr struct {
+		Span
 		Name string
 	}
 
+	// UnaryExpr is an application of a built-in ('-' or '!') or user-defined unary operator.
+	// '!x' is 1 if x is false as a condition, i.e. 0 or NaN, and 0 otherwise.
+	UnaryExpr struct {
+		Span
+		Op      string
+		Operand Expr
+	}
+
+	// BinaryExpr is an application of a built-in or user-defined binary operator.
+	// The built-in comparisons other than '==' are true if either operand is NaN.
 	BinaryExpr struct {
-		Op  rune
+		Span
+		Op  string
 		LHS Expr
 		RHS Expr
 	}
 
 	CallExpr struct {
+		Span
 		Callee string
 		Args   []Expr
 	}
 
+	// BlockExpr is a sequence of expressions separated by ';', which are evaluated in order.
+	// Its value is the one of the last expression, or 0.0 if it is empty.
 	BlockExpr struct {
+		Span
 		Exprs []Expr
 	}
 
 	IfExpr struct {
+		Span
 		Cond Expr
 		Then Expr
 		Else Expr
 	}
 
+	// ForExpr is a loop 'for Var = Start, End, Step in Body', whose value is 0.0. Body is
+	// evaluated at least once. After each evaluation of Body, Step (1 if nil) and End are
+	// evaluated, and then Var is stepped, so End sees the value before the step. The loop
+	// goes on while End is true.
 	ForExpr struct {
+		Span
 		Var   string
 		Start Expr
 		End   Expr
 		Step  Expr
 		Body  Expr
 	}
+
+	// VarExpr declares mutable local variables that are visible in Body.
+	VarExpr struct {
+		Span
+		Vars []*VarBinding
+		Body Expr
+	}
 )
 
+// VarBinding is a variable declared by VarExpr. Init is evaluated before the variable is declared,
+// so that the same name in Init refers to the outer variable, as in 'var a = a in'. The variables
+// of a VarExpr are declared in order, so Init may refer to the ones before it.
+type VarBinding struct {
+	Span
+	Name string
+	Type Type // annotated type; NoType if not annotated
+	Init Expr // nil if the variable is initialized with 0
+}
+
+func (*ErrorExpr) ExprKind() ExprType    { return ExprError }
 func (*NumberExpr) ExprKind() ExprType   { return ExprNumber }
+func (*StringExpr) ExprKind() ExprType   { return ExprString }
 func (*VariableExpr) ExprKind() ExprType { return ExprVariable }
+func (*UnaryExpr) ExprKind() ExprType    { return ExprUnary }
 func (*BinaryExpr) ExprKind() ExprType   { return ExprBinary }
 func (*CallExpr) ExprKind() ExprType     { return ExprCall }
 func (*BlockExpr) ExprKind() ExprType    { return ExprBlock }
 func (*IfExpr) ExprKind() ExprType       { return ExprIf }
 func (*ForExpr) ExprKind() ExprType      { return ExprFor }
+func (*VarExpr) ExprKind() ExprType      { return ExprVar }
@@ -1,21 +1,25 @@
 package ast
 
 type File struct {
-	Name    string
-	Externs []*Prototype
-	Defs    []*Function
-	Exprs   []Expr
+	Name     string
+	Externs  []*Prototype
+	Defs     []*Function
+	Exprs    []Expr
+	Comments []*Comment // all comments in the file, in source order
 }
 
+// MainName is the name of the function created by File.CreateMain.
+const MainName = "__kaleigo_main"
+
 // CreateMain creates dummy main function that contains all of toplevel expressions.
 func (f *File) CreateMain() *Function {
 	return &Function{
 		Prototype: &Prototype{
-			Name: "__kaleigo_main",
+			Name: MainName,
 			Args: []string{},
 		},
 		Body: &BlockExpr{
-			f.Exprs,
+			Exprs: f.Exprs,
 		},
 	}
 }
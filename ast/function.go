@@ -1,6 +1,7 @@
 package ast
 
 type Function struct {
+	Span
 	*Prototype
 	Body Expr
 }
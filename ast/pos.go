@@ -0,0 +1,52 @@
+package ast
+
+import "fmt"
+
+// Pos is a location in a source file.
+type Pos struct {
+	Offset int // byte offset, starting at 0
+	Line   int // line number, starting at 1
+	Column int // column number in runes, starting at 1
+}
+
+// IsValid reports whether the position points into a source file.
+// Nodes synthesized by the compiler (e.g. by File.CreateMain) have no position.
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Pos) String() string {
+	if !p.IsValid() {
+		return "-"
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Errorf returns an error of the backends located at pos in the file, as "file:line:column: message".
+// The file name is omitted if it is empty.
+func Errorf(filename string, pos Pos, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if filename == "" {
+		return fmt.Errorf("%s: %s", pos, msg)
+	}
+	return fmt.Errorf("%s:%s: %s", filename, pos, msg)
+}
+
+// Span is the range of source text [Start, End) a node was parsed from.
+// It is embedded in every ast node.
+type Span struct {
+	Start Pos
+	End   Pos
+}
+
+// Pos returns the start position of the span.
+func (s Span) Pos() Pos { return s.Start }
+
+// Loc returns the span itself, so that it is accessible through the Node interface.
+func (s Span) Loc() Span { return s }
+
+// Node is implemented by all ast nodes.
+type Node interface {
+	Pos() Pos
+	Loc() Span
+}
@@ -1,6 +1,55 @@
 package ast
 
+// ProtoKind identifies whether a prototype declares an ordinary function or an operator.
+type ProtoKind int
+
+const (
+	ProtoFunction ProtoKind = iota
+	ProtoUnary
+	ProtoBinary
+)
+
+// DefaultPrecedence is the precedence of a user-defined binary operator declared without one.
+const DefaultPrecedence = 30
+
 type Prototype struct {
+	Span
 	Name string
 	Args []string
+	Kind ProtoKind
+	// Precedence is the precedence of a binary operator. It is 0 for other kinds of prototypes.
+	Precedence int
+	// ArgTypes are the annotated types of Args, and ResultType is the annotated result type.
+	// They are NoType if not annotated. ArgTypes may be nil if no argument is annotated.
+	ArgTypes   []Type
+	ResultType Type
+}
+
+// ArgType returns the annotated type of the i-th argument, or NoType if it is not annotated.
+func (p *Prototype) ArgType(i int) Type {
+	if i < len(p.ArgTypes) {
+		return p.ArgTypes[i]
+	}
+	return NoType
+}
+
+// IsOperator reports whether the prototype declares a user-defined operator.
+func (p *Prototype) IsOperator() bool {
+	return p.Kind != ProtoFunction
+}
+
+// OperatorName returns the operator of a user-defined operator, e.g. "|" for "binary|".
+func (p *Prototype) OperatorName() string {
+	r := []rune(p.Name)
+	return string(r[len(r)-1])
+}
+
+// UnaryFunctionName returns the name of the function implementing the user-defined unary operator op.
+func UnaryFunctionName(op string) string {
+	return "unary" + op
+}
+
+// BinaryFunctionName returns the name of the function implementing the user-defined binary operator op.
+func BinaryFunctionName(op string) string {
+	return "binary" + op
 }
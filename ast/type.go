@@ -0,0 +1,34 @@
+package ast
+
+// Type is a static type of values.
+type Type int
+
+const (
+	NoType     Type = iota // not annotated
+	TypeF64                // 64-bit floating point number, the type of unannotated values
+	TypeI64                // 64-bit signed integer
+	TypeBool               // boolean
+	TypeString             // immutable string of bytes
+)
+
+var typeNames = map[Type]string{
+	NoType:     "<none>",
+	TypeF64:    "f64",
+	TypeI64:    "i64",
+	TypeBool:   "bool",
+	TypeString: "str",
+}
+
+func (t Type) String() string {
+	return typeNames[t]
+}
+
+// LookupType returns the type of the name used in type annotations.
+func LookupType(name string) (Type, bool) {
+	for t, n := range typeNames {
+		if n == name && t != NoType {
+			return t, true
+		}
+	}
+	return NoType, false
+}
@@ -0,0 +1,43 @@
+package ast
+
+// Inspect traverses the expression and its subexpressions in depth-first order, in the order
+// they are evaluated. It calls f for each expression, and does not visit the subexpressions
+// of the expressions for which f returns false.
+func Inspect(expr Expr, f func(Expr) bool) {
+	if !f(expr) {
+		return
+	}
+	switch e := expr.(type) {
+	case *UnaryExpr:
+		Inspect(e.Operand, f)
+	case *BinaryExpr:
+		Inspect(e.LHS, f)
+		Inspect(e.RHS, f)
+	case *CallExpr:
+		for _, arg := range e.Args {
+			Inspect(arg, f)
+		}
+	case *BlockExpr:
+		for _, e := range e.Exprs {
+			Inspect(e, f)
+		}
+	case *IfExpr:
+		Inspect(e.Cond, f)
+		Inspect(e.Then, f)
+		Inspect(e.Else, f)
+	case *ForExpr:
+		Inspect(e.Start, f)
+		Inspect(e.Body, f)
+		if e.Step != nil {
+			Inspect(e.Step, f)
+		}
+		Inspect(e.End, f)
+	case *VarExpr:
+		for _, v := range e.Vars {
+			if v.Init != nil {
+				Inspect(v.Init, f)
+			}
+		}
+		Inspect(e.Body, f)
+	}
+}
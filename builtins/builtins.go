@@ -0,0 +1,108 @@
+// Package builtins implements the runtime functions of kaleigo programs in Go,
+// for the backends that do not link lib/runtime.c and the C math library.
+package builtins
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Func is a function implemented in Go, which kaleigo programs can call through an extern.
+type Func struct {
+	Arity int
+	// Call calls the function with Arity arguments. Output is written to w.
+	Call func(w io.Writer, args []float64) float64
+}
+
+// funcs are the counterparts of lib/runtime.c and the C math library.
+var funcs = map[string]*Func{
+	"putd":     {1, putd},
+	"putchard": {1, putchard},
+	"sin":      math1(math.Sin),
+	"cos":      math1(math.Cos),
+	"tan":      math1(math.Tan),
+	"asin":     math1(math.Asin),
+	"acos":     math1(math.Acos),
+	"atan":     math1(math.Atan),
+	"atan2":    math2(math.Atan2),
+	"sinh":     math1(math.Sinh),
+	"cosh":     math1(math.Cosh),
+	"tanh":     math1(math.Tanh),
+	"exp":      math1(math.Exp),
+	"log":      math1(math.Log),
+	"log10":    math1(math.Log10),
+	"pow":      math2(math.Pow),
+	"sqrt":     math1(math.Sqrt),
+	"fabs":     math1(math.Abs),
+	"floor":    math1(math.Floor),
+	"ceil":     math1(math.Ceil),
+	"round":    math1(math.Round),
+	"fmod":     math2(math.Mod),
+}
+
+// Lookup returns the function of the name.
+func Lookup(name string) (*Func, bool) {
+	f, ok := funcs[name]
+	return f, ok
+}
+
+// Resolve returns the function that an extern of the name and the number of arguments refers to.
+func Resolve(name string, arity int) (*Func, error) {
+	f, ok := funcs[name]
+	if !ok {
+		return nil, fmt.Errorf("unresolved external function: %q", name)
+	}
+	if f.Arity != arity {
+		return nil, fmt.Errorf("external function %q takes %d arguments, but declared with %d", name, f.Arity, arity)
+	}
+	return f, nil
+}
+
+// Names returns the sorted names of the functions.
+func Names() []string {
+	names := make([]string, 0, len(funcs))
+	for name := range funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func math1(f func(float64) float64) *Func {
+	return &Func{1, func(w io.Writer, args []float64) float64 {
+		return f(args[0])
+	}}
+}
+
+func math2(f func(float64, float64) float64) *Func {
+	return &Func{2, func(w io.Writer, args []float64) float64 {
+		return f(args[0], args[1])
+	}}
+}
+
+// putd prints the number as printf("%f\n") in lib/runtime.c does with glibc, which prints
+// the sign of NaN.
+func putd(w io.Writer, args []float64) float64 {
+	d := args[0]
+	switch {
+	case math.IsNaN(d) && math.Signbit(d):
+		fmt.Fprintln(w, "-nan")
+	case math.IsNaN(d):
+		fmt.Fprintln(w, "nan")
+	case math.IsInf(d, 1):
+		fmt.Fprintln(w, "inf")
+	case math.IsInf(d, -1):
+		fmt.Fprintln(w, "-inf")
+	default:
+		fmt.Fprintf(w, "%f\n", d)
+	}
+	return 0.0
+}
+
+// putchard prints the number as a character.
+func putchard(w io.Writer, args []float64) float64 {
+	w.Write([]byte{byte(int(args[0]))})
+	return 0.0
+}
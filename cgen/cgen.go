@@ -0,0 +1,231 @@
+// Package cgen translates kaleigo programs into portable C, which is compiled
+// with a C compiler and linked with lib/runtime.c instead of using LLVM.
+//
+// Every kaleigo value is a C double. Expressions are flattened into statements
+// on temporaries, so that the evaluation order is the same as codegen's.
+package cgen
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/agatan/kaleigo/ast"
+)
+
+// reservedPrefix is the prefix of the names made up by the generator.
+// Kaleigo names with this prefix are mangled.
+const reservedPrefix = "kl_"
+
+// prelude is written at the top of every generated file.
+// The runtime functions are declared by the generated code itself, so that no header is needed.
+const prelude = `double fmod(double, double);
+
+static int kl_truthy(double d) { return d < 0.0 || d > 0.0; }
+static double kl_bool(int b) { return b ? 1.0 : 0.0; }
+static double kl_fmod(double x, double y) { return fmod(x, y); }
+`
+
+// preludeFuncs are the numbers of arguments of the C functions declared by the prelude.
+// Kaleigo functions and variables of these names are mangled, so that they do not clash with the declarations.
+var preludeFuncs = map[string]int{
+	"fmod": 2,
+}
+
+var cKeywords = map[string]bool{
+	"auto": true, "break": true, "case": true, "char": true, "const": true, "continue": true,
+	"default": true, "do": true, "double": true, "else": true, "enum": true, "extern": true,
+	"float": true, "for": true, "goto": true, "if": true, "inline": true, "int": true,
+	"long": true, "register": true, "restrict": true, "return": true, "short": true,
+	"signed": true, "sizeof": true, "static": true, "struct": true, "switch": true,
+	"typedef": true, "union": true, "unsigned": true, "void": true, "volatile": true,
+	"while": true, "main": true,
+}
+
+// isCName reports whether name can be used as a C identifier as it is.
+func isCName(name string) bool {
+	if name == "" || cKeywords[name] || strings.HasPrefix(name, reservedPrefix) {
+		return false
+	}
+	if _, ok := preludeFuncs[name]; ok {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r == '_', 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case '0' <= r && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// mangle turns name into a C identifier with the reserved prefix and the kind, e.g. "binary|" into "kl_f_binary_7c".
+func mangle(kind, name string) string {
+	var b strings.Builder
+	b.WriteString(reservedPrefix + kind + "_")
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return b.String()
+}
+
+// Generator holds the state of translation of a file.
+type Generator struct {
+	filename string
+	funcs    map[string]*function // functions callable from the program, by kaleigo name
+	globals  map[string]bool      // C names of the functions
+
+	// state of the function being generated
+	decls  []string          // declarations of the locals and the temporaries
+	body   bytes.Buffer      // statements
+	indent int               // indentation level of the statements
+	used   map[string]bool   // C names of the locals
+	values map[string]string // C names of the variables in scope
+	ntemp  int               // number of temporaries
+}
+
+// function is a function that the program can call.
+type function struct {
+	cname string
+	arity int
+}
+
+// NewGenerator creates a new generator.
+func NewGenerator() *Generator {
+	return &Generator{}
+}
+
+// Generate writes the C translation unit of the file to out.
+// It reports unknown variables and functions, and calls with wrong numbers of arguments,
+// as codegen does.
+func (g *Generator) Generate(fileast *ast.File, out io.Writer) error {
+	g.filename = fileast.Name
+	g.funcs = make(map[string]*function)
+	g.globals = make(map[string]bool)
+
+	var w bytes.Buffer
+	fmt.Fprintf(&w, "/* Code generated by kaleigo from %s. DO NOT EDIT. */\n\n", fileast.Name)
+	w.WriteString(prelude)
+
+	main := fileast.CreateMain()
+	defs := append(fileast.Defs[:len(fileast.Defs):len(fileast.Defs)], main)
+	defined := make(map[string]bool)
+	for _, def := range defs {
+		if defined[def.Name] {
+			return g.errorf(def.Prototype.Pos(), "redefinition of function %q", def.Name)
+		}
+		defined[def.Name] = true
+	}
+
+	// externs of defined functions are forward declarations, and refer to the definitions.
+	externs := 0
+	for _, extern := range fileast.Externs {
+		if f, ok := g.funcs[extern.Name]; ok && f.arity != len(extern.Args) {
+			return g.errorf(extern.Pos(), "external function %q is redeclared with %d arguments", extern.Name, len(extern.Args))
+		}
+		if defined[extern.Name] {
+			g.declare(extern.Name, defName(extern.Name), len(extern.Args))
+			continue
+		}
+		// externs of the functions of the prelude repeat the same declarations.
+		if arity, ok := preludeFuncs[extern.Name]; ok {
+			if arity != len(extern.Args) {
+				return g.errorf(extern.Pos(), "external function %q takes %d arguments, but declared with %d", extern.Name, arity, len(extern.Args))
+			}
+		} else if !isCName(extern.Name) {
+			return g.errorf(extern.Pos(), "external function %q cannot be called from C", extern.Name)
+		}
+		if externs == 0 {
+			w.WriteString("\n")
+		}
+		externs++
+		g.declare(extern.Name, extern.Name, len(extern.Args))
+		fmt.Fprintf(&w, "double %s(%s);\n", extern.Name, paramTypes(len(extern.Args)))
+	}
+
+	w.WriteString("\n")
+	for _, def := range defs {
+		if f, ok := g.funcs[def.Name]; ok && f.arity != len(def.Args) {
+			return g.errorf(def.Prototype.Pos(), "function %q is defined with %d arguments, but declared with %d", def.Name, len(def.Args), f.arity)
+		}
+		cname := defName(def.Name)
+		g.declare(def.Name, cname, len(def.Args))
+		fmt.Fprintf(&w, "double %s(%s);\n", cname, paramTypes(len(def.Args)))
+	}
+
+	for _, def := range defs {
+		w.WriteString("\n")
+		if err := g.genFunction(&w, def); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.WriteTo(out)
+	return err
+}
+
+// defName returns the C name of a defined function. The names are mangled, so that they do not
+// clash with the functions of the C library and the runtime, which are in the same program.
+func defName(name string) string {
+	if name == ast.MainName {
+		return name
+	}
+	return mangle("f", name)
+}
+
+func (g *Generator) declare(name, cname string, arity int) {
+	g.funcs[name] = &function{cname: cname, arity: arity}
+	g.globals[cname] = true
+}
+
+func paramTypes(n int) string {
+	if n == 0 {
+		return "void"
+	}
+	return strings.TrimSuffix(strings.Repeat("double, ", n), ", ")
+}
+
+// errorf returns an error located at pos.
+func (g *Generator) errorf(pos ast.Pos, format string, args ...interface{}) error {
+	return ast.Errorf(g.filename, pos, format, args...)
+}
+
+func (g *Generator) genFunction(w *bytes.Buffer, def *ast.Function) error {
+	g.decls = nil
+	g.body.Reset()
+	g.indent = 1
+	g.used = make(map[string]bool)
+	g.values = make(map[string]string)
+	g.ntemp = 0
+
+	params := make([]string, len(def.Args))
+	for i, arg := range def.Args {
+		cname := g.localName(arg)
+		params[i] = "double " + cname
+		g.values[arg] = cname
+	}
+	if len(params) == 0 {
+		params = []string{"void"}
+	}
+
+	result, err := g.genExpr(def.Body)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "double %s(%s) {\n", g.funcs[def.Name].cname, strings.Join(params, ", "))
+	for _, decl := range g.decls {
+		fmt.Fprintf(w, "\tdouble %s;\n", decl)
+	}
+	g.body.WriteTo(w)
+	fmt.Fprintf(w, "\treturn %s;\n}\n", result)
+	return nil
+}
@@ -0,0 +1,187 @@
+package cgen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/agatan/kaleigo/interp"
+	"github.com/agatan/kaleigo/parse"
+)
+
+func generate(src string) (string, error) {
+	f, err := parse.New("test.kl", src).Parse()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = NewGenerator().Generate(f, &buf)
+	return buf.String(), err
+}
+
+func TestGenerate(t *testing.T) {
+	src := `extern putd(x)
+def binary| 5 (a b) if a || b then 1 else 0
+def f(putd) var x = putd in x = x * 2
+putd(f(1) | 0)`
+	expected := `/* Code generated by kaleigo from test.kl. DO NOT EDIT. */
+
+double fmod(double, double);
+
+static int kl_truthy(double d) { return d < 0.0 || d > 0.0; }
+static double kl_bool(int b) { return b ? 1.0 : 0.0; }
+static double kl_fmod(double x, double y) { return fmod(x, y); }
+
+double putd(double);
+
+double kl_f_binary_7c(double, double);
+double kl_f_f(double);
+double __kaleigo_main(void);
+
+double kl_f_binary_7c(double a, double b) {
+	double kl_t1;
+	double kl_t2;
+	double kl_t3;
+	double kl_t4;
+	kl_t1 = a;
+	if (!kl_truthy(kl_t1)) {
+		kl_t3 = b;
+		kl_t2 = kl_bool(kl_truthy(kl_t3));
+	} else {
+		kl_t2 = 1.0;
+	}
+	if (kl_truthy(kl_t2)) {
+		kl_t4 = 1.0;
+	} else {
+		kl_t4 = 0.0;
+	}
+	return kl_t4;
+}
+
+double kl_f_f(double putd_2) {
+	double kl_t1;
+	double x;
+	double kl_t2;
+	double kl_t3;
+	kl_t1 = putd_2;
+	x = kl_t1;
+	kl_t2 = x;
+	kl_t3 = kl_t2 * 2.0;
+	x = kl_t3;
+	return kl_t3;
+}
+
+double __kaleigo_main(void) {
+	double kl_t1;
+	double kl_t2;
+	double kl_t3;
+	kl_t1 = kl_f_f(1.0);
+	kl_t2 = kl_f_binary_7c(kl_t1, 0.0);
+	kl_t3 = putd(kl_t2);
+	return kl_t3;
+}
+`
+	actual, err := generate(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != expected {
+		t.Errorf("generated C is wrong:\n%s\nexpected:\n%s", actual, expected)
+	}
+}
+
+func TestGenerateError(t *testing.T) {
+	cases := []struct {
+		src string
+		msg string
+	}{
+		{"x + 1", `test.kl:1:1: unknown variable name : "x"`},
+		{"f(1)", `test.kl:1:1: unknown function referenced: "f"`},
+		{"def f(x) x\n1 + f(1, 2)", `test.kl:2:5: incorrect number of arguments passed for "f". 1 expected, but 2 given`},
+		{"def f(x) x\ndef f(y) y", `test.kl:2:5: redefinition of function "f"`},
+		{"extern sin(x)\ndef sin(x, y) x", `test.kl:2:5: function "sin" is defined with 2 arguments, but declared with 1`},
+		{"extern int(x)", `test.kl:1:8: external function "int" cannot be called from C`},
+		{"extern fmod(x)", `test.kl:1:8: external function "fmod" takes 2 arguments, but declared with 1`},
+	}
+	for _, c := range cases {
+		_, err := generate(c.src)
+		if err == nil || err.Error() != c.msg {
+			t.Errorf("wrong error for %q: expected %q, actual %v", c.src, c.msg, err)
+		}
+	}
+}
+
+// TestCompileAndRun compiles the generated C with the runtime, and checks that the
+// executable prints the same as the interpreter.
+func TestCompileAndRun(t *testing.T) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler found")
+	}
+	dir, err := ioutil.TempDir("", "cgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	programs := []string{
+		"putd(1 + 2 * 3); putd(10 - 4 - 3); putd(7 / 2); putd(7 % 4); putd(-(1 + 2))",
+		"putd(1 < 2); putd(2 <= 1); putd(3 == 3); putd(3 != 3); putd(!0); putd(!3)",
+		"putd(!(0/0)); putd((0/0) || !(0/0))",
+		"putd(0/0); putd(-(0/0))",
+		"putd(1 && 0); putd(0 || 2); putd(2 && 3); putd(0 || 0)",
+		"putd(var x = 2 in (var x = x * 3 in x) + x)",
+		"var x = 1 in putd(x + (x = 5))",
+		"def fib(x) if x < 3 then 1 else fib(x-1) + fib(x-2)\nputd(fib(15))",
+		"def binary& 1 (x y) y\n" +
+			"def fibi(x) var a = 1, b = 1, c in (for i = 3, i < x in c = a + b & a = b & b = c) & b\nputd(fibi(11))",
+		"def even(n) if n == 0 then 1 else odd(n - 1)\ndef odd(n) if n == 0 then 0 else even(n - 1)\nputd(even(10) + odd(7))",
+		"for i = 0, i < 3, 0.5 in putd(i)",
+		"def unary~(v) 0 - v\ndef int(double) ~double\nputd(int(4))",
+		"extern putchard(c)\ndef binary& 1 (x y) y\ndef side(x) putchard(x) & 1\n0 && side(65); 1 && side(66); 1 || side(67); 0 || side(68)",
+		"extern pow(x, y)\nextern sqrt(x)\nputd(pow(2, 10) + sqrt(16))",
+		"def f(fmod) fmod % 3\nputd(f(5))",
+		"def fmod(a) a * 100\nputd(5 % 3); putd(fmod(2))",
+		"extern fmod(x, y)\nputd(fmod(7, 4) + 5 % 3)",
+		"def printf(x) x + 100\nputd(printf(1))",
+		"extern f(x)\nextern printf(x)\ndef f(x) x + 1\ndef printf(x) f(x) * 2\nputd(printf(1))",
+	}
+	for i, src := range programs {
+		src = "extern putd(x)\n" + src
+		f, err := parse.New("test.kl", src).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected bytes.Buffer
+		if _, err := interp.New(&expected).Run(f); err != nil {
+			t.Fatalf("%q: %s", src, err)
+		}
+
+		var c bytes.Buffer
+		if err := NewGenerator().Generate(f, &c); err != nil {
+			t.Errorf("%q: %s", src, err)
+			continue
+		}
+		cfile := filepath.Join(dir, "test.c")
+		if err := ioutil.WriteFile(cfile, c.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		exe := filepath.Join(dir, "test")
+		out, err := exec.Command(cc, "-o", exe, cfile, "../lib/runtime.c", "-lm").CombinedOutput()
+		if err != nil {
+			t.Errorf("program %d: C compile error: %s\n%s\n%s", i, err, out, c.String())
+			continue
+		}
+		actual, err := exec.Command(exe).Output()
+		if err != nil {
+			t.Errorf("%q: %s", src, err)
+			continue
+		}
+		if string(actual) != expected.String() {
+			t.Errorf("%q: expected output %q, actual %q", src, expected.String(), actual)
+		}
+	}
+}
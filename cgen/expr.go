@@ -0,0 +1,328 @@
+package cgen
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/agatan/kaleigo/ast"
+)
+
+// localName returns a new C name for a local variable, which is unique in the function
+// and does not hide any function.
+func (g *Generator) localName(name string) string {
+	base := name
+	if !isCName(name) {
+		base = mangle("v", name)
+	}
+	cname := base
+	for i := 2; g.used[cname] || g.globals[cname]; i++ {
+		cname = fmt.Sprintf("%s_%d", base, i)
+	}
+	g.used[cname] = true
+	return cname
+}
+
+// newLocal declares a new local variable, and returns its C name.
+func (g *Generator) newLocal(name string) string {
+	cname := g.localName(name)
+	g.decls = append(g.decls, cname)
+	return cname
+}
+
+// newTemp declares a new temporary, and returns its C name.
+func (g *Generator) newTemp() string {
+	g.ntemp++
+	cname := fmt.Sprintf("%st%d", reservedPrefix, g.ntemp)
+	g.decls = append(g.decls, cname)
+	return cname
+}
+
+// stmt writes a statement.
+func (g *Generator) stmt(format string, args ...interface{}) {
+	g.body.WriteString(strings.Repeat("\t", g.indent))
+	fmt.Fprintf(&g.body, format, args...)
+	g.body.WriteString("\n")
+}
+
+// assign writes a statement that assigns the C expression to a new temporary, and returns the temporary.
+func (g *Generator) assign(format string, args ...interface{}) string {
+	t := g.newTemp()
+	g.stmt("%s = %s;", t, fmt.Sprintf(format, args...))
+	return t
+}
+
+// bind binds the name to the C variable, and returns a function that restores the previous binding.
+func (g *Generator) bind(name, cname string) (restore func()) {
+	old, exists := g.values[name]
+	g.values[name] = cname
+	return func() {
+		if exists {
+			g.values[name] = old
+		} else {
+			delete(g.values, name)
+		}
+	}
+}
+
+// literal returns the C literal of the double.
+func literal(v float64) string {
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		// the parser never produces them, but be safe.
+		return fmt.Sprintf("(%s / 0.0)", literal(math.Copysign(1, v)))
+	}
+	s := strconv.FormatFloat(v, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eE") {
+		s += ".0"
+	}
+	return s
+}
+
+// comparisons are the C expressions of the comparison operators.
+var comparisons = map[string]string{
+	"<":  "!(%s >= %s)",
+	">":  "!(%s <= %s)",
+	"<=": "!(%s > %s)",
+	">=": "!(%s < %s)",
+	"==": "%s == %s",
+	"!=": "%s != %s",
+}
+
+// genExpr writes the statements that evaluate the expression, and returns the C expression of its value,
+// which is a temporary or a literal.
+func (g *Generator) genExpr(expr ast.Expr) (string, error) {
+	switch e := expr.(type) {
+	case *ast.ErrorExpr:
+		return "", g.errorf(e.Pos(), "invalid expression")
+	case *ast.NumberExpr:
+		return literal(e.Val), nil
+	case *ast.StringExpr:
+		return "", g.errorf(e.Pos(), "strings are not supported in C")
+	case *ast.VariableExpr:
+		v, ok := g.values[e.Name]
+		if !ok {
+			return "", g.errorf(e.Pos(), "unknown variable name : %q", e.Name)
+		}
+		// copy the value, because the variable may be assigned before the value is used.
+		return g.assign("%s", v), nil
+	case *ast.UnaryExpr:
+		operand, err := g.genExpr(e.Operand)
+		if err != nil {
+			return "", err
+		}
+		switch e.Op {
+		case "-":
+			return g.assign("-%s", operand), nil
+		case "!":
+			return g.assign("kl_bool(!kl_truthy(%s))", operand), nil
+		}
+		// user-defined unary operator
+		f, ok := g.funcs[ast.UnaryFunctionName(e.Op)]
+		if !ok {
+			return "", g.errorf(e.Pos(), "unknown unary operator: %q", e.Op)
+		}
+		return g.assign("%s(%s)", f.cname, operand), nil
+
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case "&&", "||":
+			return g.genLogical(e)
+		case "=":
+			return g.genAssign(e)
+		}
+		l, err := g.genExpr(e.LHS)
+		if err != nil {
+			return "", err
+		}
+		r, err := g.genExpr(e.RHS)
+		if err != nil {
+			return "", err
+		}
+
+		switch e.Op {
+		case "+", "-", "*", "/":
+			return g.assign("%s %s %s", l, e.Op, r), nil
+		case "%":
+			return g.assign("kl_fmod(%s, %s)", l, r), nil
+		}
+		if cmp, ok := comparisons[e.Op]; ok {
+			return g.assign("kl_bool("+cmp+")", l, r), nil
+		}
+		// user-defined binary operator
+		f, ok := g.funcs[ast.BinaryFunctionName(e.Op)]
+		if !ok {
+			return "", g.errorf(e.Pos(), "invalid binary operator: %q", e.Op)
+		}
+		return g.assign("%s(%s, %s)", f.cname, l, r), nil
+
+	case *ast.CallExpr:
+		f, ok := g.funcs[e.Callee]
+		if !ok {
+			return "", g.errorf(e.Pos(), "unknown function referenced: %q", e.Callee)
+		}
+		if f.arity != len(e.Args) {
+			return "", g.errorf(e.Pos(), "incorrect number of arguments passed for %q. %d expected, but %d given", e.Callee, f.arity, len(e.Args))
+		}
+		args := make([]string, len(e.Args))
+		for i, arg := range e.Args {
+			v, err := g.genExpr(arg)
+			if err != nil {
+				return "", err
+			}
+			args[i] = v
+		}
+		return g.assign("%s(%s)", f.cname, strings.Join(args, ", ")), nil
+
+	case *ast.BlockExpr:
+		// the statements of the expressions are emitted in order, and the block is the C expression of the last one.
+		last := literal(0.0)
+		for _, e := range e.Exprs {
+			var err error
+			last, err = g.genExpr(e)
+			if err != nil {
+				return "", err
+			}
+		}
+		return last, nil
+
+	case *ast.IfExpr:
+		cond, err := g.genExpr(e.Cond)
+		if err != nil {
+			return "", err
+		}
+		result := g.newTemp()
+		g.stmt("if (kl_truthy(%s)) {", cond)
+		if err := g.genBranch(result, e.Then); err != nil {
+			return "", err
+		}
+		g.stmt("} else {")
+		if err := g.genBranch(result, e.Else); err != nil {
+			return "", err
+		}
+		g.stmt("}")
+		return result, nil
+
+	case *ast.ForExpr:
+		start, err := g.genExpr(e.Start)
+		if err != nil {
+			return "", err
+		}
+		v := g.newLocal(e.Var)
+		g.stmt("%s = %s;", v, start)
+		restore := g.bind(e.Var, v)
+
+		g.stmt("for (;;) {")
+		g.indent++
+		if _, err := g.genExpr(e.Body); err != nil {
+			return "", err
+		}
+		step := literal(1.0)
+		if e.Step != nil {
+			step, err = g.genExpr(e.Step)
+			if err != nil {
+				return "", err
+			}
+		}
+		end, err := g.genExpr(e.End)
+		if err != nil {
+			return "", err
+		}
+		g.stmt("%s = %s + %s;", v, v, step)
+		g.stmt("if (!kl_truthy(%s)) break;", end)
+		g.indent--
+		g.stmt("}")
+
+		restore()
+		return literal(0.0), nil
+
+	case *ast.VarExpr:
+		restores := make([]func(), len(e.Vars))
+		for i, v := range e.Vars {
+			// the name is bound to a new C local after the initializer is generated.
+			init := literal(0.0)
+			if v.Init != nil {
+				var err error
+				init, err = g.genExpr(v.Init)
+				if err != nil {
+					return "", err
+				}
+			}
+			cname := g.newLocal(v.Name)
+			g.stmt("%s = %s;", cname, init)
+			restores[i] = g.bind(v.Name, cname)
+		}
+
+		body, err := g.genExpr(e.Body)
+		if err != nil {
+			return "", err
+		}
+
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+		return body, nil
+
+	default:
+		panic("internal compiler error")
+	}
+}
+
+// genBranch writes an indented block that evaluates the expression into result.
+func (g *Generator) genBranch(result string, expr ast.Expr) error {
+	g.indent++
+	defer func() { g.indent-- }()
+	v, err := g.genExpr(expr)
+	if err != nil {
+		return err
+	}
+	g.stmt("%s = %s;", result, v)
+	return nil
+}
+
+// genAssign generates an assignment to a mutable variable. The result is the assigned value.
+func (g *Generator) genAssign(e *ast.BinaryExpr) (string, error) {
+	lhs, ok := e.LHS.(*ast.VariableExpr)
+	if !ok {
+		return "", g.errorf(e.Pos(), "destination of '=' must be a variable")
+	}
+	val, err := g.genExpr(e.RHS)
+	if err != nil {
+		return "", err
+	}
+	v, ok := g.values[lhs.Name]
+	if !ok {
+		return "", g.errorf(lhs.Pos(), "unknown variable name : %q", lhs.Name)
+	}
+	g.stmt("%s = %s;", v, val)
+	return val, nil
+}
+
+// genLogical generates short-circuit evaluation of "&&" and "||".
+// The right hand side is evaluated only if the left hand side does not decide the result.
+// The result is 0.0 or 1.0.
+func (g *Generator) genLogical(e *ast.BinaryExpr) (string, error) {
+	l, err := g.genExpr(e.LHS)
+	if err != nil {
+		return "", err
+	}
+	result := g.newTemp()
+
+	// the value of the expression when the right hand side is skipped.
+	cond, short := "kl_truthy(%s)", literal(0.0)
+	if e.Op == "||" {
+		cond, short = "!kl_truthy(%s)", literal(1.0)
+	}
+	g.stmt("if ("+cond+") {", l)
+	g.indent++
+	r, err := g.genExpr(e.RHS)
+	if err != nil {
+		return "", err
+	}
+	g.stmt("%s = kl_bool(kl_truthy(%s));", result, r)
+	g.indent--
+	g.stmt("} else {")
+	g.stmt("\t%s = %s;", result, short)
+	g.stmt("}")
+	return result, nil
+}
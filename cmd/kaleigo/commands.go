@@ -0,0 +1,260 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// newFlagSet creates a flag set of the subcommand, which prints usage as
+// "usage: kaleigo <name> <synopsis>" followed by the flags.
+func newFlagSet(name, synopsis string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: kaleigo %s %s\n", name, synopsis)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses the arguments of a subcommand. If it returns false, the command should exit with code.
+func parseFlags(fs *flag.FlagSet, args []string) (code int, ok bool) {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+// sourceArg returns the source file name given as the first positional argument.
+func sourceArg(fs *flag.FlagSet) (string, bool) {
+	if fs.NArg() < 1 {
+		fmt.Fprintln(fs.Output(), "no file name given.")
+		fs.Usage()
+		return "", false
+	}
+	return fs.Arg(0), true
+}
+
+func optLevelFlag(fs *flag.FlagSet) *int {
+	return fs.Int("O", 0, "optimization level (0-3)")
+}
+
+func backendFlag(fs *flag.FlagSet) *string {
+	return fs.String("backend", DefaultBackend, "backend to run the program with: jit, interp, vm, native or c")
+}
+
+// targetFlags defines the flags that select the machine to generate native code for.
+// Their values are stored in opts.
+func targetFlags(fs *flag.FlagSet, opts *Options) {
+	fs.StringVar(&opts.Target, "target", "", "target triple to generate code for, such as aarch64-unknown-linux-gnu (default: the host)")
+	fs.StringVar(&opts.CPU, "mcpu", "", "target CPU, such as cortex-a72")
+	fs.StringVar(&opts.Features, "mattr", "", "comma separated target features, such as +avx2,-sse4.1")
+	fs.BoolVar(&opts.Debug, "g", false, "generate DWARF debug info")
+}
+
+// linkFlags defines the flags that configure linking of executables.
+// Their values are stored in opts.
+func linkFlags(fs *flag.FlagSet, opts *Options) {
+	fs.StringVar(&opts.CC, "cc", "", "C compiler used to link executables (default: $CC or "+DefaultCC+"); required to build for another target")
+	fs.Func("ldflags", "extra space separated flags passed to the C compiler when linking", func(s string) error {
+		opts.LDFlags = append(opts.LDFlags, strings.Fields(s)...)
+		return nil
+	})
+	fs.Func("libs", "comma separated libraries to link (default: "+strings.Join(DefaultLibs, ",")+")", func(s string) error {
+		opts.Libs = []string{}
+		for _, l := range strings.Split(s, ",") {
+			if l = strings.TrimSpace(l); l != "" {
+				opts.Libs = append(opts.Libs, l)
+			}
+		}
+		return nil
+	})
+}
+
+// reportError prints err to stderr, and returns exitError.
+func reportError(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+	return exitError
+}
+
+func runBuild(args []string) int {
+	fs := newFlagSet("build", "[--backend=native|c] [--target=triple] [-g] [--cc=compiler] [--ldflags=flags] [--libs=libs] [-o output] [-O level] file.kl")
+	out := fs.String("o", "a.out", "output executable name")
+	backend := fs.String("backend", DefaultBuildBackend, "backend to build the executable with: native (LLVM) or c")
+	opt := optLevelFlag(fs)
+	var opts Options
+	targetFlags(fs, &opts)
+	linkFlags(fs, &opts)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	filename, ok := sourceArg(fs)
+	if !ok || fs.NArg() > 1 {
+		return exitUsage
+	}
+
+	opts.OptLevel, opts.Backend = *opt, *backend
+	c := NewCompiler(opts)
+	if err := c.CompileFile(filename, *out); err != nil {
+		return reportError(err)
+	}
+	return exitOK
+}
+
+func runRun(args []string) int {
+	fs := newFlagSet("run", "[--backend=jit|interp|vm|native|c] [--cc=compiler] [--ldflags=flags] [--libs=libs] [-O level] file.kl [-- arguments]")
+	backend := backendFlag(fs)
+	opt := optLevelFlag(fs)
+	var opts Options
+	linkFlags(fs, &opts)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	filename, ok := sourceArg(fs)
+	if !ok {
+		return exitUsage
+	}
+	progArgs := fs.Args()[1:]
+	if len(progArgs) > 0 && progArgs[0] == "--" {
+		progArgs = progArgs[1:]
+	}
+
+	opts.OptLevel, opts.Backend = *opt, *backend
+	c := NewCompiler(opts)
+	if *backend != BackendNative && *backend != BackendC {
+		if _, err := c.RunFile(filename); err != nil {
+			return reportError(err)
+		}
+		return exitOK
+	}
+
+	dir, err := ioutil.TempDir("", "kaleigo")
+	if err != nil {
+		return reportError(err)
+	}
+	defer os.RemoveAll(dir)
+
+	exe := filepath.Join(dir, strings.TrimSuffix(filepath.Base(filename), ".kl"))
+	if err := c.CompileFile(filename, exe); err != nil {
+		return reportError(err)
+	}
+
+	cmd := exec.Command(exe, progArgs...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			if code := exit.ExitCode(); code > 0 {
+				return code
+			}
+		}
+		return reportError(err)
+	}
+	return exitOK
+}
+
+func runCheck(args []string) int {
+	fs := newFlagSet("check", "file.kl")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	filename, ok := sourceArg(fs)
+	if !ok || fs.NArg() > 1 {
+		return exitUsage
+	}
+
+	c := NewCompiler(Options{})
+	if err := c.CheckFile(filename); err != nil {
+		return reportError(err)
+	}
+	return exitOK
+}
+
+// formatExts are the default file extensions of the emit command's output formats.
+var formatExts = map[string]string{
+	FormatIR:  ".ll",
+	FormatBC:  ".bc",
+	FormatAsm: ".s",
+	FormatObj: ".o",
+
+	FormatBytecode: BytecodeExt,
+	FormatDisasm:   ".kasm",
+	FormatC:        ".c",
+	FormatWasm:     ".wasm",
+	FormatWat:      ".wat",
+}
+
+func runEmit(args []string) int {
+	fs := newFlagSet("emit", "[--format=ir|bc|asm|obj|bytecode|disasm|c|wasm|wat] [--target=triple] [-g] [-o output] [-O level] file.kl")
+	format := fs.String("format", FormatObj, "output format: ir, bc, asm, obj, bytecode, disasm, c, wasm or wat")
+	out := fs.String("o", "", "output file name, or - for stdout (default: the source file name with the format's extension)")
+	opt := optLevelFlag(fs)
+	var opts Options
+	targetFlags(fs, &opts)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	filename, ok := sourceArg(fs)
+	if !ok || fs.NArg() > 1 {
+		return exitUsage
+	}
+	ext, ok := formatExts[*format]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown output format: %q\n", *format)
+		fs.Usage()
+		return exitUsage
+	}
+
+	outname := *out
+	if outname == "" {
+		outname = strings.TrimSuffix(filepath.Base(filename), ".kl") + ext
+	}
+
+	var w io.Writer = os.Stdout
+	if outname != "-" {
+		fh, err := os.Create(outname)
+		if err != nil {
+			return reportError(err)
+		}
+		defer fh.Close()
+		w = fh
+	}
+
+	opts.OptLevel = *opt
+	c := NewCompiler(opts)
+	if err := c.EmitFile(filename, w, *format); err != nil {
+		if outname != "-" {
+			os.Remove(outname)
+		}
+		return reportError(err)
+	}
+	return exitOK
+}
+
+func runRepl(args []string) int {
+	fs := newFlagSet("repl", "[--backend=jit|interp|vm] [-O level]")
+	backend := backendFlag(fs)
+	opt := optLevelFlag(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	c := NewCompiler(Options{OptLevel: *opt, Backend: *backend})
+	if err := newRepl(c, os.Stdin, os.Stdout, os.Stderr).run(); err != nil {
+		return reportError(err)
+	}
+	return exitOK
+}
@@ -1,66 +1,348 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/agatan/kaleigo/ast"
-	"github.com/agatan/kaleigo/codegen"
+	"github.com/agatan/kaleigo/cgen"
+	"github.com/agatan/kaleigo/interp"
+	"github.com/agatan/kaleigo/lib"
 	"github.com/agatan/kaleigo/parse"
+	"github.com/agatan/kaleigo/sema"
+	"github.com/agatan/kaleigo/vm"
+	"github.com/agatan/kaleigo/wasm"
 )
 
+// Backends that run programs.
+const (
+	BackendJIT    = "jit"    // in process with the LLVM execution engine
+	BackendInterp = "interp" // with the tree-walking interpreter, which does not need LLVM
+	BackendVM     = "vm"     // with the bytecode virtual machine, which does not need LLVM
+	BackendNative = "native" // as a native executable built with LLVM and the C compiler
+	BackendC      = "c"      // as a native executable built from C source with the C compiler
+)
+
+// Options are compile options.
+type Options struct {
+	OptLevel int    // optimization level from 0 to codegen.MaxOptLevel
+	Backend  string // backend to run programs with; DefaultBackend if empty
+
+	// machine to generate native code for with LLVM; the host if empty
+	Target   string // target triple
+	CPU      string // target CPU
+	Features string // comma separated target features
+	Debug    bool   // generate DWARF debug info
+
+	// linking of executables
+	CC      string   // C compiler command, which may have arguments; $CC or DefaultCC if empty
+	LDFlags []string // extra flags passed to the C compiler when linking
+	Libs    []string // libraries linked with -l; DefaultLibs if nil
+}
+
+// DefaultCC is the C compiler used when neither Options.CC nor $CC is set.
+const DefaultCC = "cc"
+
+// DefaultLibs are the libraries linked into executables by default.
+// The C math library is needed by '%' and the math externs.
+var DefaultLibs = []string{"m"}
+
 // Compiler holds compile options and status
 type Compiler struct {
-	cc string
+	cc   []string // C compiler command and its arguments
+	opts Options
 }
 
-// NewCompiler creates a new compiler with the options.(currently option is none.)
-func NewCompiler() *Compiler {
-	cc := os.Getenv("CC")
+// NewCompiler creates a new compiler with the options.
+func NewCompiler(opts Options) *Compiler {
+	cc := opts.CC
 	if cc == "" {
-		cc = "CC"
+		cc = os.Getenv("CC")
+	}
+	if strings.TrimSpace(cc) == "" {
+		cc = DefaultCC
+	}
+	if opts.Backend == "" {
+		opts.Backend = DefaultBackend
+	}
+	if opts.Libs == nil {
+		opts.Libs = DefaultLibs
 	}
 	return &Compiler{
-		cc: cc,
+		cc:   strings.Fields(cc),
+		opts: opts,
+	}
+}
+
+// Output formats of Compiler.EmitFile.
+const (
+	FormatIR       = "ir"
+	FormatBC       = "bc"
+	FormatAsm      = "asm"
+	FormatObj      = "obj"
+	FormatBytecode = "bytecode" // bytecode of the virtual machine, which RunFile can run
+	FormatDisasm   = "disasm"   // disassembly of the bytecode
+	FormatC        = "c"        // C source of the C backend
+	FormatWasm     = "wasm"     // WebAssembly binary module, which lib/runtime.js can run
+	FormatWat      = "wat"      // WebAssembly text format
+)
+
+// BytecodeExt is the file extension of bytecode files.
+const BytecodeExt = ".kbc"
+
+// CheckFile parses and analyzes the file, and returns the errors found.
+// It does not generate code, so it works with any backend.
+func (c *Compiler) CheckFile(filename string) error {
+	f, err := c.parseFile(filename)
+	if err != nil {
+		return err
+	}
+	return c.check(f)
+}
+
+// check analyzes the program, and returns the errors found.
+func (c *Compiler) check(f *ast.File) error {
+	_, err := sema.Check(f)
+	return err
+}
+
+// EmitFile compiles the file and writes the output of the given format to out.
+func (c *Compiler) EmitFile(filename string, out io.Writer, format string) error {
+	f, err := c.parseFile(filename)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case FormatC, FormatBytecode, FormatDisasm, FormatWasm, FormatWat:
+		if err := c.checkDoubleOnly(f); err != nil {
+			return err
+		}
+	}
+
+	switch format {
+	case FormatC:
+		return cgen.NewGenerator().Generate(f, out)
+	case FormatBytecode, FormatDisasm:
+		p, err := vm.Compile(f)
+		if err != nil {
+			return err
+		}
+		if format == FormatBytecode {
+			return p.Encode(out)
+		}
+		return p.Disassemble(out)
+	case FormatWasm, FormatWat:
+		m, err := wasm.Compile(f)
+		if err != nil {
+			return err
+		}
+		if format == FormatWasm {
+			return m.WriteBinary(out)
+		}
+		return m.WriteText(out)
+	default:
+		return c.emitLLVM(f, out, format)
+	}
+}
+
+// RunFile runs the file with the backend of the compile options, and returns the value
+// of the last top-level expression.
+// Bytecode files, which have BytecodeExt, are run with the virtual machine.
+func (c *Compiler) RunFile(filename string) (float64, error) {
+	if filepath.Ext(filename) == BytecodeExt {
+		return c.runBytecode(filename)
+	}
+	f, err := c.parseFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	return c.run(f)
+}
+
+// run runs the program with the backend of the compile options.
+func (c *Compiler) run(f *ast.File) (float64, error) {
+	if c.opts.Backend != BackendJIT {
+		if err := c.checkDoubleOnly(f); err != nil {
+			return 0, err
+		}
+	}
+	switch c.opts.Backend {
+	case BackendJIT:
+		return c.runJIT(f)
+	case BackendInterp:
+		return interp.New(os.Stdout).Run(f)
+	case BackendVM:
+		p, err := vm.Compile(f)
+		if err != nil {
+			return 0, err
+		}
+		return vm.New(os.Stdout).Run(p)
+	default:
+		return 0, fmt.Errorf("backend %q cannot run programs in process", c.opts.Backend)
 	}
 }
 
+// CompileFile compiles the file into an executable named outname with the backend
+// of the compile options, which is BackendNative or BackendC.
 func (c *Compiler) CompileFile(filename string, outname string) error {
 	f, err := c.parseFile(filename)
 	if err != nil {
 		return err
 	}
 
-	g := codegen.NewGenerator("kaleigo")
-	defer g.Dispose()
+	switch c.opts.Backend {
+	case BackendNative:
+		return c.compileNative(f, outname)
+	case BackendC:
+		return c.compileC(f, outname)
+	default:
+		return fmt.Errorf("backend %q cannot build executables", c.opts.Backend)
+	}
+}
 
-	base := filepath.Base(outname)
-	obj := base + ".o"
+// compileC translates the program into C, and compiles it into an executable named outname.
+func (c *Compiler) compileC(f *ast.File, outname string) error {
+	if err := c.checkDoubleOnly(f); err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "kaleigo")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
 
-	objh, err := os.Create(obj)
+	src := filepath.Join(dir, strings.TrimSuffix(filepath.Base(outname), filepath.Ext(outname))+".c")
+	fh, err := os.Create(src)
 	if err != nil {
 		return err
 	}
-	defer func(name string) {
-		if err := os.Remove(name); err != nil {
-			panic(err)
-		}
-	}(obj)
-	defer func(objh io.Closer) {
-		if err := objh.Close(); err != nil {
-			panic(err)
+	err = cgen.NewGenerator().Generate(f, fh)
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.link(dir, src, outname)
+}
+
+// link compiles and links the input, a C source or an object file, with the runtime into
+// an executable named outname with the C compiler. The runtime is written into a subdirectory of dir.
+// The errors include the output of the C compiler.
+func (c *Compiler) link(dir string, input string, outname string) error {
+	rtdir := filepath.Join(dir, "runtime")
+	if err := os.Mkdir(rtdir, 0755); err != nil {
+		return err
+	}
+	runtime := filepath.Join(rtdir, lib.RuntimeCName)
+	if err := ioutil.WriteFile(runtime, lib.RuntimeC, 0644); err != nil {
+		return err
+	}
+
+	args := append([]string{}, c.cc[1:]...)
+	args = append(args, "-o", outname, input, runtime)
+	args = append(args, c.opts.LDFlags...)
+	for _, l := range c.opts.Libs {
+		args = append(args, "-l"+l)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(c.cc[0], args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("linking with %s: %v\n%s", strings.Join(c.cc, " "), err, msg)
 		}
-	}(objh)
+		return fmt.Errorf("linking with %s: %v", strings.Join(c.cc, " "), err)
+	}
+	os.Stderr.Write(stderr.Bytes()) // warnings
+	return nil
+}
 
-	if err := g.Emit(f, objh); err != nil {
+// checkLinkTarget reports an error if executables for the target triple, which is not the host,
+// would be linked with $CC or DefaultCC, which link executables for the host.
+// A C compiler for the target, such as "aarch64-linux-gnu-gcc", must be given by Options.CC.
+func (c *Compiler) checkLinkTarget(target, host string) error {
+	if target == host || c.opts.CC != "" {
+		return nil
+	}
+	return fmt.Errorf("cannot link executables for %s with %s; give a C compiler for the target with --cc", target, strings.Join(c.cc, " "))
+}
+
+// checkDoubleOnly analyzes the program for the backends other than the LLVM ones, which generate
+// code without the analysis, so that they accept the same programs as the LLVM backends. It also
+// reports an error if the program has values of i64 or strings, which only the LLVM backends
+// support. The other backends represent all values as doubles, which is right for bool as well,
+// since booleans are 0 or 1.
+func (c *Compiler) checkDoubleOnly(f *ast.File) error {
+	if err := c.check(f); err != nil {
 		return err
 	}
 
-	cmd := exec.Command("gcc", obj, "lib/runtime.c", "-o", outname)
-	return cmd.Run()
+	var span ast.Span
+	found := ast.NoType
+	check := func(node ast.Node, t ast.Type) {
+		if (t == ast.TypeI64 || t == ast.TypeString) && found == ast.NoType {
+			span, found = node.Loc(), t
+		}
+	}
+
+	walk := func(e ast.Expr) {
+		ast.Inspect(e, func(e ast.Expr) bool {
+			switch e := e.(type) {
+			case *ast.StringExpr:
+				check(e, ast.TypeString)
+			case *ast.VarExpr:
+				for _, b := range e.Vars {
+					check(b, b.Type)
+				}
+			}
+			return true
+		})
+	}
+
+	protos := append([]*ast.Prototype{}, f.Externs...)
+	for _, def := range f.Defs {
+		protos = append(protos, def.Prototype)
+		walk(def.Body)
+	}
+	for _, p := range protos {
+		check(p, p.ResultType)
+		for i := range p.Args {
+			check(p, p.ArgType(i))
+		}
+	}
+	for _, e := range f.Exprs {
+		walk(e)
+	}
+
+	if found == ast.NoType {
+		return nil
+	}
+	return fmt.Errorf("%s:%s: %s is supported only by the %s and %s backends", f.Name, span.Start, found, BackendJIT, BackendNative)
+}
+
+func (c *Compiler) runBytecode(filename string) (float64, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+
+	p, err := vm.Decode(fh)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", filename, err)
+	}
+	return vm.New(os.Stdout).Run(p)
 }
 
 func (c *Compiler) parseFile(filename string) (*ast.File, error) {
@@ -81,5 +363,5 @@ func (c *Compiler) parseFile(filename string) (*ast.File, error) {
 	}
 
 	p := parse.New(filename, string(input))
-	return p.Parse(), nil
+	return p.Parse()
 }
@@ -0,0 +1,127 @@
+//go:build !nollvm
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/agatan/kaleigo/ast"
+	"github.com/agatan/kaleigo/codegen"
+)
+
+// Default backends of running and building programs.
+const (
+	DefaultBackend      = BackendJIT
+	DefaultBuildBackend = BackendNative
+)
+
+var outputKinds = map[string]codegen.OutputKind{
+	FormatIR:  codegen.IRText,
+	FormatBC:  codegen.Bitcode,
+	FormatAsm: codegen.AssemblyFile,
+	FormatObj: codegen.ObjectFile,
+}
+
+// newGenerator creates a code generator configured with the compile options.
+// The caller must dispose it.
+func (c *Compiler) newGenerator() (*codegen.Generator, error) {
+	g := codegen.NewGenerator("kaleigo")
+	if err := g.SetOptLevel(c.opts.OptLevel); err != nil {
+		g.Dispose()
+		return nil, err
+	}
+	if c.opts.Target != "" || c.opts.CPU != "" || c.opts.Features != "" {
+		err := g.SetTarget(codegen.Target{Triple: c.opts.Target, CPU: c.opts.CPU, Features: c.opts.Features})
+		if err != nil {
+			g.Dispose()
+			return nil, err
+		}
+	}
+	if c.opts.Debug {
+		g.EnableDebugInfo()
+	}
+	return g, nil
+}
+
+// emitLLVM compiles the program with LLVM and writes the output of the given format to out.
+func (c *Compiler) emitLLVM(f *ast.File, out io.Writer, format string) error {
+	kind, ok := outputKinds[format]
+	if !ok {
+		return fmt.Errorf("unknown output format: %q", format)
+	}
+
+	g, err := c.newGenerator()
+	if err != nil {
+		return err
+	}
+	defer g.Dispose()
+
+	return g.Emit(f, out, kind)
+}
+
+// runJIT compiles the program in memory and runs it with the JIT execution engine.
+func (c *Compiler) runJIT(f *ast.File) (float64, error) {
+	g, err := c.newGenerator()
+	if err != nil {
+		return 0, err
+	}
+	defer g.Dispose()
+
+	return g.Run(f)
+}
+
+// newSession creates a session of the repl. The JIT backend compiles only the functions that are
+// new or redefined, and keeps the ones compiled before.
+func (c *Compiler) newSession() (session, error) {
+	if c.opts.Backend != BackendJIT {
+		return runSession{c}, nil
+	}
+	g, err := c.newGenerator()
+	if err != nil {
+		return nil, err
+	}
+	s, err := codegen.NewSession(g)
+	if err != nil {
+		g.Dispose()
+		return nil, err
+	}
+	return s, nil
+}
+
+// compileNative compiles the program into an executable named outname with LLVM.
+func (c *Compiler) compileNative(f *ast.File, outname string) error {
+	g, err := c.newGenerator()
+	if err != nil {
+		return err
+	}
+	defer g.Dispose()
+	if err := c.checkLinkTarget(g.Target().Triple, codegen.HostTarget().Triple); err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "kaleigo")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	obj := filepath.Join(dir, strings.TrimSuffix(filepath.Base(outname), filepath.Ext(outname))+".o")
+	fh, err := os.Create(obj)
+	if err != nil {
+		return err
+	}
+	err = g.Emit(f, fh, codegen.ObjectFile)
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.link(dir, obj, outname)
+}
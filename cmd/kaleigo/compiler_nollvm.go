@@ -0,0 +1,35 @@
+//go:build nollvm
+
+package main
+
+import (
+	"errors"
+	"io"
+
+	"github.com/agatan/kaleigo/ast"
+)
+
+// Default backends of running and building programs.
+// Without LLVM, programs are run with the interpreter, and built with the C backend.
+const (
+	DefaultBackend      = BackendInterp
+	DefaultBuildBackend = BackendC
+)
+
+var errNoLLVM = errors.New("kaleigo is built without LLVM (with the nollvm tag); use the interp, vm or c backend")
+
+func (c *Compiler) emitLLVM(f *ast.File, out io.Writer, format string) error {
+	return errNoLLVM
+}
+
+func (c *Compiler) runJIT(f *ast.File) (float64, error) {
+	return 0, errNoLLVM
+}
+
+func (c *Compiler) compileNative(f *ast.File, outname string) error {
+	return errNoLLVM
+}
+
+func (c *Compiler) newSession() (session, error) {
+	return runSession{c}, nil
+}
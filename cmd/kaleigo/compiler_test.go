@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckLinkTarget(t *testing.T) {
+	const host = "x86_64-pc-linux-gnu"
+	cases := []struct {
+		target string
+		cc     string
+		ok     bool
+	}{
+		{host, "", true},
+		{host, "clang", true},
+		{"aarch64-unknown-linux-gnu", "", false},
+		{"aarch64-unknown-linux-gnu", "aarch64-linux-gnu-gcc", true},
+	}
+	for _, c := range cases {
+		err := NewCompiler(Options{Target: c.target, CC: c.cc}).checkLinkTarget(c.target, host)
+		if c.ok && err != nil {
+			t.Errorf("target %s with --cc=%q: unexpected error: %v", c.target, c.cc, err)
+		}
+		if !c.ok && (err == nil || !strings.Contains(err.Error(), "--cc")) {
+			t.Errorf("target %s with --cc=%q: expected an error suggesting --cc, actual %v", c.target, c.cc, err)
+		}
+	}
+}
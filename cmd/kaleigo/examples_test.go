@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/agatan/kaleigo/interp"
+	"github.com/agatan/kaleigo/vm"
+)
+
+// exampleOutputs are the outputs of the programs in the example directory that the
+// backends without LLVM support.
+var exampleOutputs = map[string]string{
+	"if_expr.kl":   "2.000000\n3.000000\n",
+	"logical.kl":   "1.000000\n0.000000\n1.000000\n",
+	"operators.kl": "1.000000\n0.000000\n",
+	"recursive.kl": "0.000000\n-0.500000\n",
+	"test.kl":      "3.000000\n1.000000\n0.000000\n3.500000\n1.000000\n1.000000\n0.000000\n",
+	"var.kl":       "55.000000\n",
+}
+
+// TestExamples runs the examples with the backends that do not need LLVM, and checks their outputs.
+// Examples that only the LLVM backends support are skipped.
+func TestExamples(t *testing.T) {
+	files, err := filepath.Glob("../../example/*.kl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no examples found")
+	}
+	cc, ccErr := exec.LookPath(DefaultCC)
+	dir, err := ioutil.TempDir("", "kaleigo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := NewCompiler(Options{CC: cc})
+	for _, file := range files {
+		name := filepath.Base(file)
+		f, err := c.parseFile(file)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if err := c.checkDoubleOnly(f); err != nil {
+			t.Logf("%s: skipped: %s", name, err)
+			continue
+		}
+		expected, ok := exampleOutputs[name]
+		if !ok {
+			t.Errorf("%s: no expected output", name)
+			continue
+		}
+
+		var out bytes.Buffer
+		if _, err := interp.New(&out).Run(f); err != nil {
+			t.Errorf("%s: interp: %s", name, err)
+		} else if out.String() != expected {
+			t.Errorf("%s: interp: expected output %q, actual %q", name, expected, out.String())
+		}
+
+		p, err := vm.Compile(f)
+		if err != nil {
+			t.Errorf("%s: vm: %s", name, err)
+			continue
+		}
+		out.Reset()
+		if _, err := vm.New(&out).Run(p); err != nil {
+			t.Errorf("%s: vm: %s", name, err)
+		} else if out.String() != expected {
+			t.Errorf("%s: vm: expected output %q, actual %q", name, expected, out.String())
+		}
+
+		if ccErr != nil {
+			continue
+		}
+		exe := filepath.Join(dir, "example")
+		if err := c.compileC(f, exe); err != nil {
+			t.Errorf("%s: c: %s", name, err)
+			continue
+		}
+		actual, err := exec.Command(exe).Output()
+		if err != nil {
+			t.Errorf("%s: c: %s", name, err)
+		} else if string(actual) != expected {
+			t.Errorf("%s: c: expected output %q, actual %q", name, expected, actual)
+		}
+	}
+}
@@ -2,19 +2,87 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"regexp"
 )
 
+// exit codes
+const (
+	exitOK    = 0
+	exitError = 1 // compile errors or failures of the program
+	exitUsage = 2
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands []*command
+
+func init() {
+	// initialized here to avoid an initialization loop through usage.
+	commands = []*command{
+		{"build", "compile a source file into an executable", runBuild},
+		{"run", "run a source file with the JIT, the interpreter or as a native executable", runRun},
+		{"check", "check a source file for errors", runCheck},
+		{"emit", "compile a source file into LLVM IR, bitcode, assembly, an object file, VM bytecode or C", runEmit},
+		{"repl", "start an interactive session", runRepl},
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: kaleigo <command> [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-7s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'kaleigo <command> -h' for the flags of a command.")
+}
+
 func main() {
-	if len(os.Args) <= 1 {
-		fmt.Fprintln(os.Stderr, "no file name given.")
-		return
+	os.Exit(dispatch(os.Args[1:]))
+}
+
+func dispatch(args []string) int {
+	if len(args) < 1 {
+		usage(os.Stderr)
+		return exitUsage
 	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		usage(os.Stdout)
+		return exitOK
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(normalizeOptFlags(args[1:]))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "kaleigo: unknown command %q\n", args[0])
+	usage(os.Stderr)
+	return exitUsage
+}
+
+// gccOptFlag matches gcc style optimization flags such as "-O2".
+var gccOptFlag = regexp.MustCompile(`^-O([0-9]+)$`)
 
-	c := NewCompiler()
-	err := c.CompileFile(os.Args[1], "a.out")
-	if err != nil {
-		log.Fatalln(err)
+// normalizeOptFlags rewrites "-O2" into "-O=2", so that the flag package accepts it
+// as well as "-O=2" and "-O 2". Arguments after "--" are left untouched.
+func normalizeOptFlags(args []string) []string {
+	normalized := make([]string, len(args))
+	copy(normalized, args)
+	for i, arg := range normalized {
+		if arg == "--" {
+			break
+		}
+		if m := gccOptFlag.FindStringSubmatch(arg); m != nil {
+			normalized[i] = "-O=" + m[1]
+		}
 	}
+	return normalized
 }
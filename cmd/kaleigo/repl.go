@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/agatan/kaleigo/ast"
+	"github.com/agatan/kaleigo/parse"
+)
+
+const (
+	replPrompt    = "ready> "
+	replContinued = "...> "
+	replInputName = "<stdin>"
+)
+
+// repl is an interactive session. It keeps the externs and the definitions entered so far,
+// and evaluates each toplevel expression with the backend as soon as it is entered.
+type repl struct {
+	c       *Compiler
+	session session
+	in      *bufio.Scanner
+	out     io.Writer
+	errOut  io.Writer
+	externs []*ast.Prototype
+	defs    []*ast.Function
+}
+
+func newRepl(c *Compiler, in io.Reader, out, errOut io.Writer) *repl {
+	return &repl{
+		c:      c,
+		in:     bufio.NewScanner(in),
+		out:    out,
+		errOut: errOut,
+	}
+}
+
+// run reads and evaluates the input line by line until the end of the input.
+// An input that ends in the middle of an item is continued on the next line.
+func (r *repl) run() error {
+	session, err := r.c.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Dispose()
+	r.session = session
+
+	var src strings.Builder
+	prompt := replPrompt
+	for {
+		fmt.Fprint(r.out, prompt)
+		if !r.in.Scan() {
+			fmt.Fprintln(r.out)
+			return r.in.Err()
+		}
+		src.WriteString(r.in.Text())
+		src.WriteByte('\n')
+
+		if r.incomplete(src.String()) {
+			prompt = replContinued
+			continue
+		}
+		r.eval(src.String())
+		src.Reset()
+		prompt = replPrompt
+	}
+}
+
+// newParser creates a parser of src that knows the user-defined operators declared or defined so far.
+func (r *repl) newParser(src string) *parse.Parser {
+	p := parse.New(replInputName, src)
+	for _, extern := range r.externs {
+		p.Declare(extern)
+	}
+	for _, def := range r.defs {
+		p.Declare(def.Prototype)
+	}
+	return p
+}
+
+// incomplete reports whether src is a prefix of valid input, i.e. whether parsing it fails first
+// because of the unexpected end of the input. The errors after the first one may be caused by it.
+func (r *repl) incomplete(src string) bool {
+	_, err := r.newParser(src).Parse()
+	errs, ok := err.(parse.ErrorList)
+	return ok && len(errs) > 0 && errs[0].AtEOF()
+}
+
+// eval parses the toplevel items in src one by one and processes them.
+// It stops at the first error.
+func (r *repl) eval(src string) {
+	p := r.newParser(src)
+	for {
+		var err error
+		switch p.NextItem() {
+		case parse.ItemEOF:
+			return
+		case parse.ItemDefinition:
+			var f *ast.Function
+			if f, err = p.ParseDefinition(); err == nil {
+				err = r.define(f)
+			}
+		case parse.ItemExtern:
+			var proto *ast.Prototype
+			if proto, err = p.ParseExtern(); err == nil {
+				err = r.declare(proto)
+			}
+		case parse.ItemExpression:
+			var expr ast.Expr
+			if expr, err = p.ParseExpression(); err == nil {
+				err = r.evaluate(expr)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(r.errOut, err)
+			return
+		}
+	}
+}
+
+// define adds the function definition to the session, or replaces the previous definition of the same name.
+// The definition is compiled once with the current session, and rejected if it has an error.
+func (r *repl) define(f *ast.Function) error {
+	defs := make([]*ast.Function, 0, len(r.defs)+1)
+	replaced := false
+	for _, def := range r.defs {
+		if def.Name == f.Name {
+			def = f
+			replaced = true
+		}
+		defs = append(defs, def)
+	}
+	if !replaced {
+		defs = append(defs, f)
+	}
+
+	if err := r.check(r.externs, defs); err != nil {
+		return err
+	}
+	r.defs = defs
+	return nil
+}
+
+// declare adds the external function declaration to the session, or replaces the previous one of the same name.
+func (r *repl) declare(proto *ast.Prototype) error {
+	externs := make([]*ast.Prototype, 0, len(r.externs)+1)
+	for _, extern := range r.externs {
+		if extern.Name != proto.Name {
+			externs = append(externs, extern)
+		}
+	}
+	externs = append(externs, proto)
+
+	if err := r.check(externs, r.defs); err != nil {
+		return err
+	}
+	r.externs = externs
+	return nil
+}
+
+// check analyzes the externs and the definitions, and returns the errors found.
+func (r *repl) check(externs []*ast.Prototype, defs []*ast.Function) error {
+	return r.c.check(&ast.File{Name: replInputName, Externs: externs, Defs: defs})
+}
+
+// evaluate runs the expression with the definitions in the session, and prints its value.
+func (r *repl) evaluate(expr ast.Expr) error {
+	v, err := r.session.Run(&ast.File{
+		Name:    replInputName,
+		Externs: r.externs,
+		Defs:    r.defs,
+		Exprs:   []ast.Expr{expr},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(r.out, v)
+	return nil
+}
+
+// session runs the programs of an interactive session, each of which is the definitions and
+// the externs entered so far with an expression.
+type session interface {
+	Run(f *ast.File) (float64, error)
+	Dispose()
+}
+
+// runSession is a session that runs each program from scratch with the backend.
+type runSession struct {
+	c *Compiler
+}
+
+func (s runSession) Run(f *ast.File) (float64, error) {
+	return s.c.run(f)
+}
+
+func (s runSession) Dispose() {}
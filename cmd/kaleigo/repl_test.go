@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReplIncomplete(t *testing.T) {
+	cases := []struct {
+		src        string
+		incomplete bool
+	}{
+		{"1 +\n", true},
+		{"def f(x)\n", true},
+		{"(1 + 2\n", true},
+		{"1 + 2\n", false},
+		{") ; 1 +\n", false},
+		{"def f(x y) x +\n", false},
+	}
+	r := newRepl(NewCompiler(Options{Backend: BackendInterp}), strings.NewReader(""), &bytes.Buffer{}, &bytes.Buffer{})
+	for _, c := range cases {
+		if incomplete := r.incomplete(c.src); incomplete != c.incomplete {
+			t.Errorf("%q: expected incomplete=%v, actual %v", c.src, c.incomplete, incomplete)
+		}
+	}
+}
+
+func TestRepl(t *testing.T) {
+	in := strings.Join([]string{
+		") ; 1 +",
+		"def f(x)",
+		"  x + 1",
+		"f(2)",
+		"def f(x) x * 10",
+		"f(2)",
+	}, "\n") + "\n"
+	var out, errOut bytes.Buffer
+	r := newRepl(NewCompiler(Options{Backend: BackendInterp}), strings.NewReader(in), &out, &errOut)
+	if err := r.run(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "<stdin>:1:1: expected expression, found \")\"\n"; errOut.String() != expected {
+		t.Errorf("expected errors %q, actual %q", expected, errOut.String())
+	}
+	expected := replPrompt + replPrompt + replContinued + replPrompt + "3\n" + replPrompt + replPrompt + "20\n" + replPrompt + "\n"
+	if out.String() != expected {
+		t.Errorf("expected output %q, actual %q", expected, out.String())
+	}
+}
+
+func TestReplExternOperator(t *testing.T) {
+	in := strings.Join([]string{
+		"extern binary| 5 (a b)",
+		"def f(x) x | 1",
+		"def binary| 5 (a b) a + b",
+		"f(2)",
+	}, "\n") + "\n"
+	var out, errOut bytes.Buffer
+	r := newRepl(NewCompiler(Options{Backend: BackendInterp}), strings.NewReader(in), &out, &errOut)
+	if err := r.run(); err != nil {
+		t.Fatal(err)
+	}
+	if errOut.Len() != 0 {
+		t.Errorf("unexpected errors %q", errOut.String())
+	}
+	expected := replPrompt + replPrompt + replPrompt + replPrompt + "3\n" + replPrompt + "\n"
+	if out.String() != expected {
+		t.Errorf("expected output %q, actual %q", expected, out.String())
+	}
+}
@@ -0,0 +1,189 @@
+package codegen
+
+import (
+	"path/filepath"
+
+	"github.com/agatan/kaleigo/ast"
+
+	"llvm.org/llvm/bindings/go/llvm"
+)
+
+// Versions of the debug info written into the module flags.
+const (
+	debugInfoVersion = 3
+	dwarfVersion     = 4
+)
+
+// debugInfo holds the state of DWARF debug info generation for a file.
+type debugInfo struct {
+	builder *llvm.DIBuilder
+	file    llvm.Metadata
+	types   map[ast.Type]llvm.Metadata
+	// scope is the subprogram of the function being generated.
+	scope llvm.Metadata
+	// pos is the current source position of the generated instructions.
+	pos ast.Pos
+}
+
+// EnableDebugInfo makes Generate emit DWARF debug info, which maps the generated code back
+// to the source file: a compile unit, a subprogram for every function, variables for the
+// parameters and the local variables, and the source locations of the expressions.
+func (g *Generator) EnableDebugInfo() {
+	g.debugEnabled = true
+}
+
+// newDebugInfo creates a compile unit of the source file in the module.
+func newDebugInfo(mod llvm.Module, filename string, optimized bool) *debugInfo {
+	dir, name := filepath.Split(filename)
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+
+	d := &debugInfo{builder: llvm.NewDIBuilder(mod), types: make(map[ast.Type]llvm.Metadata)}
+	d.builder.CreateCompileUnit(llvm.DICompileUnit{
+		// kaleigo has no DWARF language code, and debuggers understand C best.
+		Language:  llvm.DW_LANG_C,
+		File:      name,
+		Dir:       dir,
+		Producer:  "kaleigo",
+		Optimized: optimized,
+	})
+	d.file = d.builder.CreateFile(name, dir)
+	for _, t := range []llvm.DIBasicType{
+		{Name: "f64", SizeInBits: 64, Encoding: llvm.DW_ATE_float},
+		{Name: "i64", SizeInBits: 64, Encoding: llvm.DW_ATE_signed},
+		{Name: "bool", SizeInBits: 8, Encoding: llvm.DW_ATE_boolean},
+	} {
+		typ, _ := ast.LookupType(t.Name)
+		d.types[typ] = d.builder.CreateBasicType(t)
+	}
+	d.types[ast.TypeString] = d.stringType(mod)
+
+	addModuleFlag(mod, "Debug Info Version", debugInfoVersion)
+	addModuleFlag(mod, "Dwarf Version", dwarfVersion)
+	return d
+}
+
+// stringType describes strings as struct kaleigo_string of lib/runtime.c, laid out as in the data
+// layout of the module.
+func (d *debugInfo) stringType(mod llvm.Module) llvm.Metadata {
+	data := llvm.NewTargetData(mod.DataLayout())
+	defer data.Dispose()
+	t := stringType()
+	char := d.builder.CreateBasicType(llvm.DIBasicType{Name: "char", SizeInBits: 8, Encoding: llvm.DW_ATE_signed_char})
+	ptrSize := uint64(data.PointerSize()) * 8
+	fields := []struct {
+		name string
+		size uint64
+		typ  llvm.Metadata
+	}{
+		{"ptr", ptrSize, d.builder.CreatePointerType(llvm.DIPointerType{Pointee: char, SizeInBits: ptrSize})},
+		{"len", 64, d.types[ast.TypeI64]},
+	}
+	elements := make([]llvm.Metadata, len(fields))
+	for i, f := range fields {
+		elements[i] = d.builder.CreateMemberType(d.file, llvm.DIMemberType{
+			Name:         f.name,
+			File:         d.file,
+			SizeInBits:   f.size,
+			OffsetInBits: data.ElementOffset(t, i) * 8,
+			Type:         f.typ,
+		})
+	}
+	return d.builder.CreateStructType(d.file, llvm.DIStructType{
+		Name:       "str",
+		File:       d.file,
+		SizeInBits: data.TypeSizeInBits(t),
+		Elements:   elements,
+	})
+}
+
+// addModuleFlag adds an integer module flag, which warns if modules with different values are linked.
+func addModuleFlag(mod llvm.Module, name string, value uint64) {
+	const behaviorWarning = 2
+	ctx := mod.Context()
+	mod.AddNamedMetadataOperand("llvm.module.flags", ctx.MDNode([]llvm.Metadata{
+		llvm.ConstInt(ctx.Int32Type(), behaviorWarning, false).ConstantAsMetadata(),
+		ctx.MDString(name),
+		llvm.ConstInt(ctx.Int32Type(), value, false).ConstantAsMetadata(),
+	}))
+}
+
+// finalize completes the debug info. It must be called after all the functions are generated.
+func (d *debugInfo) finalize() {
+	d.builder.Finalize()
+}
+
+func (d *debugInfo) dispose() {
+	d.builder.Destroy()
+}
+
+// beginFunction attaches a subprogram to the function, and makes it the current scope.
+// The instructions generated by b are located at the function until an expression is generated.
+func (d *debugInfo) beginFunction(b llvm.Builder, fn llvm.Value, f *ast.Function, optimized bool) {
+	// the first is the return type.
+	params := []llvm.Metadata{d.typeOf(fn.Type().ElementType().ReturnType())}
+	for _, param := range fn.Params() {
+		params = append(params, d.typeOf(param.Type()))
+	}
+	line := f.Pos().Line
+	d.scope = d.builder.CreateFunction(d.file, llvm.DIFunction{
+		Name:         f.Name,
+		LinkageName:  fn.Name(),
+		File:         d.file,
+		Line:         line,
+		Type:         d.builder.CreateSubroutineType(llvm.DISubroutineType{File: d.file, Parameters: params}),
+		IsDefinition: true,
+		ScopeLine:    line,
+		Optimized:    optimized,
+	})
+	fn.SetSubprogram(d.scope)
+	// the previous location is in the scope of another function.
+	d.pos = f.Pos()
+	b.SetCurrentDebugLocation(uint(d.pos.Line), uint(d.pos.Column), d.scope, llvm.Metadata{})
+}
+
+// setLocation sets the source position of the instructions generated after the call.
+// Positions of nodes synthesized by the compiler are ignored.
+func (d *debugInfo) setLocation(b llvm.Builder, pos ast.Pos) {
+	if !pos.IsValid() {
+		return
+	}
+	d.pos = pos
+	b.SetCurrentDebugLocation(uint(pos.Line), uint(pos.Column), d.scope, llvm.Metadata{})
+}
+
+// declareParameter describes the argNo-th parameter (starting at 1) stored in the alloca.
+func (d *debugInfo) declareParameter(alloca llvm.Value, name string, argNo int, pos ast.Pos, bb llvm.BasicBlock) {
+	v := d.builder.CreateParameterVariable(d.scope, llvm.DIParameterVariable{
+		Name:           name,
+		File:           d.file,
+		Line:           pos.Line,
+		Type:           d.typeOf(alloca.Type().ElementType()),
+		AlwaysPreserve: true,
+		ArgNo:          argNo,
+	})
+	d.declare(alloca, v, pos, bb)
+}
+
+// declareLocal describes a local variable of var or for stored in the alloca.
+func (d *debugInfo) declareLocal(alloca llvm.Value, name string, pos ast.Pos, bb llvm.BasicBlock) {
+	v := d.builder.CreateAutoVariable(d.scope, llvm.DIAutoVariable{
+		Name:           name,
+		File:           d.file,
+		Line:           pos.Line,
+		Type:           d.typeOf(alloca.Type().ElementType()),
+		AlwaysPreserve: true,
+	})
+	d.declare(alloca, v, pos, bb)
+}
+
+// typeOf returns the debug info type of values of the llvm type.
+func (d *debugInfo) typeOf(t llvm.Type) llvm.Metadata {
+	return d.types[astType(t)]
+}
+
+func (d *debugInfo) declare(alloca llvm.Value, variable llvm.Metadata, pos ast.Pos, bb llvm.BasicBlock) {
+	loc := llvm.DebugLoc{Line: uint(pos.Line), Col: uint(pos.Column), Scope: d.scope}
+	d.builder.InsertDeclareAtEnd(alloca, variable, d.builder.CreateExpression(nil), loc, bb)
+}
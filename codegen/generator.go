@@ -5,14 +5,18 @@ import (
 	"io"
 
 	"github.com/agatan/kaleigo/ast"
+	"github.com/agatan/kaleigo/sema"
 
 	"llvm.org/llvm/bindings/go/llvm"
 )
 
 func init() {
-	llvm.InitializeNativeTarget()
+	// all the targets are initialized for cross-compilation.
+	llvm.InitializeAllTargetInfos()
+	llvm.InitializeAllTargets()
+	llvm.InitializeAllTargetMCs()
 	llvm.InitializeAllAsmParsers()
-	llvm.InitializeNativeAsmPrinter()
+	llvm.InitializeAllAsmPrinters()
 }
 
 // Generator holds all information for llvm code generation.
@@ -20,50 +24,143 @@ type Generator struct {
 	ctx     llvm.Context
 	mod     llvm.Module
 	builder llvm.Builder
-	values  map[string]llvm.Value
+	fpm     llvm.PassManager
+	// values maps variable names to their stack slots created by alloca.
+	values   map[string]llvm.Value
+	filename string // source file name used in error messages
+	optLevel int
+	// target describes the machine code is generated for, and machine generates it.
+	target  Target
+	machine llvm.TargetMachine
+	// debug generates debug info if debugEnabled.
+	debugEnabled bool
+	debug        *debugInfo
+	// info is the analysis of the file by Generate, which gives the types of the expressions,
+	// and inst is the instance of a function being generated.
+	info *sema.Info
+	inst *sema.Instance
+	// symbols maps the names of instances to the names of their functions, where they differ.
+	// They differ only in a Session, which generates a function again under a new name.
+	symbols map[string]string
 }
 
-// New creates a new llvm code generator
+// New creates a new llvm code generator for the host machine.
 func NewGenerator(name string) *Generator {
-	return &Generator{
+	mod := llvm.NewModule(name)
+	g := &Generator{
 		ctx:     llvm.GlobalContext(),
-		mod:     llvm.NewModule(name),
+		mod:     mod,
 		builder: llvm.NewBuilder(),
+		fpm:     newFunctionPassManager(mod, 0),
 		values:  make(map[string]llvm.Value),
 	}
+	if err := g.SetTarget(HostTarget()); err != nil {
+		// the host target is always initialized.
+		panic(err)
+	}
+	return g
 }
 
 func (g *Generator) Dispose() {
+	g.fpm.FinalizeFunc()
+	g.fpm.Dispose()
 	g.mod.Dispose()
 	g.builder.Dispose()
+	g.machine.Dispose()
+	if g.debug != nil {
+		g.debug.dispose()
+	}
+}
+
+// Generate generates llvm IR for all of the externs, definitions and toplevel expressions
+// of the file into the generator's module. The file is analyzed by sema first, so that
+// all the problems in it are reported before any IR is generated.
+func (g *Generator) Generate(fileast *ast.File) error {
+	info, err := sema.Check(fileast)
+	if err != nil {
+		return err
+	}
+	var instances []*sema.Instance
+	for _, inst := range info.Instances {
+		if inst.Func.Defined {
+			instances = append(instances, inst)
+		}
+	}
+	return g.generate(fileast, info, instances)
 }
 
-func (g *Generator) Emit(fileast *ast.File, out io.Writer) error {
+// generate generates llvm IR for the externs of the file and the instances analyzed in info.
+func (g *Generator) generate(fileast *ast.File, info *sema.Info, instances []*sema.Instance) error {
+	g.info = info
+	g.filename = fileast.Name
+	if g.debugEnabled {
+		g.debug = newDebugInfo(g.mod, fileast.Name, g.optLevel > 0)
+	}
+	// all the functions are declared before any body is generated, so that functions can
+	// call the functions defined after them.
 	for _, extern := range fileast.Externs {
 		_, err := g.GenProto(extern)
 		if err != nil {
 			return err
 		}
 	}
-	for _, def := range fileast.Defs {
-		_, err := g.GenFun(def)
-		if err != nil {
+	// every polymorphic function is generated for each combination of types it is called with.
+	for _, inst := range instances {
+		if _, err := g.declareInstance(inst); err != nil {
 			return err
 		}
 	}
-	_, err := g.GenFun(fileast.CreateMain())
-	if err != nil {
+	for _, inst := range instances {
+		if _, err := g.genInstance(inst); err != nil {
+			return err
+		}
+	}
+	if g.debug != nil {
+		g.debug.finalize()
+	}
+	g.optimizeModule()
+	return nil
+}
+
+// OutputKind selects the output format of Emit.
+type OutputKind int
+
+const (
+	ObjectFile   OutputKind = iota // native object file
+	AssemblyFile                   // native assembly (.s)
+	IRText                         // textual llvm IR (.ll)
+	Bitcode                        // llvm bitcode (.bc)
+)
+
+// Emit generates code for the file and writes it to out in the format of kind.
+func (g *Generator) Emit(fileast *ast.File, out io.Writer, kind OutputKind) error {
+	if err := g.Generate(fileast); err != nil {
 		return err
 	}
 
-	target, err := llvm.GetTargetFromTriple(llvm.DefaultTargetTriple())
-	if err != nil {
+	switch kind {
+	case IRText:
+		_, err := io.WriteString(out, g.mod.String())
 		return err
+	case Bitcode:
+		buf := llvm.WriteBitcodeToMemoryBuffer(g.mod)
+		defer buf.Dispose()
+		_, err := out.Write(buf.Bytes())
+		return err
+	case ObjectFile, AssemblyFile:
+		return g.emitNative(out, kind)
+	default:
+		return fmt.Errorf("unknown output kind: %d", kind)
 	}
-	m := target.CreateTargetMachine(llvm.DefaultTargetTriple(), "", "",
-		llvm.CodeGenLevelNone, llvm.RelocDefault, llvm.CodeModelDefault)
+}
 
-	buf, err := m.EmitToMemoryBuffer(g.mod, llvm.ObjectFile)
+// emitNative writes an object file or assembly of the module for the target machine.
+func (g *Generator) emitNative(out io.Writer, kind OutputKind) error {
+	filetype := llvm.ObjectFile
+	if kind == AssemblyFile {
+		filetype = llvm.AssemblyFile
+	}
+	buf, err := g.machine.EmitToMemoryBuffer(g.mod, filetype)
 	if err != nil {
 		return err
 	}
@@ -77,21 +174,69 @@ func (g *Generator) error(err error) error {
 	return err
 }
 
-func (g *Generator) errorf(format string, args ...interface{}) error {
-	return fmt.Errorf(format, args...)
+// errorf returns an error located at pos.
+func (g *Generator) errorf(pos ast.Pos, format string, args ...interface{}) error {
+	return ast.Errorf(g.filename, pos, format, args...)
+}
+
+func (g *Generator) GenExpr(expr ast.Expr) (llvm.Value, error) {
+	if g.debug == nil {
+		return g.genExpr(expr)
+	}
+	// the instructions of the expression are located at it, and the instructions generated
+	// after it by the enclosing expression are located at the enclosing expression.
+	outer := g.debug.pos
+	g.debug.setLocation(g.builder, expr.Pos())
+	val, err := g.genExpr(expr)
+	g.debug.setLocation(g.builder, outer)
+	return val, err
 }
 
-func (g *Generator) GenExpr(expr ast.Expr) (val llvm.Value, err error) {
+func (g *Generator) genExpr(expr ast.Expr) (val llvm.Value, err error) {
 	switch e := expr.(type) {
+	case *ast.ErrorExpr:
+		return val, g.errorf(e.Pos(), "invalid expression")
 	case *ast.NumberExpr:
+		if g.typeOf(e) == ast.TypeI64 {
+			return llvm.ConstInt(llvm.Int64Type(), uint64(int64(e.Val)), true), nil
+		}
 		return llvm.ConstFloat(llvm.DoubleType(), e.Val), nil
+	case *ast.StringExpr:
+		return g.genString(e.Val), nil
 	case *ast.VariableExpr:
 		v, ok := g.values[e.Name]
 		if !ok {
-			err = g.errorf("unknown variable name : %q", e.Name)
+			return val, g.errorf(e.Pos(), "unknown variable name : %q", e.Name)
+		}
+		return g.builder.CreateLoad(v, e.Name), nil
+	case *ast.UnaryExpr:
+		operand, err := g.GenExpr(e.Operand)
+		if err != nil {
+			return operand, err
+		}
+		switch e.Op {
+		case "-":
+			if isInt(operand) {
+				return g.builder.CreateNeg(operand, "negtmp"), nil
+			}
+			return g.builder.CreateFNeg(g.convert(operand, llvm.DoubleType()), "negtmp"), nil
+		case "!":
+			return g.genNot(operand), nil
+		}
+		// user-defined unary operator
+		f := g.callee(e, ast.UnaryFunctionName(e.Op))
+		if f.IsNil() {
+			return val, g.errorf(e.Pos(), "unknown unary operator: %q", e.Op)
 		}
-		return v, err
+		return g.genCall(f, []llvm.Value{operand}, "unop"), nil
+
 	case *ast.BinaryExpr:
+		switch e.Op {
+		case "&&", "||":
+			return g.genLogical(e)
+		case "=":
+			return g.genAssign(e)
+		}
 		l, err := g.GenExpr(e.LHS)
 		if err != nil {
 			return l, err
@@ -101,29 +246,50 @@ func (g *Generator) GenExpr(expr ast.Expr) (val llvm.Value, err error) {
 			return r, err
 		}
 
+		if _, ok := floatPredicates[e.Op]; ok {
+			return g.genCompare(e.Op, l, r), nil
+		}
+		if isInt(l) && isInt(r) {
+			switch e.Op {
+			case "+":
+				return g.builder.CreateAdd(l, r, "addtmp"), nil
+			case "-":
+				return g.builder.CreateSub(l, r, "subtmp"), nil
+			case "*":
+				return g.builder.CreateMul(l, r, "multmp"), nil
+			case "/", "%":
+				return g.genIntDivision(e.Op, l, r), nil
+			}
+		}
+
 		switch e.Op {
-		case '+':
-			return g.builder.CreateFAdd(l, r, "addtmp"), nil
-		case '-':
-			return g.builder.CreateFSub(l, r, "subtmp"), nil
-		case '*':
-			return g.builder.CreateFMul(l, r, "multmp"), nil
-		case '<':
-			l = g.builder.CreateFCmp(llvm.FloatULT, l, r, "cmptmp")
-			return g.builder.CreateUIToFP(l, llvm.DoubleType(), "booltmp"), nil
+		case "+":
+			return g.builder.CreateFAdd(g.toDouble(l), g.toDouble(r), "addtmp"), nil
+		case "-":
+			return g.builder.CreateFSub(g.toDouble(l), g.toDouble(r), "subtmp"), nil
+		case "*":
+			return g.builder.CreateFMul(g.toDouble(l), g.toDouble(r), "multmp"), nil
+		case "/":
+			return g.builder.CreateFDiv(g.toDouble(l), g.toDouble(r), "divtmp"), nil
+		case "%":
+			return g.builder.CreateFRem(g.toDouble(l), g.toDouble(r), "remtmp"), nil
 
 		default:
-			err = fmt.Errorf("invalid binary operator: %q", e.Op)
-			return val, err
+			// user-defined binary operator
+			f := g.callee(e, ast.BinaryFunctionName(e.Op))
+			if f.IsNil() {
+				return val, g.errorf(e.Pos(), "invalid binary operator: %q", e.Op)
+			}
+			return g.genCall(f, []llvm.Value{l, r}, "binop"), nil
 		}
 	case *ast.CallExpr:
-		f := g.mod.NamedFunction(e.Callee)
+		f := g.callee(e, e.Callee)
 		if f.IsNil() {
-			return val, fmt.Errorf("unknown function referenced: %q", e.Callee)
+			return val, g.errorf(e.Pos(), "unknown function referenced: %q", e.Callee)
 		}
 
-		if f.ParamsCount() != len(e.Args) {
-			return val, fmt.Errorf("incorrect number of arguments passed for %q. %d expected, but %d given", e.Callee, f.ParamsCount(), len(e.Args))
+		if n := g.arity(f); n != len(e.Args) {
+			return val, g.errorf(e.Pos(), "incorrect number of arguments passed for %q. %d expected, but %d given", e.Callee, n, len(e.Args))
 		}
 
 		args := []llvm.Value{}
@@ -135,10 +301,10 @@ func (g *Generator) GenExpr(expr ast.Expr) (val llvm.Value, err error) {
 			args = append(args, v)
 		}
 
-		return g.builder.CreateCall(f, args, "calltmp"), nil
+		return g.genCall(f, args, "calltmp"), nil
 
 	case *ast.BlockExpr:
-		var last llvm.Value
+		last := llvm.ConstFloat(llvm.DoubleType(), 0.0)
 		var err error
 		for _, e := range e.Exprs {
 			last, err = g.GenExpr(e)
@@ -153,8 +319,9 @@ func (g *Generator) GenExpr(expr ast.Expr) (val llvm.Value, err error) {
 		if err != nil {
 			return cond, err
 		}
-		// cond == 0.0 ??
-		cond = g.builder.CreateFCmp(llvm.FloatONE, cond, llvm.ConstFloat(llvm.DoubleType(), 0.0), "ifcond")
+		cond = g.convert(cond, llvm.Int1Type())
+		// both branches are converted to the type of the if.
+		typ := llvmType(g.typeOf(e))
 
 		// create basic blocks for if jump
 		parent := g.builder.GetInsertBlock().Parent()
@@ -170,6 +337,7 @@ func (g *Generator) GenExpr(expr ast.Expr) (val llvm.Value, err error) {
 		if err != nil {
 			return then, err
 		}
+		then = g.convert(then, typ)
 		g.builder.CreateBr(mergebb)
 		thenbb = g.builder.GetInsertBlock()
 
@@ -179,11 +347,12 @@ func (g *Generator) GenExpr(expr ast.Expr) (val llvm.Value, err error) {
 		if err != nil {
 			return else_, err
 		}
+		else_ = g.convert(else_, typ)
 		g.builder.CreateBr(mergebb)
 		elsebb = g.builder.GetInsertBlock()
 
 		g.builder.SetInsertPointAtEnd(mergebb)
-		phi := g.builder.CreatePHI(llvm.DoubleType(), "iftmp")
+		phi := g.builder.CreatePHI(typ, "iftmp")
 		phi.AddIncoming([]llvm.Value{then}, []llvm.BasicBlock{thenbb})
 		phi.AddIncoming([]llvm.Value{else_}, []llvm.BasicBlock{elsebb})
 		return phi, nil
@@ -193,20 +362,31 @@ func (g *Generator) GenExpr(expr ast.Expr) (val llvm.Value, err error) {
 		if err != nil {
 			return start, err
 		}
+		// the loop variable has the type of the start value, where booleans are numbers.
+		if start.Type() == llvm.Int1Type() {
+			start = g.convert(start, llvm.DoubleType())
+		}
+		typ := start.Type()
+		alloca := g.createEntryBlockAlloca(e.Var, typ)
+		g.builder.CreateStore(start, alloca)
+		if g.debug != nil {
+			g.debug.declareLocal(alloca, e.Var, e.Pos(), g.builder.GetInsertBlock())
+		}
+
 		parent := g.builder.GetInsertBlock().Parent()
-		preheaderBB := g.builder.GetInsertBlock()
 		loopBB := llvm.AddBasicBlock(parent, "loop")
 
 		g.builder.CreateBr(loopBB)
 
 		g.builder.SetInsertPointAtEnd(loopBB)
-		phi := g.builder.CreatePHI(llvm.DoubleType(), e.Var)
-		phi.AddIncoming([]llvm.Value{start}, []llvm.BasicBlock{preheaderBB})
 
 		oldVal, oldExists := g.values[e.Var]
-		g.values[e.Var] = phi
+		g.values[e.Var] = alloca
 
-		g.GenExpr(e.Body)
+		body, err := g.GenExpr(e.Body)
+		if err != nil {
+			return body, err
+		}
 
 		var step llvm.Value
 		if e.Step != nil {
@@ -214,27 +394,36 @@ func (g *Generator) GenExpr(expr ast.Expr) (val llvm.Value, err error) {
 			if err != nil {
 				return step, err
 			}
+			step = g.convert(step, typ)
+		} else if typ == llvm.Int64Type() {
+			step = llvm.ConstInt(typ, 1, false)
 		} else {
-			step = llvm.ConstFloat(llvm.DoubleType(), 1.0)
+			step = llvm.ConstFloat(typ, 1.0)
 		}
 
-		next := g.builder.CreateFAdd(phi, step, "nextvar")
-
+		// the end condition sees the loop variable before it is stepped.
 		end, err := g.GenExpr(e.End)
 		if err != nil {
 			return end, err
 		}
 
-		end = g.builder.CreateFCmp(llvm.FloatONE, end, llvm.ConstFloat(llvm.DoubleType(), 0.0), "loopcond")
+		end = g.convert(end, llvm.Int1Type())
+
+		// the loop variable may be changed in the body, so reload it.
+		cur := g.builder.CreateLoad(alloca, e.Var)
+		var next llvm.Value
+		if typ == llvm.Int64Type() {
+			next = g.builder.CreateAdd(cur, step, "nextvar")
+		} else {
+			next = g.builder.CreateFAdd(cur, step, "nextvar")
+		}
+		g.builder.CreateStore(next, alloca)
 
-		loopEndBB := g.builder.GetInsertBlock()
 		afterBB := llvm.AddBasicBlock(parent, "afterloop")
 
 		g.builder.CreateCondBr(end, loopBB, afterBB)
 		g.builder.SetInsertPointAtEnd(afterBB)
 
-		phi.AddIncoming([]llvm.Value{next}, []llvm.BasicBlock{loopEndBB})
-
 		if oldExists {
 			g.values[e.Var] = oldVal
 		} else {
@@ -243,56 +432,371 @@ func (g *Generator) GenExpr(expr ast.Expr) (val llvm.Value, err error) {
 
 		return llvm.ConstFloat(llvm.DoubleType(), 0.0), nil
 
+	case *ast.VarExpr:
+		oldVals := make([]llvm.Value, len(e.Vars))
+		oldExists := make([]bool, len(e.Vars))
+		for i, v := range e.Vars {
+			// the alloca of the variable is bound after the initializer is generated.
+			// variables that are not annotated have the type of the initializer, where
+			// booleans are numbers. Strings that are not initialized are empty.
+			typ := llvmType(v.Type)
+			init := llvm.ConstNull(typ)
+			if v.Init != nil {
+				init, err = g.GenExpr(v.Init)
+				if err != nil {
+					return init, err
+				}
+				if v.Type == ast.NoType && init.Type() != llvm.Int1Type() {
+					typ = init.Type()
+				}
+				init = g.convert(init, typ)
+			}
+			alloca := g.createEntryBlockAlloca(v.Name, typ)
+			g.builder.CreateStore(init, alloca)
+			if g.debug != nil {
+				g.debug.declareLocal(alloca, v.Name, e.Pos(), g.builder.GetInsertBlock())
+			}
+
+			oldVals[i], oldExists[i] = g.values[v.Name]
+			g.values[v.Name] = alloca
+		}
+
+		body, err := g.GenExpr(e.Body)
+		if err != nil {
+			return body, err
+		}
+
+		for i := len(e.Vars) - 1; i >= 0; i-- {
+			if oldExists[i] {
+				g.values[e.Vars[i].Name] = oldVals[i]
+			} else {
+				delete(g.values, e.Vars[i].Name)
+			}
+		}
+		return body, nil
+
 	default:
 		panic("internal compiler error")
 	}
 }
 
+// genString generates the value of a string literal. The bytes of every literal are a private
+// global constant, which the optimizer may merge with the ones of the same value.
+func (g *Generator) genString(s string) llvm.Value {
+	bytes := llvm.AddGlobal(g.mod, llvm.ArrayType(llvm.Int8Type(), len(s)), ".str")
+	bytes.SetInitializer(llvm.ConstString(s, false))
+	bytes.SetLinkage(llvm.PrivateLinkage)
+	bytes.SetGlobalConstant(true)
+	bytes.SetUnnamedAddr(true)
+	ptr := llvm.ConstBitCast(bytes, llvm.PointerType(llvm.Int8Type(), 0))
+	return llvm.ConstStruct([]llvm.Value{ptr, llvm.ConstInt(llvm.Int64Type(), uint64(len(s)), false)}, false)
+}
+
+// genAssign generates an assignment to a mutable variable. The result is the assigned value.
+func (g *Generator) genAssign(e *ast.BinaryExpr) (llvm.Value, error) {
+	lhs, ok := e.LHS.(*ast.VariableExpr)
+	if !ok {
+		return llvm.Value{}, g.errorf(e.Pos(), "destination of '=' must be a variable")
+	}
+	val, err := g.GenExpr(e.RHS)
+	if err != nil {
+		return val, err
+	}
+	v, ok := g.values[lhs.Name]
+	if !ok {
+		return val, g.errorf(lhs.Pos(), "unknown variable name : %q", lhs.Name)
+	}
+	val = g.convert(val, v.Type().ElementType())
+	g.builder.CreateStore(val, v)
+	return val, nil
+}
+
+// createEntryBlockAlloca creates a stack slot for a mutable variable of the type in the entry block
+// of the current function, where mem2reg can promote it to a register.
+func (g *Generator) createEntryBlockAlloca(name string, t llvm.Type) llvm.Value {
+	entry := g.builder.GetInsertBlock().Parent().EntryBasicBlock()
+	b := llvm.NewBuilder()
+	defer b.Dispose()
+	b.SetInsertPoint(entry, entry.FirstInstruction())
+	return b.CreateAlloca(t, name)
+}
+
+// genLogical generates short-circuit evaluation of "&&" and "||".
+// The right hand side is evaluated only if the left hand side does not decide the result.
+// The result is a bool.
+func (g *Generator) genLogical(e *ast.BinaryExpr) (llvm.Value, error) {
+	l, err := g.GenExpr(e.LHS)
+	if err != nil {
+		return l, err
+	}
+	lcond := g.convert(l, llvm.Int1Type())
+
+	lhsbb := g.builder.GetInsertBlock()
+	parent := lhsbb.Parent()
+	rhsbb := llvm.AddBasicBlock(parent, "logicrhs")
+	mergebb := llvm.AddBasicBlock(parent, "logiccont")
+
+	// the value of the expression when the right hand side is skipped.
+	var short llvm.Value
+	if e.Op == "&&" {
+		g.builder.CreateCondBr(lcond, rhsbb, mergebb)
+		short = llvm.ConstInt(llvm.Int1Type(), 0, false)
+	} else {
+		g.builder.CreateCondBr(lcond, mergebb, rhsbb)
+		short = llvm.ConstInt(llvm.Int1Type(), 1, false)
+	}
+
+	g.builder.SetInsertPointAtEnd(rhsbb)
+	r, err := g.GenExpr(e.RHS)
+	if err != nil {
+		return r, err
+	}
+	r = g.convert(r, llvm.Int1Type())
+	g.builder.CreateBr(mergebb)
+	rhsbb = g.builder.GetInsertBlock()
+
+	g.builder.SetInsertPointAtEnd(mergebb)
+	phi := g.builder.CreatePHI(llvm.Int1Type(), "logictmp")
+	phi.AddIncoming([]llvm.Value{short, r}, []llvm.BasicBlock{lhsbb, rhsbb})
+	return phi, nil
+}
+
+// genCompare compares two values with the comparison operator into a bool.
+// Integers are compared as signed integers, and the others as doubles.
+func (g *Generator) genCompare(op string, l, r llvm.Value) llvm.Value {
+	if isInt(l) && isInt(r) {
+		return g.builder.CreateICmp(intPredicates[op], l, r, "cmptmp")
+	}
+	return g.builder.CreateFCmp(floatPredicates[op], g.toDouble(l), g.toDouble(r), "cmptmp")
+}
+
+// genIntDivision generates '/' or '%' of integers, which are defined for all the operands, unlike
+// sdiv and srem: the quotient and the remainder of division by 0 are 0, and math.MinInt64 / -1
+// wraps around to math.MinInt64.
+func (g *Generator) genIntDivision(op string, l, r llvm.Value) llvm.Value {
+	t := l.Type()
+	zero := llvm.ConstNull(t)
+	byZero := g.builder.CreateICmp(llvm.IntEQ, r, zero, "byzero")
+	byMinusOne := g.builder.CreateICmp(llvm.IntEQ, r, llvm.ConstAllOnes(t), "byminusone")
+	// the divisor is replaced with 1 where the result is not the one of sdiv or srem.
+	special := g.builder.CreateOr(byZero, byMinusOne, "special")
+	divisor := g.builder.CreateSelect(special, llvm.ConstInt(t, 1, false), r, "divisor")
+	if op == "%" {
+		rem := g.builder.CreateSRem(l, divisor, "remtmp")
+		return g.builder.CreateSelect(special, zero, rem, "remtmp")
+	}
+	quo := g.builder.CreateSDiv(l, divisor, "divtmp")
+	// x / -1 is -x, which wraps around.
+	quo = g.builder.CreateSelect(byMinusOne, g.builder.CreateNeg(l, "negtmp"), quo, "divtmp")
+	return g.builder.CreateSelect(byZero, zero, quo, "divtmp")
+}
+
+// genNot generates '!', which is true if the operand is false as a condition.
+func (g *Generator) genNot(v llvm.Value) llvm.Value {
+	switch v.Type() {
+	case llvm.Int1Type():
+		return g.builder.CreateXor(v, llvm.ConstInt(v.Type(), 1, false), "nottmp")
+	case llvm.Int64Type():
+		return g.builder.CreateICmp(llvm.IntEQ, v, llvm.ConstNull(v.Type()), "nottmp")
+	default:
+		return g.builder.CreateFCmp(llvm.FloatUEQ, v, llvm.ConstFloat(v.Type(), 0.0), "nottmp")
+	}
+}
+
+// toDouble converts booleans and integers to doubles, which are the operands of arithmetic
+// operators other than the ones of two integers.
+func (g *Generator) toDouble(v llvm.Value) llvm.Value {
+	return g.convert(v, llvm.DoubleType())
+}
+
+// genCall calls the function with the arguments converted to the types of its parameters.
+func (g *Generator) genCall(f llvm.Value, args []llvm.Value, name string) llvm.Value {
+	if obj := g.cFunction(f.Name()); obj != nil {
+		return g.genCCall(f, obj, args, name)
+	}
+	for i, param := range f.Params() {
+		args[i] = g.convert(args[i], param.Type())
+	}
+	return g.builder.CreateCall(f, args, name)
+}
+
+// genCCall calls the external function of obj, passing strings through pointers as cFunctionType describes.
+func (g *Generator) genCCall(f llvm.Value, obj *sema.Object, args []llvm.Value, name string) llvm.Value {
+	var cargs []llvm.Value
+	var result llvm.Value
+	if obj.Type == ast.TypeString {
+		result = g.createEntryBlockAlloca("strret", stringType())
+		cargs = append(cargs, result)
+	}
+	for i, arg := range args {
+		arg = g.convert(arg, llvmType(obj.Params[i]))
+		if obj.Params[i] == ast.TypeString {
+			p := g.createEntryBlockAlloca("strarg", stringType())
+			g.builder.CreateStore(arg, p)
+			arg = p
+		}
+		cargs = append(cargs, arg)
+	}
+	if result.IsNil() {
+		return g.builder.CreateCall(f, cargs, name)
+	}
+	// void values have no names.
+	g.builder.CreateCall(f, cargs, "")
+	return g.builder.CreateLoad(result, name)
+}
+
+// arity returns the number of the arguments the function is called with.
+func (g *Generator) arity(f llvm.Value) int {
+	if obj := g.cFunction(f.Name()); obj != nil {
+		return len(obj.Params)
+	}
+	return f.ParamsCount()
+}
+
+// GenProto declares the function of the prototype. If the function is already declared,
+// it returns the function, provided that the numbers of arguments agree.
 func (g *Generator) GenProto(p *ast.Prototype) (llvm.Value, error) {
-	doubles := []llvm.Type{}
-	for _ = range p.Args {
-		doubles = append(doubles, llvm.DoubleType())
+	if f := g.mod.NamedFunction(p.Name); !f.IsNil() {
+		if g.arity(f) != len(p.Args) {
+			return f, g.errorf(p.Pos(), "external function %q is redeclared with %d arguments", p.Name, len(p.Args))
+		}
+		if f.Type().ElementType() != g.functionType(p) {
+			return f, g.errorf(p.Pos(), "external function %q is redeclared with different types", p.Name)
+		}
+		return f, nil
 	}
-	ft := llvm.FunctionType(llvm.DoubleType(), doubles, false)
-	f := llvm.AddFunction(g.mod, p.Name, ft)
+	f := llvm.AddFunction(g.mod, p.Name, g.functionType(p))
 	if f.IsNil() {
-		return f, fmt.Errorf("function is nil: %q", p.Name)
+		return f, g.errorf(p.Pos(), "function is nil: %q", p.Name)
 	}
-	for i, arg := range f.Params() {
+	params := f.Params()
+	if len(params) > len(p.Args) {
+		// the pointer to the string result of an external function.
+		params[0].SetName("result")
+		params = params[1:]
+	}
+	for i, arg := range params {
 		arg.SetName(p.Args[i])
 	}
 	return f, nil
 }
 
-func (g *Generator) GenFun(f *ast.Function) (llvm.Value, error) {
-	var err error
+// declareFunction declares the function of the definition, or returns the function declared
+// by an extern or a previous call. It reports definitions that disagree with the declarations.
+func (g *Generator) declareFunction(f *ast.Function) (llvm.Value, error) {
 	ff := g.mod.NamedFunction(f.Name)
 	if ff.IsNil() {
-		ff, err = g.GenProto(f.Prototype)
-		if err != nil {
-			return ff, err
+		return g.GenProto(f.Prototype)
+	}
+	if ff.ParamsCount() != len(f.Args) {
+		return ff, g.errorf(f.Prototype.Pos(), "function %q is defined with %d arguments, but declared with %d", f.Name, len(f.Args), ff.ParamsCount())
+	}
+	if ff.Type().ElementType() != g.functionType(f.Prototype) {
+		return ff, g.errorf(f.Prototype.Pos(), "function %q is defined with different types than declared", f.Name)
+	}
+	// the names of the parameters may differ from the ones in the extern.
+	for i, arg := range ff.Params() {
+		arg.SetName(f.Args[i])
+	}
+	return ff, nil
+}
+
+// declareInstance declares the function of the instance of a definition.
+func (g *Generator) declareInstance(inst *sema.Instance) (llvm.Value, error) {
+	def := inst.Func.Decl.(*ast.Function)
+	if _, renamed := g.symbols[inst.Name]; inst.Name == def.Name && !renamed {
+		return g.declareFunction(def)
+	}
+	f := llvm.AddFunction(g.mod, g.symbol(inst.Name), llvmFunctionType(inst.Params, inst.Result))
+	for i, arg := range f.Params() {
+		arg.SetName(def.Args[i])
+	}
+	return f, nil
+}
+
+// callee returns the function called by the expression, which is a call or an application of
+// a user-defined operator: the instance of the function found by sema, or the function of the name.
+func (g *Generator) callee(expr ast.Expr, name string) llvm.Value {
+	if g.inst != nil {
+		if callee := g.inst.Callee(expr); callee != nil {
+			return g.function(callee.Name)
 		}
 	}
+	return g.function(name)
+}
+
+// symbol returns the name of the function of the instance named name.
+func (g *Generator) symbol(name string) string {
+	if symbol, ok := g.symbols[name]; ok {
+		return symbol
+	}
+	return name
+}
+
+// function returns the function of the instance named name in the module.
+func (g *Generator) function(name string) llvm.Value {
+	return g.mod.NamedFunction(g.symbol(name))
+}
+
+// GenFun generates the body of the function of the definition.
+func (g *Generator) GenFun(f *ast.Function) (llvm.Value, error) {
+	ff, err := g.declareFunction(f)
+	if err != nil {
+		return ff, err
+	}
+	return g.genBody(ff, f)
+}
+
+// genInstance generates the body of the function of the instance of a definition.
+func (g *Generator) genInstance(inst *sema.Instance) (llvm.Value, error) {
+	g.inst = inst
+	defer func() { g.inst = nil }()
+	return g.genBody(g.function(inst.Name), inst.Func.Decl.(*ast.Function))
+}
+
+// genBody generates the body of the function ff of the definition f.
+func (g *Generator) genBody(ff llvm.Value, f *ast.Function) (llvm.Value, error) {
+	if !ff.IsDeclaration() {
+		return ff, g.errorf(f.Prototype.Pos(), "redefinition of function %q", f.Name)
+	}
 
 	bb := llvm.AddBasicBlock(ff, "entry")
 	g.builder.SetInsertPointAtEnd(bb)
 	g.values = make(map[string]llvm.Value)
+	if g.debug != nil {
+		g.debug.beginFunction(g.builder, ff, f, g.optLevel > 0)
+	}
 
-	for _, arg := range ff.Params() {
-		g.values[arg.Name()] = arg
+	for i, arg := range ff.Params() {
+		alloca := g.createEntryBlockAlloca(arg.Name(), arg.Type())
+		g.builder.CreateStore(arg, alloca)
+		g.values[arg.Name()] = alloca
+		if g.debug != nil {
+			g.debug.declareParameter(alloca, arg.Name(), i+1, f.Pos(), bb)
+		}
 	}
 
 	body, err := g.GenExpr(f.Body)
 	if err != nil {
-		ff.EraseFromParentAsFunction()
+		g.eraseFunction(ff)
 		return body, err
 	}
 
-	g.builder.CreateRet(body)
+	// booleans are converted to doubles, and the value of the main function is converted to a double.
+	g.builder.CreateRet(g.convert(body, ff.Type().ElementType().ReturnType()))
 	if llvm.VerifyFunction(ff, llvm.PrintMessageAction) != nil {
-		ff.EraseFromParentAsFunction()
-		return ff, fmt.Errorf("function verification failed: %q", f.Name)
+		g.eraseFunction(ff)
+		return ff, g.errorf(f.Pos(), "function verification failed: %q", f.Name)
 	}
+	g.fpm.RunFunc(ff)
 
 	return ff, nil
 }
+
+// eraseFunction removes the function whose body failed to be generated.
+// Functions called by other functions are left as they are, since the module is discarded anyway.
+func (g *Generator) eraseFunction(f llvm.Value) {
+	if f.FirstUse().IsNil() {
+		f.EraseFromParentAsFunction()
+	}
+}
@@ -1,9 +1,14 @@
 package codegen
 
 import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
 	"testing"
 
 	"github.com/agatan/kaleigo/ast"
+	"github.com/agatan/kaleigo/parse"
 )
 
 func TestGenFun(t *testing.T) {
@@ -14,7 +19,7 @@ func TestGenFun(t *testing.T) {
 			Args: []string{"x", "y"},
 		},
 		Body: &ast.BinaryExpr{
-			Op:  '+',
+			Op:  "+",
 			LHS: &ast.VariableExpr{Name: "x"},
 			RHS: &ast.VariableExpr{Name: "y"},
 		},
@@ -93,7 +98,7 @@ func TestGenForExpr(t *testing.T) {
 			Var:   "i",
 			Start: &ast.NumberExpr{Val: 1.0},
 			End: &ast.BinaryExpr{
-				Op:  '<',
+				Op:  "<",
 				LHS: &ast.VariableExpr{Name: "i"},
 				RHS: &ast.NumberExpr{Val: 10.0},
 			},
@@ -108,3 +113,577 @@ func TestGenForExpr(t *testing.T) {
 		t.Fatalf("generated llvm.Value from for expression is nil")
 	}
 }
+
+func TestGenErrorPosition(t *testing.T) {
+	g := NewGenerator("test")
+	_, err := g.GenExpr(&ast.CallExpr{
+		Span:   ast.Span{Start: ast.Pos{Offset: 10, Line: 2, Column: 7}},
+		Callee: "unknown",
+		Args:   []ast.Expr{},
+	})
+	if err == nil {
+		t.Fatal("call of an unknown function is not detected")
+	}
+	expected := `2:7: unknown function referenced: "unknown"`
+	if err.Error() != expected {
+		t.Errorf("wrong error message: expected %q, actual %q", expected, err.Error())
+	}
+}
+
+func TestGenUserDefinedOperator(t *testing.T) {
+	g := NewGenerator("test")
+	_, err := g.GenFun(&ast.Function{
+		Prototype: &ast.Prototype{
+			Name: "binary|",
+			Args: []string{"a", "b"},
+			Kind: ast.ProtoBinary,
+		},
+		Body: &ast.VariableExpr{Name: "a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.GenFun(&ast.Function{
+		Prototype: &ast.Prototype{
+			Name: "unary~",
+			Args: []string{"v"},
+			Kind: ast.ProtoUnary,
+		},
+		Body: &ast.VariableExpr{Name: "v"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := g.GenFun(&ast.Function{
+		Prototype: &ast.Prototype{
+			Name: "useop",
+			Args: []string{"x"},
+		},
+		Body: &ast.BinaryExpr{
+			Op:  "|",
+			LHS: &ast.UnaryExpr{Op: "~", Operand: &ast.VariableExpr{Name: "x"}},
+			RHS: &ast.NumberExpr{Val: 1.0},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.IsNil() {
+		t.Fatalf("generated llvm.Value from user-defined operators is nil")
+	}
+}
+
+func TestGenArithmeticAndComparison(t *testing.T) {
+	g := NewGenerator("test")
+	for i, op := range []string{"/", "%", "<", ">", "<=", ">=", "==", "!="} {
+		value, err := g.GenFun(&ast.Function{
+			Prototype: &ast.Prototype{
+				Name: fmt.Sprintf("op%d", i),
+				Args: []string{"x", "y"},
+			},
+			Body: &ast.BinaryExpr{
+				Op:  op,
+				LHS: &ast.VariableExpr{Name: "x"},
+				RHS: &ast.VariableExpr{Name: "y"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", op, err)
+		}
+		if value.IsNil() {
+			t.Fatalf("generated llvm.Value of %q is nil", op)
+		}
+	}
+}
+
+func TestGenLogical(t *testing.T) {
+	g := NewGenerator("test")
+	value, err := g.GenFun(&ast.Function{
+		Prototype: &ast.Prototype{
+			Name: "logical",
+			Args: []string{"x", "y"},
+		},
+		Body: &ast.BinaryExpr{
+			Op: "||",
+			LHS: &ast.BinaryExpr{
+				Op:  "&&",
+				LHS: &ast.VariableExpr{Name: "x"},
+				RHS: &ast.UnaryExpr{Op: "!", Operand: &ast.VariableExpr{Name: "y"}},
+			},
+			RHS: &ast.UnaryExpr{Op: "-", Operand: &ast.VariableExpr{Name: "x"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.IsNil() {
+		t.Fatalf("generated llvm.Value from logical operators is nil")
+	}
+}
+
+func TestGenVarExpr(t *testing.T) {
+	g := NewGenerator("test")
+	value, err := g.GenFun(&ast.Function{
+		Prototype: &ast.Prototype{
+			Name: "testvar",
+			Args: []string{"x"},
+		},
+		Body: &ast.VarExpr{
+			Vars: []*ast.VarBinding{
+				{Name: "a", Init: &ast.VariableExpr{Name: "x"}},
+				{Name: "b"},
+			},
+			Body: &ast.BinaryExpr{
+				Op:  "=",
+				LHS: &ast.VariableExpr{Name: "x"},
+				RHS: &ast.BinaryExpr{
+					Op:  "+",
+					LHS: &ast.VariableExpr{Name: "a"},
+					RHS: &ast.VariableExpr{Name: "b"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.IsNil() {
+		t.Fatalf("generated llvm.Value from var expression is nil")
+	}
+}
+
+func TestGenerateForwardReference(t *testing.T) {
+	src := `def even(n) if n == 0 then 1 else odd(n - 1)
+def odd(n) if n == 0 then 0 else even(n - 1)
+main2()
+def main2() even(10)`
+	f, err := parse.New("test.kl", src).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGenerator("test")
+	defer g.Dispose()
+	var buf bytes.Buffer
+	if err := g.Emit(f, &buf, IRText); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"even", "odd", "main2"} {
+		if !strings.Contains(buf.String(), fmt.Sprintf("define double @%s(", name)) {
+			t.Errorf("%s is not defined in llvm IR:\n%s", name, buf.String())
+		}
+	}
+}
+
+func TestGenerateTypes(t *testing.T) {
+	src := `def fact(n: i64): i64 if n < 2 then 1 else n * fact(n - 1)
+def positive(x): bool x > 0 && !(x != x)
+if positive(2) then fact(5) else 0`
+	f, err := parse.New("test.kl", src).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGenerator("test")
+	defer g.Dispose()
+	var buf bytes.Buffer
+	if err := g.Emit(f, &buf, IRText); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"define i64 @fact(i64 %n)",
+		"icmp slt i64",
+		"mul i64",
+		"define i1 @positive(double %x)",
+		"sitofp i64",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("%q is not found in llvm IR:\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestGenerateInferredTypes(t *testing.T) {
+	src := `def id(x) x
+def twice(x, n: i64) n * 2 + x
+id(1 < 2); twice(id(3), 4)`
+	f, err := parse.New("test.kl", src).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGenerator("test")
+	defer g.Dispose()
+	var buf bytes.Buffer
+	if err := g.Emit(f, &buf, IRText); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"define double @id(double %x)",
+		"define i64 @id.i64(i64 %x)",
+		"define i1 @id.bool(i1 %x)",
+		"define i64 @twice(i64 %x, i64 %n)",
+		"call i64 @id.i64(i64 3)",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("%q is not found in llvm IR:\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestGenerateStrings(t *testing.T) {
+	src := `extern putstr(s: str)
+extern strconcat(a: str, b: str): str
+def greet(name) strconcat("hello, ", name)
+putstr(greet("world\n"))`
+	f, err := parse.New("test.kl", src).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGenerator("test")
+	defer g.Dispose()
+	var buf bytes.Buffer
+	if err := g.Emit(f, &buf, IRText); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`private unnamed_addr constant [7 x i8] c"hello, "`,
+		`private unnamed_addr constant [6 x i8] c"world\0A"`,
+		"declare double @putstr({ i8*, i64 }*",
+		"declare void @strconcat({ i8*, i64 }*, { i8*, i64 }*, { i8*, i64 }*",
+		"define { i8*, i64 } @greet({ i8*, i64 } %name)",
+		"call void @strconcat({ i8*, i64 }* %strret",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("%q is not found in llvm IR:\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestGenFunDeclarationMismatch(t *testing.T) {
+	g := NewGenerator("test")
+	defer g.Dispose()
+	if _, err := g.GenProto(&ast.Prototype{Name: "f", Args: []string{"x"}}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := g.GenProto(&ast.Prototype{Span: ast.Span{Start: ast.Pos{Line: 2, Column: 8}}, Name: "f", Args: []string{"x", "y"}})
+	if expected := `2:8: external function "f" is redeclared with 2 arguments`; err == nil || err.Error() != expected {
+		t.Errorf("expected %q, but got %v", expected, err)
+	}
+	_, err = g.GenFun(&ast.Function{
+		Prototype: &ast.Prototype{Span: ast.Span{Start: ast.Pos{Line: 3, Column: 5}}, Name: "f", Args: []string{"a", "b"}},
+		Body:      &ast.VariableExpr{Name: "a"},
+	})
+	if expected := `3:5: function "f" is defined with 2 arguments, but declared with 1`; err == nil || err.Error() != expected {
+		t.Errorf("expected %q, but got %v", expected, err)
+	}
+	// the parameters are named after the definition, not after the extern.
+	_, err = g.GenFun(&ast.Function{
+		Prototype: &ast.Prototype{Name: "f", Args: []string{"a"}},
+		Body:      &ast.VariableExpr{Name: "a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.GenFun(&ast.Function{
+		Prototype: &ast.Prototype{Span: ast.Span{Start: ast.Pos{Line: 4, Column: 5}}, Name: "f", Args: []string{"a"}},
+		Body:      &ast.VariableExpr{Name: "a"},
+	})
+	if expected := `4:5: redefinition of function "f"`; err == nil || err.Error() != expected {
+		t.Errorf("expected %q, but got %v", expected, err)
+	}
+}
+
+func TestSetOptLevel(t *testing.T) {
+	g := NewGenerator("test")
+	for level := 0; level <= MaxOptLevel; level++ {
+		if err := g.SetOptLevel(level); err != nil {
+			t.Fatal(err)
+		}
+		_, err := g.GenFun(&ast.Function{
+			Prototype: &ast.Prototype{
+				Name: fmt.Sprintf("f%d", level),
+				Args: []string{"x", "y"},
+			},
+			Body: &ast.BinaryExpr{
+				Op:  "+",
+				LHS: &ast.VariableExpr{Name: "x"},
+				RHS: &ast.VariableExpr{Name: "y"},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.SetOptLevel(MaxOptLevel + 1); err == nil {
+		t.Errorf("invalid optimization level is not detected")
+	}
+}
+
+func TestEmit(t *testing.T) {
+	f := &ast.File{
+		Name: "test.kl",
+		Defs: []*ast.Function{{
+			Prototype: &ast.Prototype{Name: "f", Args: []string{"x"}},
+			Body:      &ast.VariableExpr{Name: "x"},
+		}},
+		Exprs: []ast.Expr{
+			&ast.CallExpr{Callee: "f", Args: []ast.Expr{&ast.NumberExpr{Val: 1.0}}},
+		},
+	}
+	for _, kind := range []OutputKind{ObjectFile, AssemblyFile, IRText, Bitcode} {
+		g := NewGenerator("test")
+		var buf bytes.Buffer
+		if err := g.Emit(f, &buf, kind); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() == 0 {
+			t.Errorf("output of kind %d is empty", kind)
+		}
+		if kind == IRText && !strings.Contains(buf.String(), "define double @f(double %x)") {
+			t.Errorf("function definition is not found in llvm IR:\n%s", buf.String())
+		}
+		g.Dispose()
+	}
+}
+
+func TestSetTarget(t *testing.T) {
+	f := &ast.File{
+		Name:  "test.kl",
+		Exprs: []ast.Expr{&ast.NumberExpr{Val: 1.0}},
+	}
+	for _, triple := range []string{"aarch64-unknown-linux-gnu", "riscv64-unknown-linux-gnu", "x86_64-unknown-linux-gnu"} {
+		g := NewGenerator("test")
+		if err := g.SetTarget(Target{Triple: triple}); err != nil {
+			t.Fatal(err)
+		}
+		var ir, obj bytes.Buffer
+		if err := g.Emit(f, &ir, IRText); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(ir.String(), fmt.Sprintf("target triple = %q", triple)) {
+			t.Errorf("target triple %q is not set:\n%s", triple, ir.String())
+		}
+		if !strings.Contains(ir.String(), "target datalayout = ") {
+			t.Errorf("data layout of %q is not set:\n%s", triple, ir.String())
+		}
+		if err := g.emitNative(&obj, ObjectFile); err != nil {
+			t.Fatal(err)
+		}
+		if obj.Len() == 0 {
+			t.Errorf("object file for %q is empty", triple)
+		}
+		g.Dispose()
+	}
+
+	g := NewGenerator("test")
+	defer g.Dispose()
+	if err := g.SetTarget(Target{Triple: "nosuch-unknown-none"}); err == nil {
+		t.Errorf("unknown target is accepted")
+	}
+}
+
+func TestEnableDebugInfo(t *testing.T) {
+	f, err := parse.New("test.kl", "def f(x) var y = x * 2 in y + 1\nf(1)").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGenerator("test")
+	defer g.Dispose()
+	g.EnableDebugInfo()
+	var buf bytes.Buffer
+	if err := g.Emit(f, &buf, IRText); err != nil {
+		t.Fatal(err)
+	}
+	ir := buf.String()
+	for _, s := range []string{
+		`!DICompileUnit(`,
+		`!DIFile(filename: "test.kl"`,
+		`!DISubprogram(name: "f"`,
+		`!DILocalVariable(name: "x", arg: 1`,
+		`!DILocalVariable(name: "y"`,
+		`!DILocation(line: 1, column: 27`,
+		`!"Debug Info Version", i32 3}`,
+	} {
+		if !strings.Contains(ir, s) {
+			t.Errorf("%s is not found in llvm IR:\n%s", s, ir)
+		}
+	}
+}
+
+func TestRunWithDebugInfo(t *testing.T) {
+	// the debug info declares intrinsics such as llvm.dbg.declare, which must not be resolved as externs.
+	f, err := parse.New("test.kl", "def f(x) var y = x * 2 in y + 1\nf(1)").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGenerator("test")
+	defer g.Dispose()
+	g.EnableDebugInfo()
+	result, err := g.Run(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != 3.0 {
+		t.Errorf("wrong result of JIT execution: expected 3, actual %f", result)
+	}
+}
+
+func TestLookupRuntimeSymbol(t *testing.T) {
+	for _, name := range []string{"putd", "putchard", "cos", "pow"} {
+		if lookupRuntimeSymbol(name) == nil {
+			t.Errorf("runtime function %q is not found", name)
+		}
+	}
+	if lookupRuntimeSymbol("kaleigo_no_such_function") != nil {
+		t.Errorf("unknown function is resolved")
+	}
+}
+
+func TestRun(t *testing.T) {
+	g := NewGenerator("test")
+	defer g.Dispose()
+	result, err := g.Run(&ast.File{
+		Name:    "test.kl",
+		Externs: []*ast.Prototype{{Name: "pow", Args: []string{"x", "y"}}},
+		Exprs: []ast.Expr{
+			&ast.CallExpr{
+				Callee: "pow",
+				Args:   []ast.Expr{&ast.NumberExpr{Val: 2.0}, &ast.NumberExpr{Val: 10.0}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != 1024.0 {
+		t.Errorf("wrong result of JIT execution: expected 1024, actual %f", result)
+	}
+}
+
+func TestRunIntDivision(t *testing.T) {
+	defs := "def div(a: i64, b: i64): i64 a / b\ndef rem(a: i64, b: i64): i64 a % b\n"
+	cases := []struct {
+		expr     string
+		expected float64
+	}{
+		{"div(7, 2)", 3},
+		{"div(-7, 2)", -3},
+		{"rem(-7, 2)", -1},
+		{"div(7, 0)", 0},
+		{"rem(7, 0)", 0},
+		{"div(7, -1)", -7},
+		{"rem(7, -1)", 0},
+		{"div(-4611686018427387904 * 2, -1)", math.MinInt64},
+		{"rem(-4611686018427387904 * 2, -1)", 0},
+	}
+	for _, c := range cases {
+		f, err := parse.New("test.kl", defs+c.expr).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := NewGenerator("test")
+		result, err := g.Run(f)
+		g.Dispose()
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		if result != c.expected {
+			t.Errorf("%s: expected %f, actual %f", c.expr, c.expected, result)
+		}
+	}
+}
+
+func TestRunNot(t *testing.T) {
+	cases := []struct {
+		expr     string
+		expected float64
+	}{
+		{"!0", 1},
+		{"!3", 0},
+		{"!(0/0)", 1},
+		{"(0/0) || !(0/0)", 1},
+	}
+	for _, c := range cases {
+		f, err := parse.New("test.kl", c.expr).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := NewGenerator("test")
+		result, err := g.Run(f)
+		g.Dispose()
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		if result != c.expected {
+			t.Errorf("%s: expected %f, actual %f", c.expr, c.expected, result)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	s, err := NewSession(NewGenerator("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Dispose()
+
+	var defs []*ast.Function
+	define := func(src string) {
+		f, err := parse.New("test.kl", src).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, def := range f.Defs {
+			replaced := false
+			for i, d := range defs {
+				if d.Name == def.Name {
+					defs[i], replaced = def, true
+				}
+			}
+			if !replaced {
+				defs = append(defs, def)
+			}
+		}
+	}
+	run := func(src string, expected float64) {
+		f, err := parse.New("test.kl", src).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := s.Run(&ast.File{Name: "test.kl", Defs: defs, Exprs: f.Exprs})
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			return
+		}
+		if result != expected {
+			t.Errorf("%s: expected %f, actual %f", src, expected, result)
+		}
+	}
+	symbol := func(name string) string {
+		if f, ok := s.funcs[name]; ok {
+			return f.symbol
+		}
+		return ""
+	}
+
+	define("def f(x) x + 1\ndef g(x) f(x) * 2\ndef h(x) x - 1\ndef id(x) x")
+	run("g(1)", 4)
+	run("h(1)", 0)
+	if symbol("f") != "f" || symbol("g") != "g" || symbol("h") != "h" {
+		t.Errorf("functions are generated under other names: f=%s g=%s h=%s", symbol("f"), symbol("g"), symbol("h"))
+	}
+
+	// g is generated again to call the new f, but h is not.
+	define("def f(x) x + 10")
+	run("g(1) + h(1)", 22)
+	if symbol("f") == "f" || symbol("g") == "g" || symbol("h") != "h" {
+		t.Errorf("wrong functions are generated again: f=%s g=%s h=%s", symbol("f"), symbol("g"), symbol("h"))
+	}
+
+	// the instance of id for i64 generated for an expression is called from the later ones.
+	run("var x: i64 = 3 in id(x)", 3)
+	run("var y: i64 = 4 in id(y) + id(1)", 5)
+	if symbol("id.i64") != "id.i64" {
+		t.Errorf("id.i64 is generated again: %s", symbol("id.i64"))
+	}
+}
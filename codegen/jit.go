@@ -0,0 +1,69 @@
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/agatan/kaleigo/ast"
+
+	"llvm.org/llvm/bindings/go/llvm"
+)
+
+func init() {
+	llvm.LinkInMCJIT()
+}
+
+// Run generates code for the file and executes its toplevel expressions in process
+// with the MCJIT execution engine, without writing an object file or invoking a C compiler.
+// It returns the value of the last toplevel expression.
+func (g *Generator) Run(fileast *ast.File) (float64, error) {
+	if err := g.Generate(fileast); err != nil {
+		return 0, err
+	}
+	return g.runMain()
+}
+
+// runMain compiles the module and calls ast.MainName in it.
+func (g *Generator) runMain() (float64, error) {
+	if !g.isHost() {
+		return 0, fmt.Errorf("cannot run code for %q in process", g.target.Triple)
+	}
+	main := g.mod.NamedFunction(ast.MainName)
+	if main.IsNil() {
+		return 0, fmt.Errorf("%s is not generated", ast.MainName)
+	}
+
+	opts := llvm.NewMCJITCompilerOptions()
+	opts.SetMCJITOptimizationLevel(uint(g.optLevel))
+	ee, err := llvm.NewMCJITCompiler(g.mod, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer ee.Dispose()
+	// the engine owns the module while it is alive, but the module is disposed by the generator.
+	defer ee.RemoveModule(g.mod)
+
+	if err := g.mapExterns(ee); err != nil {
+		return 0, err
+	}
+
+	result := ee.RunFunction(main, []llvm.GenericValue{})
+	flushRuntime()
+	defer result.Dispose()
+	return result.Float(llvm.DoubleType()), nil
+}
+
+// mapExterns resolves the external functions declared in the module to functions in the host process.
+func (g *Generator) mapExterns(ee llvm.ExecutionEngine) error {
+	for f := g.mod.FirstFunction(); !f.IsNil(); f = llvm.NextFunction(f) {
+		// intrinsics such as llvm.fabs.f64 are lowered by the code generator, not resolved.
+		if !f.IsDeclaration() || f.IntrinsicID() != 0 {
+			continue
+		}
+		addr := lookupRuntimeSymbol(f.Name())
+		if addr == nil {
+			return fmt.Errorf("unresolved external function: %q", f.Name())
+		}
+		ee.AddGlobalMapping(f, addr)
+	}
+	return nil
+}
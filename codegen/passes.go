@@ -0,0 +1,90 @@
+package codegen
+
+import (
+	"fmt"
+
+	"llvm.org/llvm/bindings/go/llvm"
+)
+
+// MaxOptLevel is the highest optimization level (-O3).
+const MaxOptLevel = 3
+
+// newFunctionPassManager creates a pass manager run on each function right after it is generated.
+func newFunctionPassManager(mod llvm.Module, level int) llvm.PassManager {
+	fpm := llvm.NewFunctionPassManagerForModule(mod)
+	// variables are allocated on the stack, and promoted to registers by mem2reg.
+	// It is run even at -O0 to keep the generated code readable.
+	fpm.AddPromoteMemoryToRegisterPass()
+	if level >= 1 {
+		fpm.AddInstructionCombiningPass()
+		fpm.AddCFGSimplificationPass()
+	}
+	if level >= 2 {
+		fpm.AddReassociatePass()
+		fpm.AddGVNPass()
+		fpm.AddCFGSimplificationPass()
+	}
+	if level >= 3 {
+		fpm.AddTailCallEliminationPass()
+		fpm.AddAggressiveDCEPass()
+	}
+	fpm.InitializeFunc()
+	return fpm
+}
+
+// newModulePassManager creates a pass manager run on the whole module before emitting code.
+// It performs interprocedural optimizations, mainly inlining, and cleans up after them.
+func newModulePassManager(level int) llvm.PassManager {
+	mpm := llvm.NewPassManager()
+	if level >= 2 {
+		mpm.AddFunctionInliningPass()
+		mpm.AddInstructionCombiningPass()
+		mpm.AddReassociatePass()
+		mpm.AddGVNPass()
+		mpm.AddCFGSimplificationPass()
+	}
+	if level >= 3 {
+		mpm.AddIPSCCPPass()
+		mpm.AddDeadArgEliminationPass()
+		mpm.AddGlobalOptimizerPass()
+		mpm.AddLICMPass()
+		mpm.AddAggressiveDCEPass()
+		mpm.AddCFGSimplificationPass()
+	}
+	return mpm
+}
+
+// codeGenLevel returns the target machine's optimization level corresponding to level.
+func codeGenLevel(level int) llvm.CodeGenOptLevel {
+	switch level {
+	case 0:
+		return llvm.CodeGenLevelNone
+	case 1:
+		return llvm.CodeGenLevelLess
+	case 2:
+		return llvm.CodeGenLevelDefault
+	default:
+		return llvm.CodeGenLevelAggressive
+	}
+}
+
+// SetOptLevel sets the optimization level from 0 (-O0) to MaxOptLevel (-O3).
+// It affects functions generated after the call.
+func (g *Generator) SetOptLevel(level int) error {
+	if level < 0 || level > MaxOptLevel {
+		return fmt.Errorf("invalid optimization level: %d", level)
+	}
+	g.fpm.FinalizeFunc()
+	g.fpm.Dispose()
+	g.fpm = newFunctionPassManager(g.mod, level)
+	g.optLevel = level
+	// the target machine is recreated with the optimization level.
+	return g.SetTarget(g.target)
+}
+
+// optimizeModule runs the interprocedural optimizations on the module.
+func (g *Generator) optimizeModule() {
+	mpm := newModulePassManager(g.optLevel)
+	defer mpm.Dispose()
+	mpm.Run(g.mod)
+}
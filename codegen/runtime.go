@@ -0,0 +1,139 @@
+package codegen
+
+/*
+#cgo LDFLAGS: -lm -ldl
+#define _GNU_SOURCE
+#include <dlfcn.h>
+#include <math.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+// kaleigo's runtime functions for programs run by the JIT. They must behave as
+// the ones in lib/runtime.c. Output is flushed by kaleigo_flush after a program
+// runs, since it is interleaved with the output of the Go side.
+
+static double kaleigo_putd(double d) {
+	printf("%f\n", d);
+	return 0.0;
+}
+
+static double kaleigo_putchard(double d) {
+	putchar((int)d);
+	return 0.0;
+}
+
+struct kaleigo_string {
+	const char *ptr;
+	int64_t len;
+};
+
+static double kaleigo_putstr(const struct kaleigo_string *s) {
+	if (s->len > 0) {
+		fwrite(s->ptr, 1, s->len, stdout);
+	}
+	return 0.0;
+}
+
+static void kaleigo_strconcat(struct kaleigo_string *result, const struct kaleigo_string *a, const struct kaleigo_string *b) {
+	struct kaleigo_string s = {NULL, a->len + b->len};
+	if (s.len > 0) {
+		char *p = malloc(s.len);
+		if (p == NULL) {
+			perror("strconcat");
+			exit(1);
+		}
+		if (a->len > 0) {
+			memcpy(p, a->ptr, a->len);
+		}
+		if (b->len > 0) {
+			memcpy(p + a->len, b->ptr, b->len);
+		}
+		s.ptr = p;
+	}
+	*result = s;
+}
+
+static int64_t kaleigo_strlength(const struct kaleigo_string *s) {
+	return s->len;
+}
+
+static int64_t kaleigo_strcompare(const struct kaleigo_string *a, const struct kaleigo_string *b) {
+	int64_t n = a->len < b->len ? a->len : b->len;
+	int c = n > 0 ? memcmp(a->ptr, b->ptr, n) : 0;
+	if (c != 0) {
+		return c;
+	}
+	return (a->len > b->len) - (a->len < b->len);
+}
+
+static void kaleigo_flush(void) {
+	fflush(stdout);
+}
+
+struct kaleigo_symbol {
+	const char *name;
+	void *addr;
+};
+
+// libm functions are listed explicitly, so that libm is linked even if the
+// linker drops unused shared libraries.
+static struct kaleigo_symbol kaleigo_symbols[] = {
+	{"putd", (void *)kaleigo_putd},
+	{"putchard", (void *)kaleigo_putchard},
+	{"putstr", (void *)kaleigo_putstr},
+	{"strconcat", (void *)kaleigo_strconcat},
+	{"strlength", (void *)kaleigo_strlength},
+	{"strcompare", (void *)kaleigo_strcompare},
+	{"sin", (void *)sin},
+	{"cos", (void *)cos},
+	{"tan", (void *)tan},
+	{"asin", (void *)asin},
+	{"acos", (void *)acos},
+	{"atan", (void *)atan},
+	{"atan2", (void *)atan2},
+	{"sinh", (void *)sinh},
+	{"cosh", (void *)cosh},
+	{"tanh", (void *)tanh},
+	{"exp", (void *)exp},
+	{"log", (void *)log},
+	{"log10", (void *)log10},
+	{"pow", (void *)pow},
+	{"sqrt", (void *)sqrt},
+	{"fabs", (void *)fabs},
+	{"floor", (void *)floor},
+	{"ceil", (void *)ceil},
+	{"round", (void *)round},
+	{"fmod", (void *)fmod},
+	{NULL, NULL},
+};
+
+static void *kaleigo_lookup_symbol(const char *name) {
+	struct kaleigo_symbol *s;
+	for (s = kaleigo_symbols; s->name != NULL; s++) {
+		if (strcmp(s->name, name) == 0) {
+			return s->addr;
+		}
+	}
+	return dlsym(RTLD_DEFAULT, name);
+}
+*/
+import "C"
+
+import (
+	"unsafe"
+)
+
+// lookupRuntimeSymbol returns the address of a function in the host process that
+// implements the external function name, or nil if it is not found.
+func lookupRuntimeSymbol(name string) unsafe.Pointer {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	return C.kaleigo_lookup_symbol(cname)
+}
+
+// flushRuntime flushes the output written by the runtime functions.
+func flushRuntime() {
+	C.kaleigo_flush()
+}
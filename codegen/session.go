@@ -0,0 +1,226 @@
+package codegen
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/agatan/kaleigo/ast"
+	"github.com/agatan/kaleigo/sema"
+
+	"llvm.org/llvm/bindings/go/llvm"
+)
+
+// Session runs the programs of an interactive session in process, each of which is the previous
+// one with a new definition, extern or toplevel expression. Unlike Run, it keeps a single execution
+// engine alive, and generates each program into a new module added to the engine, which declares
+// the functions generated for the previous programs and calls them. A function is generated again
+// only if its definition or its types change, or if a function it calls is generated again.
+// Since the engine cannot replace the code it has compiled, the function is then generated under
+// a new name.
+type Session struct {
+	g  *Generator
+	ee llvm.ExecutionEngine
+	// funcs are the functions generated so far by the names of their instances.
+	funcs map[string]*sessionFunc
+	// symbols are the names of the functions in the engine, and externs are the names of the
+	// external functions mapped to the runtime.
+	symbols map[string]bool
+	externs map[string]bool
+	modules int // number of the modules added to the engine for the programs
+}
+
+// sessionModuleName returns the name of the module generated for the n-th program of a session.
+func sessionModuleName(n int) string {
+	return "kaleigo." + strconv.Itoa(n)
+}
+
+// sessionFunc is a function generated for an instance in a session.
+type sessionFunc struct {
+	def     *ast.Function
+	params  []ast.Type
+	result  ast.Type
+	callees map[string]bool // names of the instances it calls
+	symbol  string          // name of the function in the engine
+}
+
+// NewSession creates a session that generates code with g, which must generate code for the host.
+// The session takes over g, which is disposed by Session.Dispose.
+func NewSession(g *Generator) (*Session, error) {
+	if !g.isHost() {
+		return nil, fmt.Errorf("cannot run code for %q in process", g.target.Triple)
+	}
+	opts := llvm.NewMCJITCompilerOptions()
+	opts.SetMCJITOptimizationLevel(uint(g.optLevel))
+	// the engine is created with the empty module of the generator, and takes it over.
+	ee, err := llvm.NewMCJITCompiler(g.mod, opts)
+	if err != nil {
+		return nil, err
+	}
+	g.takeModule(sessionModuleName(1))
+	return &Session{
+		g:       g,
+		ee:      ee,
+		funcs:   make(map[string]*sessionFunc),
+		symbols: make(map[string]bool),
+		externs: make(map[string]bool),
+	}, nil
+}
+
+// Dispose disposes the generator, the engine and the modules added to it.
+func (s *Session) Dispose() {
+	s.g.Dispose()
+	s.ee.Dispose()
+}
+
+// Run generates code for the functions of the file that are not generated yet, and executes
+// its toplevel expressions. It returns the value of the last toplevel expression.
+// If it fails, the session is left as it was.
+func (s *Session) Run(fileast *ast.File) (float64, error) {
+	info, err := sema.Check(fileast)
+	if err != nil {
+		return 0, err
+	}
+
+	var instances []*sema.Instance
+	changed := make(map[string]bool)
+	for _, inst := range info.Instances {
+		if inst.Func.Defined {
+			instances = append(instances, inst)
+			changed[inst.Name] = !s.generated(inst)
+		}
+	}
+	// the functions calling the functions generated again are generated again to call the new ones.
+	for more := true; more; {
+		more = false
+		for _, inst := range instances {
+			for _, callee := range inst.Callees() {
+				if !changed[inst.Name] && changed[callee.Name] {
+					changed[inst.Name] = true
+					more = true
+				}
+			}
+		}
+	}
+
+	// the module of the generator is the n-th one, and the functions generated again are named after it.
+	n := s.modules + 1
+	g := s.g
+	g.symbols = make(map[string]string)
+	var generate []*sema.Instance
+	for _, inst := range instances {
+		switch {
+		case !changed[inst.Name]:
+			g.symbols[inst.Name] = s.funcs[inst.Name].symbol
+		case s.symbols[inst.Name]:
+			g.symbols[inst.Name] = inst.Name + "." + strconv.Itoa(n)
+			generate = append(generate, inst)
+		default:
+			generate = append(generate, inst)
+		}
+	}
+	// the functions generated for the previous programs are declared to be called.
+	for _, inst := range generate {
+		for _, callee := range inst.Callees() {
+			if !changed[callee.Name] && g.function(callee.Name).IsNil() {
+				llvm.AddFunction(g.mod, g.symbol(callee.Name), llvmFunctionType(callee.Params, callee.Result))
+			}
+		}
+	}
+
+	if err := g.generate(fileast, info, generate); err != nil {
+		g.takeModule(sessionModuleName(n)).Dispose()
+		return 0, err
+	}
+	if err := s.mapExterns(g.mod); err != nil {
+		g.takeModule(sessionModuleName(n)).Dispose()
+		return 0, err
+	}
+	main := g.function(ast.MainName)
+	s.ee.AddModule(g.takeModule(sessionModuleName(n + 1)))
+	s.modules = n
+
+	for _, inst := range generate {
+		callees := make(map[string]bool)
+		for _, callee := range inst.Callees() {
+			callees[callee.Name] = true
+		}
+		symbol := g.symbol(inst.Name)
+		s.funcs[inst.Name] = &sessionFunc{
+			def:     inst.Func.Decl.(*ast.Function),
+			params:  inst.Params,
+			result:  inst.Result,
+			callees: callees,
+			symbol:  symbol,
+		}
+		s.symbols[inst.Name] = true
+		s.symbols[symbol] = true
+	}
+
+	result := s.ee.RunFunction(main, []llvm.GenericValue{})
+	flushRuntime()
+	defer result.Dispose()
+	return result.Float(llvm.DoubleType()), nil
+}
+
+// generated reports whether the function of the instance is generated with its current definition
+// and types, and calls the same instances.
+func (s *Session) generated(inst *sema.Instance) bool {
+	f, ok := s.funcs[inst.Name]
+	if !ok || f.def != inst.Func.Decl || f.result != inst.Result || len(f.params) != len(inst.Params) {
+		return false
+	}
+	for i, t := range inst.Params {
+		if f.params[i] != t {
+			return false
+		}
+	}
+	callees := inst.Callees()
+	if len(callees) != len(f.callees) {
+		return false
+	}
+	for _, callee := range callees {
+		if !f.callees[callee.Name] {
+			return false
+		}
+	}
+	return true
+}
+
+// mapExterns resolves the external functions called in the module to functions in the host
+// process, except for the functions generated in the session, which the engine resolves.
+// Each external function is mapped once, since the engine maps it by name.
+func (s *Session) mapExterns(mod llvm.Module) error {
+	for f := mod.FirstFunction(); !f.IsNil(); f = llvm.NextFunction(f) {
+		name := f.Name()
+		if !f.IsDeclaration() || f.IntrinsicID() != 0 || f.FirstUse().IsNil() || s.symbols[name] || s.externs[name] {
+			continue
+		}
+		addr := lookupRuntimeSymbol(name)
+		if addr == nil {
+			return fmt.Errorf("unresolved external function: %q", name)
+		}
+		s.ee.AddGlobalMapping(f, addr)
+		s.externs[name] = true
+	}
+	return nil
+}
+
+// takeModule returns the module of the generator, which the caller takes over, and makes the
+// generator generate code into a new module named name for the same target.
+func (g *Generator) takeModule(name string) llvm.Module {
+	mod := g.mod
+	g.fpm.FinalizeFunc()
+	g.fpm.Dispose()
+	if g.debug != nil {
+		g.debug.dispose()
+		g.debug = nil
+	}
+
+	g.mod = llvm.NewModule(name)
+	g.fpm = newFunctionPassManager(g.mod, g.optLevel)
+	data := g.machine.CreateTargetData()
+	defer data.Dispose()
+	g.mod.SetTarget(g.machine.Triple())
+	g.mod.SetDataLayout(data.String())
+	return mod
+}
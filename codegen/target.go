@@ -0,0 +1,56 @@
+package codegen
+
+import (
+	"fmt"
+
+	"llvm.org/llvm/bindings/go/llvm"
+)
+
+// Target describes the machine that code is generated for.
+type Target struct {
+	Triple   string // target triple such as "aarch64-unknown-linux-gnu"; the host's if empty
+	CPU      string // CPU name such as "cortex-a72"; a generic CPU if empty
+	Features string // comma separated CPU features such as "+avx2,-sse4.1"
+}
+
+// HostTarget returns the target of the host machine.
+func HostTarget() Target {
+	return Target{Triple: llvm.DefaultTargetTriple()}
+}
+
+// SetTarget sets the machine that code is generated for. It sets the target triple and
+// the data layout of the module, so it must be called before generating code.
+func (g *Generator) SetTarget(t Target) error {
+	if t.Triple == "" {
+		t.Triple = llvm.DefaultTargetTriple()
+	}
+	target, err := llvm.GetTargetFromTriple(t.Triple)
+	if err != nil {
+		return fmt.Errorf("unsupported target %q: %v", t.Triple, err)
+	}
+	machine := target.CreateTargetMachine(t.Triple, t.CPU, t.Features,
+		codeGenLevel(g.optLevel), llvm.RelocDefault, llvm.CodeModelDefault)
+
+	data := machine.CreateTargetData()
+	defer data.Dispose()
+	g.mod.SetTarget(machine.Triple())
+	g.mod.SetDataLayout(data.String())
+
+	// the machine is not created yet when the generator is being created.
+	if g.target.Triple != "" {
+		g.machine.Dispose()
+	}
+	g.target = t
+	g.machine = machine
+	return nil
+}
+
+// Target returns the machine that code is generated for.
+func (g *Generator) Target() Target {
+	return g.target
+}
+
+// isHost reports whether code is generated for the host machine, so that it can be run in process.
+func (g *Generator) isHost() bool {
+	return g.target.Triple == llvm.DefaultTargetTriple()
+}
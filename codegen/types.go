@@ -0,0 +1,161 @@
+package codegen
+
+import (
+	"github.com/agatan/kaleigo/ast"
+	"github.com/agatan/kaleigo/sema"
+
+	"llvm.org/llvm/bindings/go/llvm"
+)
+
+// llvmType returns the llvm type of values of the type. Values that are not annotated are doubles.
+func llvmType(t ast.Type) llvm.Type {
+	switch t {
+	case ast.TypeI64:
+		return llvm.Int64Type()
+	case ast.TypeBool:
+		return llvm.Int1Type()
+	case ast.TypeString:
+		return stringType()
+	default:
+		return llvm.DoubleType()
+	}
+}
+
+// stringType returns the llvm type of strings: the pointer to the bytes, which are not terminated
+// by NUL, and the number of the bytes. It is laid out as struct kaleigo_string in lib/runtime.c,
+// but external functions take and return strings through pointers, as cFunctionType describes.
+func stringType() llvm.Type {
+	return llvm.StructType([]llvm.Type{llvm.PointerType(llvm.Int8Type(), 0), llvm.Int64Type()}, false)
+}
+
+// astType returns the type of values of the llvm type.
+func astType(t llvm.Type) ast.Type {
+	switch t {
+	case llvm.Int64Type():
+		return ast.TypeI64
+	case llvm.Int1Type():
+		return ast.TypeBool
+	case stringType():
+		return ast.TypeString
+	default:
+		return ast.TypeF64
+	}
+}
+
+// functionType returns the llvm type of the function of the prototype: the types inferred by sema
+// if the file is analyzed by Generate, and the annotated types otherwise.
+func (g *Generator) functionType(p *ast.Prototype) llvm.Type {
+	if obj := g.cFunction(p.Name); obj != nil {
+		return cFunctionType(obj.Params, obj.Type)
+	}
+	if g.info != nil {
+		if obj, ok := g.info.Funcs[p.Name]; ok {
+			return llvmFunctionType(obj.Params, obj.Type)
+		}
+	}
+	params := make([]ast.Type, len(p.Args))
+	for i := range params {
+		params[i] = p.ArgType(i)
+	}
+	return llvmFunctionType(params, p.ResultType)
+}
+
+// cFunctionType returns the llvm type of an external function, which is implemented in C.
+// Since the ABIs of C differ in how they pass structs by value, a string argument is passed as
+// a pointer to a copy of it, and a string result is stored to the string pointed to by an extra
+// first parameter, in which case the function returns void.
+func cFunctionType(params []ast.Type, result ast.Type) llvm.Type {
+	var types []llvm.Type
+	ret := llvmType(result)
+	if result == ast.TypeString {
+		types = append(types, llvm.PointerType(stringType(), 0))
+		ret = llvm.VoidType()
+	}
+	for _, t := range params {
+		if t == ast.TypeString {
+			types = append(types, llvm.PointerType(stringType(), 0))
+		} else {
+			types = append(types, llvmType(t))
+		}
+	}
+	return llvm.FunctionType(ret, types, false)
+}
+
+func llvmFunctionType(params []ast.Type, result ast.Type) llvm.Type {
+	types := make([]llvm.Type, len(params))
+	for i, t := range params {
+		types[i] = llvmType(t)
+	}
+	return llvm.FunctionType(llvmType(result), types, false)
+}
+
+// cFunction returns the object of the external function named name, which is declared by an extern
+// and not defined, or nil if it is not one. It is found only in the files analyzed by Generate.
+func (g *Generator) cFunction(name string) *sema.Object {
+	if g.info == nil {
+		return nil
+	}
+	if obj, ok := g.info.Funcs[name]; ok && !obj.Defined {
+		return obj
+	}
+	return nil
+}
+
+// typeOf returns the type of the expression found by sema, in the instance being generated.
+// Expressions generated without the analysis, as by GenExpr called directly, are f64.
+func (g *Generator) typeOf(expr ast.Expr) ast.Type {
+	t := ast.NoType
+	switch {
+	case g.inst != nil:
+		t = g.inst.TypeOf(expr)
+	case g.info != nil:
+		t = g.info.Types[expr]
+	}
+	if t == ast.NoType {
+		return ast.TypeF64
+	}
+	return t
+}
+
+// convert converts the value to the type. Booleans are converted to 0.0 or 1.0, and values
+// are converted to booleans by comparing them with 0, where NaN is false.
+// Programs analyzed by sema convert only booleans to doubles, and the value of the main function
+// to a double. The other conversions are for code generated without the analysis.
+func (g *Generator) convert(v llvm.Value, t llvm.Type) llvm.Value {
+	from := v.Type()
+	switch {
+	case from == t:
+		return v
+	case t == llvm.Int1Type() && from == llvm.DoubleType():
+		return g.builder.CreateFCmp(llvm.FloatONE, v, llvm.ConstFloat(from, 0.0), "tobool")
+	case t == llvm.Int1Type():
+		return g.builder.CreateICmp(llvm.IntNE, v, llvm.ConstNull(from), "tobool")
+	case from == llvm.Int1Type():
+		if t == llvm.DoubleType() {
+			return g.builder.CreateUIToFP(v, t, "booltmp")
+		}
+		return g.builder.CreateZExt(v, t, "booltmp")
+	case t == llvm.DoubleType():
+		return g.builder.CreateSIToFP(v, t, "convtmp")
+	default:
+		return g.builder.CreateFPToSI(v, t, "convtmp")
+	}
+}
+
+// Predicates of the comparison operators. Comparisons of doubles other than '==' and '!=' are
+// unordered, i.e. true if either operand is NaN.
+var (
+	floatPredicates = map[string]llvm.FloatPredicate{
+		"<": llvm.FloatULT, ">": llvm.FloatUGT, "<=": llvm.FloatULE, ">=": llvm.FloatUGE,
+		"==": llvm.FloatOEQ, "!=": llvm.FloatUNE,
+	}
+	intPredicates = map[string]llvm.IntPredicate{
+		"<": llvm.IntSLT, ">": llvm.IntSGT, "<=": llvm.IntSLE, ">=": llvm.IntSGE,
+		"==": llvm.IntEQ, "!=": llvm.IntNE,
+	}
+)
+
+// isInt reports whether the value is an i64.
+func isInt(v llvm.Value) bool {
+	return v.Type() == llvm.Int64Type()
+}
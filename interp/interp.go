@@ -0,0 +1,334 @@
+// Package interp evaluates kaleigo programs by walking their syntax trees.
+// Unlike codegen, it is written in pure Go and does not need LLVM.
+package interp
+
+import (
+	"bufio"
+	"io"
+	"math"
+
+	"github.com/agatan/kaleigo/ast"
+	"github.com/agatan/kaleigo/builtins"
+)
+
+// function is a callable kaleigo function: either a definition in the program or a builtin.
+type function struct {
+	args    []string
+	body    ast.Expr
+	builtin *builtins.Func
+}
+
+// maxFrames limits the depth of calls, so that infinite recursion fails instead of
+// exhausting the Go stack, which is not recoverable.
+const maxFrames = 1 << 16
+
+// Interpreter holds the functions of the running program.
+type Interpreter struct {
+	out      *bufio.Writer
+	funcs    map[string]*function
+	filename string
+	depth    int // number of calls in progress
+}
+
+// New creates a new interpreter. The output of putd and putchard is written to out.
+func New(out io.Writer) *Interpreter {
+	return &Interpreter{
+		out: bufio.NewWriter(out),
+	}
+}
+
+// Run evaluates all of toplevel expressions in the file in order, and returns the value of the last one.
+// Externs of functions that are not defined in the file are resolved to the functions in package builtins.
+func (in *Interpreter) Run(fileast *ast.File) (result float64, err error) {
+	in.filename = fileast.Name
+	in.funcs = make(map[string]*function)
+	defer func() {
+		if ferr := in.out.Flush(); err == nil {
+			err = ferr
+		}
+	}()
+
+	for _, def := range fileast.Defs {
+		in.funcs[def.Name] = &function{args: def.Args, body: def.Body}
+	}
+	// externs of defined functions are forward declarations, and refer to the definitions.
+	for _, extern := range fileast.Externs {
+		if f, ok := in.funcs[extern.Name]; ok && f.builtin == nil {
+			continue
+		}
+		b, err := builtins.Resolve(extern.Name, len(extern.Args))
+		if err != nil {
+			return 0, in.errorf(extern.Pos(), "%v", err)
+		}
+		in.funcs[extern.Name] = &function{args: extern.Args, builtin: b}
+	}
+
+	main := fileast.CreateMain()
+	return in.call(main.Pos(), &function{args: main.Args, body: main.Body}, nil)
+}
+
+// errorf returns an error located at pos.
+func (in *Interpreter) errorf(pos ast.Pos, format string, args ...interface{}) error {
+	return ast.Errorf(in.filename, pos, format, args...)
+}
+
+// call calls the function with the arguments, whose number must match the parameters.
+// pos is the position of the call, where a stack overflow is reported.
+func (in *Interpreter) call(pos ast.Pos, f *function, args []float64) (float64, error) {
+	if f.builtin != nil {
+		return f.builtin.Call(in.out, args), nil
+	}
+	if in.depth == maxFrames {
+		return 0, in.errorf(pos, "stack overflow")
+	}
+	in.depth++
+	defer func() { in.depth-- }()
+	env := make(map[string]float64, len(args))
+	for i, arg := range f.args {
+		env[arg] = args[i]
+	}
+	return in.eval(f.body, env)
+}
+
+// truthy reports whether v is true as a condition, i.e. it is neither 0.0 nor NaN.
+func truthy(v float64) bool {
+	return v != 0.0 && !math.IsNaN(v)
+}
+
+// boolean converts b to 0.0 or 1.0.
+func boolean(b bool) float64 {
+	if b {
+		return 1.0
+	}
+	return 0.0
+}
+
+// eval evaluates the expression. env holds the values of the variables in scope.
+func (in *Interpreter) eval(expr ast.Expr, env map[string]float64) (float64, error) {
+	switch e := expr.(type) {
+	case *ast.ErrorExpr:
+		return 0, in.errorf(e.Pos(), "invalid expression")
+	case *ast.NumberExpr:
+		return e.Val, nil
+	case *ast.StringExpr:
+		return 0, in.errorf(e.Pos(), "strings are not supported by the interpreter")
+	case *ast.VariableExpr:
+		v, ok := env[e.Name]
+		if !ok {
+			return 0, in.errorf(e.Pos(), "unknown variable name : %q", e.Name)
+		}
+		return v, nil
+	case *ast.UnaryExpr:
+		operand, err := in.eval(e.Operand, env)
+		if err != nil {
+			return 0, err
+		}
+		switch e.Op {
+		case "-":
+			return -operand, nil
+		case "!":
+			return boolean(!truthy(operand)), nil
+		}
+		// user-defined unary operator
+		f, ok := in.funcs[ast.UnaryFunctionName(e.Op)]
+		if !ok {
+			return 0, in.errorf(e.Pos(), "unknown unary operator: %q", e.Op)
+		}
+		return in.call(e.Pos(), f, []float64{operand})
+
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case "&&", "||":
+			return in.evalLogical(e, env)
+		case "=":
+			return in.evalAssign(e, env)
+		}
+		l, err := in.eval(e.LHS, env)
+		if err != nil {
+			return 0, err
+		}
+		r, err := in.eval(e.RHS, env)
+		if err != nil {
+			return 0, err
+		}
+
+		switch e.Op {
+		case "+":
+			return l + r, nil
+		case "-":
+			return l - r, nil
+		case "*":
+			return l * r, nil
+		case "/":
+			return l / r, nil
+		case "%":
+			return math.Mod(l, r), nil
+		case "<":
+			return boolean(!(l >= r)), nil
+		case ">":
+			return boolean(!(l <= r)), nil
+		case "<=":
+			return boolean(!(l > r)), nil
+		case ">=":
+			return boolean(!(l < r)), nil
+		case "==":
+			return boolean(l == r), nil
+		case "!=":
+			return boolean(l != r), nil
+		default:
+			// user-defined binary operator
+			f, ok := in.funcs[ast.BinaryFunctionName(e.Op)]
+			if !ok {
+				return 0, in.errorf(e.Pos(), "invalid binary operator: %q", e.Op)
+			}
+			return in.call(e.Pos(), f, []float64{l, r})
+		}
+
+	case *ast.CallExpr:
+		f, ok := in.funcs[e.Callee]
+		if !ok {
+			return 0, in.errorf(e.Pos(), "unknown function referenced: %q", e.Callee)
+		}
+		if len(f.args) != len(e.Args) {
+			return 0, in.errorf(e.Pos(), "incorrect number of arguments passed for %q. %d expected, but %d given", e.Callee, len(f.args), len(e.Args))
+		}
+		args := make([]float64, len(e.Args))
+		for i, arg := range e.Args {
+			v, err := in.eval(arg, env)
+			if err != nil {
+				return 0, err
+			}
+			args[i] = v
+		}
+		return in.call(e.Pos(), f, args)
+
+	case *ast.BlockExpr:
+		last := 0.0
+		for _, e := range e.Exprs {
+			var err error
+			last, err = in.eval(e, env)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return last, nil
+
+	case *ast.IfExpr:
+		cond, err := in.eval(e.Cond, env)
+		if err != nil {
+			return 0, err
+		}
+		if truthy(cond) {
+			return in.eval(e.Then, env)
+		}
+		return in.eval(e.Else, env)
+
+	case *ast.ForExpr:
+		start, err := in.eval(e.Start, env)
+		if err != nil {
+			return 0, err
+		}
+		oldVal, oldExists := env[e.Var]
+		env[e.Var] = start
+
+		for {
+			if _, err := in.eval(e.Body, env); err != nil {
+				return 0, err
+			}
+			step := 1.0
+			if e.Step != nil {
+				step, err = in.eval(e.Step, env)
+				if err != nil {
+					return 0, err
+				}
+			}
+			end, err := in.eval(e.End, env)
+			if err != nil {
+				return 0, err
+			}
+			env[e.Var] += step
+			if !truthy(end) {
+				break
+			}
+		}
+
+		if oldExists {
+			env[e.Var] = oldVal
+		} else {
+			delete(env, e.Var)
+		}
+		return 0, nil
+
+	case *ast.VarExpr:
+		oldVals := make([]float64, len(e.Vars))
+		oldExists := make([]bool, len(e.Vars))
+		for i, v := range e.Vars {
+			// the outer value is saved only after the initializer has read it from env.
+			init := 0.0
+			if v.Init != nil {
+				var err error
+				init, err = in.eval(v.Init, env)
+				if err != nil {
+					return 0, err
+				}
+			}
+			oldVals[i], oldExists[i] = env[v.Name]
+			env[v.Name] = init
+		}
+
+		body, err := in.eval(e.Body, env)
+		if err != nil {
+			return 0, err
+		}
+
+		for i := len(e.Vars) - 1; i >= 0; i-- {
+			if oldExists[i] {
+				env[e.Vars[i].Name] = oldVals[i]
+			} else {
+				delete(env, e.Vars[i].Name)
+			}
+		}
+		return body, nil
+
+	default:
+		panic("internal interpreter error")
+	}
+}
+
+// evalAssign evaluates an assignment to a mutable variable. The result is the assigned value.
+func (in *Interpreter) evalAssign(e *ast.BinaryExpr, env map[string]float64) (float64, error) {
+	lhs, ok := e.LHS.(*ast.VariableExpr)
+	if !ok {
+		return 0, in.errorf(e.Pos(), "destination of '=' must be a variable")
+	}
+	val, err := in.eval(e.RHS, env)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := env[lhs.Name]; !ok {
+		return 0, in.errorf(lhs.Pos(), "unknown variable name : %q", lhs.Name)
+	}
+	env[lhs.Name] = val
+	return val, nil
+}
+
+// evalLogical evaluates "&&" and "||" with short-circuit.
+// The right hand side is evaluated only if the left hand side does not decide the result.
+// The result is 0.0 or 1.0.
+func (in *Interpreter) evalLogical(e *ast.BinaryExpr, env map[string]float64) (float64, error) {
+	l, err := in.eval(e.LHS, env)
+	if err != nil {
+		return 0, err
+	}
+	if e.Op == "&&" && !truthy(l) {
+		return 0.0, nil
+	}
+	if e.Op == "||" && truthy(l) {
+		return 1.0, nil
+	}
+	r, err := in.eval(e.RHS, env)
+	if err != nil {
+		return 0, err
+	}
+	return boolean(truthy(r)), nil
+}
@@ -0,0 +1,119 @@
+package interp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/agatan/kaleigo/parse"
+)
+
+func run(t *testing.T, src string) (float64, string, error) {
+	f, err := parse.New("test", src).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	v, err := New(&out).Run(f)
+	return v, out.String(), err
+}
+
+func TestRunExpressions(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"10 - 4 - 3", 3},
+		{"7 / 2", 3.5},
+		{"7 % 4", 3},
+		{"-(1 + 2)", -3},
+		{"1 < 2", 1},
+		{"2 <= 1", 0},
+		{"3 == 3", 1},
+		{"3 != 3", 0},
+		{"!0", 1},
+		{"!(0/0)", 1},
+		{"(0/0) || !(0/0)", 1},
+		{"1 && 0", 0},
+		{"0 || 2", 1},
+		{"if 1 < 2 then 10 else 20", 10},
+		{"var a = 1, b in b = a + 1", 2},
+		{"var a, b in (a = b = 3) + a + b", 9},
+		{"var x = 2 in (var x = x * 3 in x) + x", 8},
+		{"def f(x) x * x\nf(3) + f(4)", 25},
+		{"def binary| 5 (a b) if a then 1 else if b then 1 else 0\n0 | 1 + 1", 1},
+		{"def unary~(v) 0 - v\n~2 * 3", -6},
+		{"extern pow(x, y)\npow(2, 10)", 1024},
+		{"extern f(x)\ndef f(x) x + 1\nf(2)", 3},
+		{"extern sin(x)\ndef sin(x) x * 2\nsin(2)", 4},
+		{"def fib(x) if x < 3 then 1 else fib(x-1) + fib(x-2)\nfib(10)", 55},
+		{"def binary& 1 (x y) y\n" +
+			"def fibi(x) var a = 1, b = 1, c in (for i = 3, i < x in c = a + b & a = b & b = c) & b\nfibi(10)", 55},
+		{"def binary& 1 (x y) y\nvar n = 0 in (for i = 0, i < 3 in n = n + 1) & n", 4},
+		{"1; 2; 3", 3},
+		{"", 0},
+	}
+	for _, c := range cases {
+		v, _, err := run(t, c.src)
+		if err != nil {
+			t.Errorf("%q: %s", c.src, err)
+			continue
+		}
+		if v != c.expected {
+			t.Errorf("%q: expected %f, actual %f", c.src, c.expected, v)
+		}
+	}
+}
+
+func TestRunOutput(t *testing.T) {
+	src := `
+extern putd(x)
+extern putchard(c)
+def binary& 1 (x y) y
+def side(x) putchard(x) & 1
+for i = 0, i < 3 in putd(i)
+0 && side(65)
+1 && side(66)
+putchard(10)
+`
+	_, out, err := run(t, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "0.000000\n1.000000\n2.000000\n3.000000\nB\n"
+	if out != expected {
+		t.Errorf("wrong output: expected %q, actual %q", expected, out)
+	}
+}
+
+func TestRunOutputNaN(t *testing.T) {
+	// the sign of 0/0 depends on the machine, and putd prints it as printf of glibc does.
+	_, out, err := run(t, "extern putd(x)\nputd(0/0); putd(-(0/0))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "-nan\nnan\n" && out != "nan\n-nan\n" {
+		t.Errorf("wrong output: expected NaNs of both signs, actual %q", out)
+	}
+}
+
+func TestRunError(t *testing.T) {
+	cases := []struct {
+		src string
+		msg string
+	}{
+		{"x + 1", `test:1:1: unknown variable name : "x"`},
+		{"f(1)", `test:1:1: unknown function referenced: "f"`},
+		{"def f(x) x\n1 + f(1, 2)", `test:2:5: incorrect number of arguments passed for "f". 1 expected, but 2 given`},
+		{"extern printf(x)", `test:1:8: unresolved external function: "printf"`},
+		{"extern sin(x, y)", `test:1:8: external function "sin" takes 1 arguments, but declared with 2`},
+		{"sin(1)", `test:1:1: unknown function referenced: "sin"`},
+		{"def f(x) f(x + 1)\nf(0)", `test:1:10: stack overflow`},
+	}
+	for _, c := range cases {
+		_, _, err := run(t, c.src)
+		if err == nil || err.Error() != c.msg {
+			t.Errorf("wrong error for %q: expected %q, actual %v", c.src, c.msg, err)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+// Package lib embeds the runtime of kaleigo programs, so that the compiler can link it
+// wherever it is run from.
+package lib
+
+import _ "embed"
+
+// RuntimeC is the source of runtime.c, which is linked into native executables.
+//
+//go:embed runtime.c
+var RuntimeC []byte
+
+// RuntimeCName is the file name of RuntimeC.
+const RuntimeCName = "runtime.c"
@@ -1,5 +1,22 @@
+//go:build ignore
+
+// The runtime is embedded by lib.go and compiled by the C compiler that links
+// kaleigo programs, not by cgo.
+
 extern double __kaleigo_main();
+#include <stdint.h>
 #include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+// kaleigo_string is a string of kaleigo. The bytes are not terminated by NUL, and
+// ptr may be NULL if len is 0. Strings are passed to the functions below by
+// pointers, and a string result is stored through the first parameter, as
+// cFunctionType in codegen/types.go describes.
+struct kaleigo_string {
+  const char *ptr;
+  int64_t len;
+};
 
 double putd(double d) {
   printf("%f\n", d);
@@ -11,6 +28,48 @@ double putchard(double d) {
   return  0.0;
 }
 
+double putstr(const struct kaleigo_string *s) {
+  if (s->len > 0) {
+    fwrite(s->ptr, 1, s->len, stdout);
+  }
+  return 0.0;
+}
+
+// strconcat stores a new string, which is never freed, to result.
+void strconcat(struct kaleigo_string *result, const struct kaleigo_string *a, const struct kaleigo_string *b) {
+  struct kaleigo_string s = {NULL, a->len + b->len};
+  if (s.len > 0) {
+    char *p = malloc(s.len);
+    if (p == NULL) {
+      perror("strconcat");
+      exit(1);
+    }
+    if (a->len > 0) {
+      memcpy(p, a->ptr, a->len);
+    }
+    if (b->len > 0) {
+      memcpy(p + a->len, b->ptr, b->len);
+    }
+    s.ptr = p;
+  }
+  *result = s;
+}
+
+int64_t strlength(const struct kaleigo_string *s) {
+  return s->len;
+}
+
+// strcompare returns a negative number, 0 or a positive number if a is less than,
+// equal to or greater than b in the lexicographical order of the bytes.
+int64_t strcompare(const struct kaleigo_string *a, const struct kaleigo_string *b) {
+  int64_t n = a->len < b->len ? a->len : b->len;
+  int c = n > 0 ? memcmp(a->ptr, b->ptr, n) : 0;
+  if (c != 0) {
+    return c;
+  }
+  return (a->len > b->len) - (a->len < b->len);
+}
+
 int main(void) {
   __kaleigo_main();
 }
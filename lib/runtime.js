@@ -0,0 +1,106 @@
+// Runtime of kaleigo programs compiled to WebAssembly, the counterpart of runtime.c.
+//
+// It provides the "env" imports of the modules: putd, putchard, __kaleigo_fmod for '%' and the C math functions.
+//
+// Node.js:
+//
+//   node lib/runtime.js prog.wasm
+//
+// Browsers:
+//
+//   <script src="runtime.js"></script>
+//   kaleigo.run(bytes).then((result) => ...);
+(function (root, factory) {
+  if (typeof module === "object" && module.exports) {
+    module.exports = factory();
+  } else {
+    root.kaleigo = factory();
+  }
+})(this, function () {
+  "use strict";
+
+  const signBuffer = new DataView(new ArrayBuffer(8));
+
+  // formatDouble formats d as printf("%f") of glibc does, which prints the sign of NaN.
+  function formatDouble(d) {
+    if (Number.isNaN(d)) {
+      signBuffer.setFloat64(0, d);
+      return signBuffer.getUint8(0) & 0x80 ? "-nan" : "nan";
+    }
+    if (!Number.isFinite(d)) {
+      return d > 0 ? "inf" : "-inf";
+    }
+    if (Math.abs(d) >= 1e21) {
+      // toFixed switches to exponential notation, but such doubles are integers.
+      return BigInt(d).toString() + ".000000";
+    }
+    const s = d.toFixed(6);
+    return Object.is(d, -0) ? "-" + s : s;
+  }
+
+  const mathFunctions = {
+    sin: Math.sin, cos: Math.cos, tan: Math.tan,
+    asin: Math.asin, acos: Math.acos, atan: Math.atan, atan2: Math.atan2,
+    sinh: Math.sinh, cosh: Math.cosh, tanh: Math.tanh,
+    exp: Math.exp, log: Math.log, log10: Math.log10, pow: Math.pow, sqrt: Math.sqrt,
+    fabs: Math.abs, floor: Math.floor, ceil: Math.ceil,
+    // C rounds halfway cases away from zero.
+    round: (x) => Math.sign(x) * Math.round(Math.abs(x)),
+    // '%' of JavaScript is fmod of C.
+    fmod: (x, y) => x % y,
+  };
+
+  // imports returns the imports of a module, which writes its output as bytes with write.
+  function imports(write) {
+    const ascii = (s) => Uint8Array.from(s, (c) => c.charCodeAt(0));
+    const env = Object.assign({}, mathFunctions, {
+      putd: (d) => {
+        write(ascii(formatDouble(d) + "\n"));
+        return 0;
+      },
+      putchard: (d) => {
+        write(Uint8Array.of(Math.trunc(d) & 0xff));
+        return 0;
+      },
+      // '%' of kaleigo, under a name that does not collide with externs.
+      __kaleigo_fmod: mathFunctions.fmod,
+    });
+    return { env: env };
+  }
+
+  // consoleWriter returns a writer that logs the output to the console line by line.
+  function consoleWriter() {
+    const decoder = new TextDecoder();
+    let line = "";
+    return (bytes) => {
+      line += decoder.decode(bytes, { stream: true });
+      let i;
+      while ((i = line.indexOf("\n")) >= 0) {
+        console.log(line.slice(0, i));
+        line = line.slice(i + 1);
+      }
+    };
+  }
+
+  // run instantiates the module and calls its __kaleigo_main. It resolves to the value of the
+  // last top-level expression.
+  function run(bytes, write) {
+    return WebAssembly.instantiate(bytes, imports(write || consoleWriter())).then((result) =>
+      result.instance.exports.__kaleigo_main()
+    );
+  }
+
+  if (typeof require === "function" && typeof process === "object" && require.main === module) {
+    const fs = require("fs");
+    if (process.argv.length !== 3) {
+      process.stderr.write("usage: node runtime.js prog.wasm\n");
+      process.exit(2);
+    }
+    run(fs.readFileSync(process.argv[2]), (bytes) => fs.writeSync(1, bytes)).catch((err) => {
+      process.stderr.write(err + "\n");
+      process.exit(1);
+    });
+  }
+
+  return { formatDouble: formatDouble, imports: imports, run: run };
+});
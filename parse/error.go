@@ -0,0 +1,51 @@
+package parse
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/agatan/kaleigo/ast"
+)
+
+// Error is a syntax error found while lexing or parsing a source file.
+type Error struct {
+	Filename string
+	Span     ast.Span
+	Msg      string
+	// Expected and Found describe the mismatched token of "expected X, found Y" errors.
+	// They are empty for other kinds of errors.
+	Expected string
+	Found    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%s: %s", e.Filename, e.Span.Start, e.Msg)
+}
+
+// eofDescription is Found of the errors at the end of the input.
+const eofDescription = "end of file"
+
+// AtEOF reports whether the error is caused by the unexpected end of the input, i.e. whether
+// the input may be continued to be valid.
+func (e *Error) AtEOF() bool {
+	return e.Found == eofDescription
+}
+
+// ErrorList is a list of syntax errors in the order they were found.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Err returns nil if the list is empty, and the list itself otherwise.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
@@ -2,14 +2,19 @@ package parse
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
+
+	"github.com/agatan/kaleigo/ast"
 )
 
 type token struct {
-	kind  tokenType
-	value string
+	kind     tokenType
+	value    string
+	span     ast.Span
+	comments []*ast.Comment // comments between the previous token and this one
 }
 
 type tokenType int
@@ -26,12 +31,17 @@ const (
 	tokElse
 	tokFor
 	tokIn
+	tokBinary
+	tokUnary
+	tokVar
 
 	tokIdentifier
 	tokNumber
+	tokString
 
 	tokSemi
 	tokComma
+	tokColon
 	tokLparen
 	tokRparen
 
@@ -45,7 +55,16 @@ const (
 	tokMinus
 	tokStar
 	tokSlash
+	tokPercent
 	tokLessThan
+	tokGreaterThan
+	tokLessEqual
+	tokGreaterEqual
+	tokEqualEqual
+	tokNotEqual
+	tokAndAnd
+	tokOrOr
+	tokBang
 )
 
 var keywords = map[string]tokenType{
@@ -56,35 +75,55 @@ var keywords = map[string]tokenType{
 	"else":   tokElse,
 	"for":    tokFor,
 	"in":     tokIn,
+	"binary": tokBinary,
+	"unary":  tokUnary,
+	"var":    tokVar,
 }
 
-var op = map[rune]tokenType{
-	'=': tokEqual,
-	'+': tokPlus,
-	'-': tokMinus,
-	'*': tokStar,
-	'/': tokSlash,
-	'<': tokLessThan,
+// builtinOps maps built-in operators to their token types.
+// Operators are at most 2 characters long, and the longest one is chosen by the lexer.
+var builtinOps = map[string]tokenType{
+	"=":  tokEqual,
+	"+":  tokPlus,
+	"-":  tokMinus,
+	"*":  tokStar,
+	"/":  tokSlash,
+	"%":  tokPercent,
+	"<":  tokLessThan,
+	">":  tokGreaterThan,
+	"<=": tokLessEqual,
+	">=": tokGreaterEqual,
+	"==": tokEqualEqual,
+	"!=": tokNotEqual,
+	"&&": tokAndAnd,
+	"||": tokOrOr,
+	"!":  tokBang,
 }
 
+// userOpType is a set of kinds of a user-defined operator.
+// The same character can be defined as both an unary and a binary operator.
 type userOpType int
 
 const (
-	uopNOP userOpType = iota
-	uopUnaryOp
-	uopBinaryOp
+	uopNOP      userOpType = 0
+	uopUnaryOp  userOpType = 1 << 0
+	uopBinaryOp userOpType = 1 << 1
 )
 
 type stateFn func(*lexer) stateFn
 
 // lexer has a scanner state.
+// Tokens are scanned on demand, so user-defined operators registered by the parser
+// take effect from the next token.
 type lexer struct {
 	input         string
 	name          string
 	pos           int
 	start         int
+	startPos      ast.Pos // line and column of start
 	width         int
-	tokens        chan token
+	tokens        []token        // scanned but not yet consumed tokens
+	comments      []*ast.Comment // comments not yet attached to a token
 	state         stateFn
 	userOperators map[rune]userOpType
 }
@@ -94,23 +133,25 @@ func lex(name, input string) *lexer {
 	l := &lexer{
 		name:          name,
 		input:         input,
-		tokens:        make(chan token, 10),
+		startPos:      ast.Pos{Line: 1, Column: 1},
+		state:         lexToplevel,
 		userOperators: map[rune]userOpType{},
 	}
-	go l.run()
 	return l
 }
 
-func (l *lexer) run() {
-	for l.state = lexToplevel; l.state != nil; {
-		l.state = l.state(l)
-	}
-	close(l.tokens)
-}
-
 // Nexttoken returns the next token.
+// Once the input is exhausted, it keeps returning tokEOF.
 func (l *lexer) nextToken() token {
-	return <-l.tokens
+	for len(l.tokens) == 0 {
+		if l.state == nil {
+			return token{kind: tokEOF, span: ast.Span{Start: l.startPos, End: l.startPos}}
+		}
+		l.state = l.state(l)
+	}
+	t := l.tokens[0]
+	l.tokens = l.tokens[1:]
+	return t
 }
 
 func (l *lexer) word() string {
@@ -140,20 +181,50 @@ func (l *lexer) peek() rune {
 	return r
 }
 
+// span returns the span of the current word.
+func (l *lexer) span() ast.Span {
+	end := l.startPos
+	for _, r := range l.word() {
+		if r == '\n' {
+			end.Line++
+			end.Column = 1
+		} else {
+			end.Column++
+		}
+	}
+	end.Offset = l.pos
+	return ast.Span{Start: l.startPos, End: end}
+}
+
 func (l *lexer) emit(t tokenType) {
-	l.tokens <- token{kind: t, value: l.word()}
+	sp := l.span()
+	l.tokens = append(l.tokens, token{kind: t, value: l.word(), span: sp, comments: l.comments})
+	l.comments = nil
 	l.start = l.pos
+	l.startPos = sp.End
 }
 
+// emitComment saves the current word as a comment, which is attached to the next token.
+func (l *lexer) emitComment() {
+	sp := l.span()
+	l.comments = append(l.comments, &ast.Comment{Span: sp, Text: l.word()})
+	l.start = l.pos
+	l.startPos = sp.End
+}
+
+// errorf emits an error token for the current word and resumes lexing after it.
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.tokens <- token{
+	l.tokens = append(l.tokens, token{
 		kind:  tokError,
 		value: fmt.Sprintf(format, args...),
-	}
-	return nil
+		span:  l.span(),
+	})
+	l.ignore()
+	return lexToplevel
 }
 
 func (l *lexer) ignore() {
+	l.startPos = l.span().End
 	l.start = l.pos
 }
 
@@ -180,10 +251,19 @@ func lexToplevel(l *lexer) stateFn {
 		case isSpace(r) || isEOL(r):
 			l.backup()
 			skipWhite(l)
+		case r == '#':
+			return lexLineComment
+		case r == '/' && l.peek() == '/':
+			return lexLineComment
+		case r == '/' && l.peek() == '*':
+			l.next()
+			return lexBlockComment
 		case r == ';':
 			l.emit(tokSemi)
 		case r == ',':
 			l.emit(tokComma)
+		case r == ':':
+			l.emit(tokColon)
 		case r == '(':
 			l.emit(tokLparen)
 		case r == ')':
@@ -191,14 +271,16 @@ func lexToplevel(l *lexer) stateFn {
 		case isNumeric(r):
 			l.backup()
 			return lexNumber
+		case r == '"':
+			return lexString
 		case isAlpha(r):
 			l.backup()
 			return lexIdentifier
-		case op[r] > tokUserBinaryOp:
-			l.emit(op[r])
-		case l.userOperators[r] == uopBinaryOp:
+		case l.acceptOperator(r):
+			// emitted
+		case l.userOperators[r]&uopBinaryOp != 0:
 			l.emit(tokUserBinaryOp)
-		case l.userOperators[r] == uopUnaryOp:
+		case l.userOperators[r]&uopUnaryOp != 0:
 			l.emit(tokUserUnaryOp)
 		default:
 			return l.errorf("unrecognized character: %#U", r)
@@ -220,27 +302,170 @@ func lexNumber(l *lexer) stateFn {
 		l.acceptRun("0123456789")
 	}
 	if isAlphaNumeric(l.peek()) {
-		return l.errorf("bad number syntax: %q", l.word()+string(l.peek()))
+		bad := l.word() + string(l.peek())
+		for isAlphaNumeric(l.next()) {
+		}
+		l.backup()
+		return l.errorf("bad number syntax: %q", bad)
 	}
 	l.emit(tokNumber)
 	return lexToplevel
 }
 
+// escapes maps the characters following '\' in string literals to the characters they stand for.
+// "\xHH" stands for the byte of the two hexadecimal digits.
+var escapes = map[rune]byte{
+	'n':  '\n',
+	't':  '\t',
+	'r':  '\r',
+	'0':  0,
+	'\\': '\\',
+	'"':  '"',
+}
+
+// lexString scans a string literal, which ends on the same line. The opening '"' is already consumed.
+// A literal with a bad escape sequence is reported as a whole, so that the rest of it is not
+// scanned as tokens.
+func lexString(l *lexer) stateFn {
+	bad := ""
+	for {
+		switch r := l.next(); {
+		case r == eof || isEOL(r):
+			l.backup()
+			return l.errorf("unterminated string literal")
+		case r == '"':
+			if bad != "" {
+				return l.errorf("unknown escape sequence: %s", bad)
+			}
+			l.emit(tokString)
+			return lexToplevel
+		case r == '\\':
+			start := l.pos - l.width
+			if !l.acceptEscape() && bad == "" {
+				bad = l.input[start:l.pos]
+			}
+		}
+	}
+}
+
+// acceptEscape consumes the escape sequence following '\', and reports whether it is valid.
+func (l *lexer) acceptEscape() bool {
+	const hexDigits = "0123456789abcdefABCDEF"
+	switch r := l.next(); {
+	case r == 'x':
+		return l.accept(hexDigits) && l.accept(hexDigits)
+	case r == eof || isEOL(r):
+		// the end of line is left for lexString to report.
+		l.backup()
+		return false
+	default:
+		_, ok := escapes[r]
+		return ok
+	}
+}
+
+// unquote returns the value of a string literal scanned by lexString.
+func unquote(lit string) string {
+	var b strings.Builder
+	lit = lit[1 : len(lit)-1]
+	for i := 0; i < len(lit); i++ {
+		if lit[i] != '\\' {
+			b.WriteByte(lit[i])
+			continue
+		}
+		i++
+		if lit[i] == 'x' {
+			n, _ := strconv.ParseUint(lit[i+1:i+3], 16, 8)
+			b.WriteByte(byte(n))
+			i += 2
+			continue
+		}
+		b.WriteByte(escapes[rune(lit[i])])
+	}
+	return b.String()
+}
+
+// lexLineComment scans a comment up to the end of line. The comment marker is already consumed.
+func lexLineComment(l *lexer) stateFn {
+	for r := l.next(); r != eof && !isEOL(r); r = l.next() {
+	}
+	l.backup()
+	l.emitComment()
+	return lexToplevel
+}
+
+// lexBlockComment scans a possibly nested block comment. The opening "/*" is already consumed.
+func lexBlockComment(l *lexer) stateFn {
+	depth := 1
+	for depth > 0 {
+		switch r := l.next(); {
+		case r == eof:
+			return l.errorf("unterminated block comment")
+		case r == '/' && l.peek() == '*':
+			l.next()
+			depth++
+		case r == '*' && l.peek() == '/':
+			l.next()
+			depth--
+		}
+	}
+	l.emitComment()
+	return lexToplevel
+}
+
 func lexIdentifier(l *lexer) stateFn {
 	for isAlphaNumeric(l.next()) {
 	}
 	l.backup()
 	word := l.word()
-	if tok, ok := keywords[word]; ok {
-		l.emit(tok)
-	} else {
+	tok, ok := keywords[word]
+	if !ok {
 		l.emit(tokIdentifier)
+		return lexToplevel
+	}
+	l.emit(tok)
+	if tok == tokBinary || tok == tokUnary {
+		return lexOperatorName
+	}
+	return lexToplevel
+}
+
+// lexOperatorName scans the operator character following 'binary' or 'unary' as tokOther.
+// Spaces may separate them, as in 'binary : 1'. Whether the character can be (re)defined is
+// checked by the parser.
+func lexOperatorName(l *lexer) stateFn {
+	for isSpace(l.peek()) {
+		l.next()
+	}
+	l.ignore()
+	r := l.peek()
+	if r == eof || isSpace(r) || isEOL(r) || isAlphaNumeric(r) || strings.ContainsRune("(),;#\"", r) {
+		return lexToplevel
 	}
+	l.next()
+	l.emit(tokOther)
 	return lexToplevel
 }
 
 // lexing helper functions {{{
 
+// acceptOperator emits the longest built-in operator starting with r, and reports whether it is found.
+// r is already consumed.
+func (l *lexer) acceptOperator(r rune) bool {
+	if n := l.peek(); n != eof {
+		if t, ok := builtinOps[string(r)+string(n)]; ok {
+			l.next()
+			l.emit(t)
+			return true
+		}
+	}
+	if t, ok := builtinOps[string(r)]; ok {
+		l.emit(t)
+		return true
+	}
+	return false
+}
+
 func isSpace(r rune) bool {
 	return r == ' ' || r == '\t'
 }
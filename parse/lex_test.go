@@ -3,6 +3,8 @@ package parse
 import (
 	"reflect"
 	"testing"
+
+	"github.com/agatan/kaleigo/ast"
 )
 
 func TestLex(t *testing.T) {
@@ -26,6 +28,7 @@ func TestLex(t *testing.T) {
 
 	for _, e := range expected {
 		actual := lexer.nextToken()
+		actual.span = ast.Span{}
 		if !reflect.DeepEqual(e, actual) {
 			t.Errorf("lex error: expected %#v, actual %#v", e, actual)
 		}
@@ -39,3 +42,108 @@ func TestLexError(t *testing.T) {
 		t.Errorf("bad number syntax is not detected: result: %#v", actual)
 	}
 }
+
+func TestLexPosition(t *testing.T) {
+	lexer := lex("test", "abc\n  12")
+	expected := []ast.Span{
+		{Start: ast.Pos{Offset: 0, Line: 1, Column: 1}, End: ast.Pos{Offset: 3, Line: 1, Column: 4}},
+		{Start: ast.Pos{Offset: 6, Line: 2, Column: 3}, End: ast.Pos{Offset: 8, Line: 2, Column: 5}},
+		{Start: ast.Pos{Offset: 8, Line: 2, Column: 5}, End: ast.Pos{Offset: 8, Line: 2, Column: 5}},
+	}
+
+	for _, e := range expected {
+		actual := lexer.nextToken()
+		if e != actual.span {
+			t.Errorf("wrong token position of %q: expected %v, actual %v", actual.value, e, actual.span)
+		}
+	}
+}
+
+func TestLexErrorRecovery(t *testing.T) {
+	lexer := lex("test", "1 $ 2x 3")
+	expected := []token{
+		{kind: tokNumber, value: "1"},
+		{kind: tokError, value: "unrecognized character: U+0024 '$'"},
+		{kind: tokError, value: `bad number syntax: "2x"`},
+		{kind: tokNumber, value: "3"},
+		{kind: tokEOF, value: ""},
+	}
+
+	for _, e := range expected {
+		actual := lexer.nextToken()
+		actual.span = ast.Span{}
+		if !reflect.DeepEqual(e, actual) {
+			t.Errorf("lex error: expected %#v, actual %#v", e, actual)
+		}
+	}
+}
+
+func TestLexComment(t *testing.T) {
+	lexer := lex("test", "# line\nabc // line 2\n/* block /* nested */ */ 1 /* unterminated")
+	expected := []struct {
+		kind     tokenType
+		value    string
+		comments []string
+	}{
+		{kind: tokIdentifier, value: "abc", comments: []string{"# line"}},
+		{kind: tokNumber, value: "1", comments: []string{"// line 2", "/* block /* nested */ */"}},
+		{kind: tokError, value: "unterminated block comment"},
+		{kind: tokEOF, value: ""},
+	}
+
+	for _, e := range expected {
+		actual := lexer.nextToken()
+		if actual.kind != e.kind || actual.value != e.value {
+			t.Errorf("lex error: expected %q, actual %q", e.value, actual.value)
+		}
+		comments := []string{}
+		for _, c := range actual.comments {
+			comments = append(comments, c.Text)
+		}
+		if len(e.comments) != len(comments) || len(comments) > 0 && !reflect.DeepEqual(e.comments, comments) {
+			t.Errorf("wrong comments attached to %q: expected %q, actual %q", actual.value, e.comments, comments)
+		}
+	}
+}
+
+func TestLexOperators(t *testing.T) {
+	lexer := lex("test", "a<=b>=c==d!=e<f>g=h/i%j")
+	expected := []tokenType{
+		tokIdentifier, tokLessEqual, tokIdentifier, tokGreaterEqual, tokIdentifier,
+		tokEqualEqual, tokIdentifier, tokNotEqual, tokIdentifier, tokLessThan,
+		tokIdentifier, tokGreaterThan, tokIdentifier, tokEqual, tokIdentifier,
+		tokSlash, tokIdentifier, tokPercent, tokIdentifier, tokEOF,
+	}
+
+	for _, e := range expected {
+		actual := lexer.nextToken()
+		if e != actual.kind {
+			t.Errorf("lex error: expected token type %d, actual %#v", e, actual)
+		}
+	}
+}
+
+func TestLexString(t *testing.T) {
+	lexer := lex("test", `"" "a\tb\\\"c\x41\0" "\q" "\x4" "x`+"\n"+`"\`)
+	expected := []token{
+		{kind: tokString, value: `""`},
+		{kind: tokString, value: `"a\tb\\\"c\x41\0"`},
+		{kind: tokError, value: `unknown escape sequence: \q`},
+		{kind: tokError, value: `unknown escape sequence: \x4`},
+		{kind: tokError, value: "unterminated string literal"},
+		{kind: tokError, value: "unterminated string literal"},
+		{kind: tokEOF, value: ""},
+	}
+
+	for _, e := range expected {
+		actual := lexer.nextToken()
+		actual.span = ast.Span{}
+		if !reflect.DeepEqual(e, actual) {
+			t.Errorf("lex error: expected %#v, actual %#v", e, actual)
+		}
+	}
+
+	if actual, expected := unquote(`"a\tb\\\"c\x41\0"`), "a\tb\\\"cA\x00"; actual != expected {
+		t.Errorf("wrong value of string literal: expected %q, actual %q", expected, actual)
+	}
+}
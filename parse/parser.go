@@ -13,16 +13,32 @@ type Parser struct {
 	lex          *lexer
 	lookahead    [3]token
 	peekCount    int
-	binaryOpPrec map[rune]int
+	prev         token // the last consumed token
+	binaryOpPrec map[string]int
+	errors       ErrorList
+	comments     []*ast.Comment
 }
 
+// bailout is used to unwind the parser stack after an error has been recorded.
+type bailout struct{}
+
 // New creates a new parser.
 func New(name, input string) *Parser {
-	binop := map[rune]int{
-		'<': 10,
-		'+': 20,
-		'-': 20,
-		'*': 20,
+	binop := map[string]int{
+		"=":  2,
+		"||": 4,
+		"&&": 6,
+		"<":  10,
+		">":  10,
+		"<=": 10,
+		">=": 10,
+		"==": 10,
+		"!=": 10,
+		"+":  20,
+		"-":  20,
+		"*":  40,
+		"/":  40,
+		"%":  40,
 	}
 	return &Parser{
 		lex:          lex(name, input),
@@ -34,9 +50,10 @@ func (p *Parser) next() token {
 	if p.peekCount > 0 {
 		p.peekCount--
 	} else {
-		p.lookahead[0] = p.lex.nextToken()
+		p.lookahead[0] = p.fetch()
 	}
-	return p.lookahead[p.peekCount]
+	p.prev = p.lookahead[p.peekCount]
+	return p.prev
 }
 
 func (p *Parser) peek() token {
@@ -44,113 +61,412 @@ func (p *Parser) peek() token {
 		return p.lookahead[p.peekCount-1]
 	}
 	p.peekCount = 1
-	p.lookahead[0] = p.lex.nextToken()
+	p.lookahead[0] = p.fetch()
 	return p.lookahead[0]
 }
 
+// fetch reads a token from the lexer and records lexical errors.
+// The error token itself is passed on to the parser, which fails on it without
+// reporting the error again.
+func (p *Parser) fetch() token {
+	t := p.lex.nextToken()
+	p.comments = append(p.comments, t.comments...)
+	if t.kind == tokError {
+		p.errors = append(p.errors, &Error{
+			Filename: p.lex.name,
+			Span:     t.span,
+			Msg:      t.value,
+		})
+	}
+	return t
+}
+
+// spanFrom returns the span from start to the end of the last consumed token.
+func (p *Parser) spanFrom(start ast.Pos) ast.Span {
+	return ast.Span{Start: start, End: p.prev.span.End}
+}
+
+// errorf records an error at the position of the next token and stops parsing.
 func (p *Parser) errorf(format string, args ...interface{}) {
-	panic(fmt.Errorf(format, args...))
+	if p.peek().kind == tokError {
+		panic(bailout{})
+	}
+	p.errors = append(p.errors, &Error{
+		Filename: p.lex.name,
+		Span:     p.peek().span,
+		Msg:      fmt.Sprintf(format, args...),
+	})
+	panic(bailout{})
+}
+
+// errorAt records an error at the given span and stops parsing.
+func (p *Parser) errorAt(span ast.Span, format string, args ...interface{}) {
+	p.errors = append(p.errors, &Error{
+		Filename: p.lex.name,
+		Span:     span,
+		Msg:      fmt.Sprintf(format, args...),
+	})
+	panic(bailout{})
+}
+
+// errorExpected records an "expected X, found Y" error at the next token and stops parsing.
+func (p *Parser) errorExpected(expected string) {
+	if p.peek().kind == tokError {
+		panic(bailout{})
+	}
+	found := describe(p.peek())
+	p.errors = append(p.errors, &Error{
+		Filename: p.lex.name,
+		Span:     p.peek().span,
+		Msg:      fmt.Sprintf("expected %s, found %s", expected, found),
+		Expected: expected,
+		Found:    found,
+	})
+	panic(bailout{})
+}
+
+// expect consumes the next token if it has the given kind, and reports an error otherwise.
+func (p *Parser) expect(kind tokenType, expected string) token {
+	if p.peek().kind != kind {
+		p.errorExpected(expected)
+	}
+	return p.next()
+}
+
+// recover turns a bailout into the returned error of the top-level parsing functions,
+// which is the list of the errors recorded since the nerrors-th one.
+func (p *Parser) recover(nerrors int, errp *error) {
+	if e := recover(); e != nil {
+		if _, ok := e.(bailout); !ok {
+			panic(e)
+		}
+		*errp = p.errors[nerrors:].Err()
+	}
 }
 
-func (p *Parser) error(err error) {
-	panic(err)
+// synchronize skips tokens up to the beginning of the next toplevel item,
+// i.e. the next 'def' or 'extern', or just after the next ';'.
+func (p *Parser) synchronize() {
+	for {
+		switch p.peek().kind {
+		case tokDef, tokExtern, tokEOF:
+			return
+		case tokSemi:
+			p.next()
+			return
+		}
+		p.next()
+	}
+}
+
+// describe returns a description of the token for error messages.
+func describe(t token) string {
+	if t.kind == tokEOF {
+		return eofDescription
+	}
+	return strconv.Quote(t.value)
 }
 
-func (p *Parser) tokenPrecedence(token rune) int {
-	if prec, ok := p.binaryOpPrec[token]; ok {
+func (p *Parser) tokenPrecedence(t token) int {
+	if t.kind < tokUserUnaryOp {
+		return -1
+	}
+	if prec, ok := p.binaryOpPrec[t.value]; ok {
 		return prec
 	}
 	return -1
 }
 
 // Parse consumes and parses all of source code.
-func (p *Parser) Parse() *ast.File {
+// Parse does not stop at the first syntax error: it skips to the next toplevel item
+// and goes on, so the returned error is an ErrorList of all syntax errors in the file.
+// Broken expressions are replaced with ast.ErrorExpr in the returned file.
+func (p *Parser) Parse() (*ast.File, error) {
 	f := &ast.File{
 		Name: p.lex.name,
 	}
-	for p.peek().kind != tokEOF {
-		switch p.peek().kind {
-		case tokDef:
-			d := p.ParseDefinition()
-			f.Defs = append(f.Defs, d)
-		case tokExtern:
-			f.Externs = append(f.Externs, p.ParseExtern())
-		case tokSemi:
-			// ignore
-			p.next()
-		default:
-			f.Exprs = append(f.Exprs, p.ParseExpression())
+	for p.parseItem(f) {
+	}
+	f.Comments = p.comments
+	return f, p.errors.Err()
+}
+
+// parseItem parses a toplevel item into f, and reports whether there may be more items.
+func (p *Parser) parseItem(f *ast.File) (more bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(bailout); !ok {
+				panic(e)
+			}
+			p.synchronize()
+			more = true
 		}
+	}()
+
+	switch p.peek().kind {
+	case tokEOF:
+		return false
+	case tokDef:
+		f.Defs = append(f.Defs, p.parseDefinition())
+	case tokExtern:
+		f.Externs = append(f.Externs, p.parseExtern())
+	case tokSemi:
+		// ignore
+		p.next()
+	default:
+		f.Exprs = append(f.Exprs, p.parseExpressionRecover())
+	}
+	return true
+}
+
+// parseExpressionRecover is like parseExpression, but after a syntax error it skips
+// to the next toplevel item and returns an ast.ErrorExpr covering the skipped tokens.
+func (p *Parser) parseExpressionRecover() (expr ast.Expr) {
+	start := p.prev.span.End
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(bailout); !ok {
+				panic(e)
+			}
+			p.synchronize()
+			sp := p.spanFrom(start)
+			if sp.End.Offset < sp.Start.Offset {
+				// nothing has been skipped
+				sp.End = sp.Start
+			}
+			expr = &ast.ErrorExpr{Span: sp}
+		}
+	}()
+	start = p.peek().span.Start
+	return p.parseExpression()
+}
+
+// ItemKind is a kind of toplevel items.
+type ItemKind int
+
+// Kinds of toplevel items returned by Parser.NextItem.
+const (
+	ItemEOF ItemKind = iota
+	ItemDefinition
+	ItemExtern
+	ItemExpression
+)
+
+// NextItem skips ';' separators, and returns the kind of the next toplevel item without consuming it.
+// It tells which of ParseDefinition, ParseExtern and ParseExpression should be called next.
+func (p *Parser) NextItem() ItemKind {
+	for p.peek().kind == tokSemi {
+		p.next()
+	}
+	switch p.peek().kind {
+	case tokEOF:
+		return ItemEOF
+	case tokDef:
+		return ItemDefinition
+	case tokExtern:
+		return ItemExtern
+	default:
+		return ItemExpression
 	}
-	return f
 }
 
 // ParseDefinition consumes a function definition.
-func (p *Parser) ParseDefinition() *ast.Function {
-	p.next()
-	proto := p.parsePrototype()
-	body := p.ParseExpression()
-	return &ast.Function{Prototype: proto, Body: body}
+// A broken function body is replaced with ast.ErrorExpr, and reported in the returned error.
+// Like ParseExtern and ParseExpression, it reports only the errors found by the call.
+func (p *Parser) ParseDefinition() (f *ast.Function, err error) {
+	nerrors := len(p.errors)
+	defer p.recover(nerrors, &err)
+	f = p.parseDefinition()
+	return f, p.errors[nerrors:].Err()
 }
 
 // ParseExtern consumes a external function declaration.
-func (p *Parser) ParseExtern() *ast.Prototype {
-	p.next()
+func (p *Parser) ParseExtern() (proto *ast.Prototype, err error) {
+	defer p.recover(len(p.errors), &err)
+	return p.parseExtern(), nil
+}
+
+// ParseExpression recognizes an expression and consumes it.
+func (p *Parser) ParseExpression() (expr ast.Expr, err error) {
+	defer p.recover(len(p.errors), &err)
+	return p.parseExpression(), nil
+}
+
+func (p *Parser) parseDefinition() *ast.Function {
+	start := p.expect(tokDef, "'def'").span.Start
+	proto := p.parsePrototype()
+	body := p.parseExpressionRecover()
+	return &ast.Function{Span: p.spanFrom(start), Prototype: proto, Body: body}
+}
+
+func (p *Parser) parseExtern() *ast.Prototype {
+	p.expect(tokExtern, "'extern'")
 	return p.parsePrototype()
 }
 
 func (p *Parser) parsePrototype() *ast.Prototype {
-	name := p.peek().value
-	p.next()
-	if p.peek().kind != tokLparen {
-		p.errorf("unexpected token: %q", p.peek().value)
+	start := p.peek().span.Start
+	proto := &ast.Prototype{Kind: ast.ProtoFunction}
+	switch p.peek().kind {
+	case tokUnary, tokBinary:
+		p.parseOperatorName(proto)
+	default:
+		proto.Name = p.expect(tokIdentifier, "function name").value
 	}
-	p.next()
+	p.expect(tokLparen, "'('")
 
+	// arguments are separated by ',', and may be annotated with their types as 'x: i64'.
+	// The operands of an operator may be separated just by white spaces, as in 'binary| (a b)'.
 	args := []string{}
-	if p.peek().kind != tokRparen {
-		for {
-			if p.peek().kind != tokIdentifier {
-				p.errorf("unexpected token: %q", p.peek().value)
-			}
-			args = append(args, p.peek().value)
-			p.next()
-
-			if p.peek().kind == tokRparen {
-				break
-			}
-			if p.peek().kind != tokComma {
-				p.errorf("expected ','")
+	var types []ast.Type
+	for p.peek().kind != tokRparen {
+		if len(args) > 0 && (proto.Kind == ast.ProtoFunction || p.peek().kind == tokComma) {
+			p.expect(tokComma, "',' or ')'")
+		}
+		args = append(args, p.expect(tokIdentifier, "argument name").value)
+		if t := p.parseTypeAnnotation(); t != ast.NoType {
+			for len(types) < len(args)-1 {
+				types = append(types, ast.NoType)
 			}
-			p.next()
+			types = append(types, t)
 		}
 	}
 	p.next()
-	return &ast.Prototype{Name: name, Args: args}
+	proto.ResultType = p.parseTypeAnnotation()
+	proto.Span = p.spanFrom(start)
+	proto.Args = args
+	proto.ArgTypes = types
+
+	switch {
+	case proto.Kind == ast.ProtoUnary && len(args) != 1:
+		p.errorAt(proto.Span, "unary operator %q must take 1 operand, but %d given", proto.Name, len(args))
+	case proto.Kind == ast.ProtoBinary && len(args) != 2:
+		p.errorAt(proto.Span, "binary operator %q must take 2 operands, but %d given", proto.Name, len(args))
+	}
+	return proto
 }
 
-// ParseExpression recognizes an expression and consumes it.
-func (p *Parser) ParseExpression() ast.Expr {
-	lhs := p.parsePrimary()
+// parseTypeAnnotation parses ': type' if any, and returns the type.
+// It returns ast.NoType if there is no annotation.
+func (p *Parser) parseTypeAnnotation() ast.Type {
+	if p.peek().kind != tokColon {
+		return ast.NoType
+	}
+	p.next()
+	name := p.expect(tokIdentifier, "type name")
+	t, ok := ast.LookupType(name.value)
+	if !ok {
+		p.errorAt(name.span, "unknown type %q", name.value)
+	}
+	return t
+}
+
+// parseOperatorName parses the name and the precedence of a user-defined operator, e.g. "binary| 5",
+// and registers the operator.
+func (p *Parser) parseOperatorName(proto *ast.Prototype) {
+	kw := p.next()
+	optok := p.peek()
+	if optok.kind != tokOther {
+		p.errorExpected("operator character")
+	}
+	op, _ := utf8.DecodeRuneInString(optok.value)
+	if _, ok := builtinOps[optok.value]; ok || optok.value == ":" {
+		p.errorf("cannot redefine built-in operator %q", op)
+	}
+	p.next()
+	proto.Name = kw.value + optok.value
+
+	if kw.kind == tokUnary {
+		proto.Kind = ast.ProtoUnary
+		p.Declare(proto)
+		return
+	}
+
+	proto.Kind = ast.ProtoBinary
+	proto.Precedence = ast.DefaultPrecedence
+	if p.peek().kind == tokNumber {
+		prec, err := strconv.Atoi(p.peek().value)
+		if err != nil || prec < 1 || prec > 100 {
+			p.errorf("invalid precedence %s: must be an integer between 1 and 100", p.peek().value)
+		}
+		p.next()
+		proto.Precedence = prec
+	}
+	p.Declare(proto)
+}
+
+// Declare makes the parser recognize the operator defined by proto in the following input.
+// It is used to carry user-defined operators over to a new parser, e.g. for each input line of a REPL.
+// Prototypes of ordinary functions are ignored.
+func (p *Parser) Declare(proto *ast.Prototype) {
+	op := proto.OperatorName()
+	r, _ := utf8.DecodeRuneInString(op)
+	switch proto.Kind {
+	case ast.ProtoUnary:
+		p.lex.userOperators[r] |= uopUnaryOp
+	case ast.ProtoBinary:
+		p.lex.userOperators[r] |= uopBinaryOp
+		p.binaryOpPrec[op] = proto.Precedence
+	}
+}
+
+func (p *Parser) parseExpression() ast.Expr {
+	lhs := p.parseUnary()
 	return p.parseBinOpRHS(0, lhs)
 }
 
 func (p *Parser) parseBinOpRHS(prec int, lhs ast.Expr) ast.Expr {
 	for {
-		op, _ := utf8.DecodeRuneInString(p.peek().value)
-		cprec := p.tokenPrecedence(op)
+		op := p.peek().value
+		cprec := p.tokenPrecedence(p.peek())
 		if cprec < prec {
 			return lhs
 		}
+		if op == "=" {
+			if _, ok := lhs.(*ast.VariableExpr); !ok {
+				p.errorAt(lhs.Loc(), "destination of '=' must be a variable")
+			}
+		}
 		// skip op
 		p.next()
-		rhs := p.parsePrimary()
-		op2, _ := utf8.DecodeRuneInString(p.peek().value)
-		nprec := p.tokenPrecedence(op2)
-		if prec < nprec {
-			rhs = p.parseBinOpRHS(prec+1, rhs)
+		rhs := p.parseUnary()
+		// operators are left-associative, except '=': 'a = b = 1' assigns 1 to b and then to a.
+		rprec := cprec + 1
+		if op == "=" {
+			rprec = cprec
+		}
+		if rprec <= p.tokenPrecedence(p.peek()) {
+			rhs = p.parseBinOpRHS(rprec, rhs)
+		}
+		lhs = &ast.BinaryExpr{
+			Span: ast.Span{Start: lhs.Pos(), End: rhs.Loc().End},
+			Op:   op,
+			LHS:  lhs,
+			RHS:  rhs,
 		}
-		lhs = &ast.BinaryExpr{Op: op, LHS: lhs, RHS: rhs}
+	}
+}
+
+// parseUnary parses an application of unary operators, or a primary expression.
+func (p *Parser) parseUnary() ast.Expr {
+	t := p.peek()
+	switch t.kind {
+	case tokMinus, tokBang:
+		// built-in unary operators
+	case tokUserUnaryOp, tokUserBinaryOp:
+		op, _ := utf8.DecodeRuneInString(t.value)
+		if p.lex.userOperators[op]&uopUnaryOp == 0 {
+			return p.parsePrimary()
+		}
+	default:
+		return p.parsePrimary()
+	}
+	p.next()
+	operand := p.parseUnary()
+	return &ast.UnaryExpr{
+		Span:    ast.Span{Start: t.span.Start, End: operand.Loc().End},
+		Op:      t.value,
+		Operand: operand,
 	}
 }
 
@@ -160,84 +476,84 @@ func (p *Parser) parsePrimary() ast.Expr {
 		return p.parseIdentifier()
 	case tokNumber:
 		return p.parseNumber()
+	case tokString:
+		return p.parseString()
 	case tokLparen:
 		return p.parseParenExpr()
 	case tokIf:
 		return p.parseIfExpr()
 	case tokFor:
 		return p.parseForExpr()
+	case tokVar:
+		return p.parseVarExpr()
 	}
-	p.errorf("unexpected token: %q", p.peek().value)
+	p.errorExpected("expression")
 	return nil
 }
 
 func (p *Parser) parseNumber() ast.Expr {
 	val, err := strconv.ParseFloat(p.peek().value, 64)
 	if err != nil {
-		p.error(err)
+		p.errorf("invalid number literal: %q", p.peek().value)
 	}
 	p.next()
-	return &ast.NumberExpr{Val: val}
+	return &ast.NumberExpr{Span: p.prev.span, Val: val}
+}
+
+func (p *Parser) parseString() ast.Expr {
+	p.next()
+	return &ast.StringExpr{Span: p.prev.span, Val: unquote(p.prev.value)}
 }
 
 func (p *Parser) parseIdentifier() ast.Expr {
+	start := p.peek().span.Start
 	name := p.peek().value
 	p.next()
 	if p.peek().kind != tokLparen {
-		return &ast.VariableExpr{Name: name}
+		return &ast.VariableExpr{Span: p.prev.span, Name: name}
 	}
 	// skip '('
 	p.next()
 	args := []ast.Expr{}
 	if p.peek().kind != tokRparen {
 		for {
-			args = append(args, p.ParseExpression())
+			args = append(args, p.parseExpression())
 			if p.peek().kind == tokRparen {
 				break
 			}
-			if p.peek().kind != tokComma {
-				p.error(fmt.Errorf("expected ','"))
-			}
 			// skip ','
-			p.next()
+			p.expect(tokComma, "',' or ')'")
 		}
 	}
 	// skip ')'
 	p.next()
-	return &ast.CallExpr{Callee: name, Args: args}
+	return &ast.CallExpr{Span: p.spanFrom(start), Callee: name, Args: args}
 }
 
 func (p *Parser) parseParenExpr() ast.Expr {
 	// skip '('
 	p.next()
-	expr := p.ParseExpression()
-	if p.peek().kind != tokRparen {
-		p.error(fmt.Errorf("expected ')'"))
-	}
-	p.next()
+	expr := p.parseExpression()
+	p.expect(tokRparen, "')'")
 	return expr
 }
 
 func (p *Parser) parseIfExpr() ast.Expr {
 	// skip 'if'
-	p.next()
-	cond := p.ParseExpression()
+	start := p.next().span.Start
+	cond := p.parseExpression()
 
-	if p.peek().kind != tokThen {
-		p.error(fmt.Errorf("expected then"))
-	}
 	// eat 'then'
-	p.next()
+	p.expect(tokThen, "'then'")
+
+	then := p.parseExpression()
 
-	then := p.ParseExpression()
-	if p.peek().kind != tokElse {
-		p.error(fmt.Errorf("expected else"))
-	}
 	// eat 'else'
-	p.next()
+	p.expect(tokElse, "'else'")
 
-	else_ := p.ParseExpression()
+	else_ := p.parseExpression()
 	return &ast.IfExpr{
+		Span: p.spanFrom(start),
 		Cond: cond,
 		Then: then,
 		Else: else_,
@@ -246,40 +562,28 @@ func (p *Parser) parseIfExpr() ast.Expr {
 
 func (p *Parser) parseForExpr() ast.Expr {
 	// skip 'for'
-	p.next()
-	if p.peek().kind != tokIdentifier {
-		p.errorf("expected identifier after for")
-	}
+	pos := p.next().span.Start
 
-	name := p.peek().value
-	p.next()
-	if p.peek().kind != tokEqual {
-		p.errorf("expected '=' after for")
-	}
-	p.next()
+	name := p.expect(tokIdentifier, "identifier after 'for'").value
+	p.expect(tokEqual, "'=' after for variable")
 
-	start := p.ParseExpression()
-	if p.peek().kind != tokComma {
-		p.errorf("expected ',' after for start value")
-	}
-	p.next()
+	start := p.parseExpression()
+	p.expect(tokComma, "',' after for start value")
 
-	end := p.ParseExpression()
+	end := p.parseExpression()
 
 	var step ast.Expr
 	if p.peek().kind == tokComma {
 		p.next()
-		step = p.ParseExpression()
+		step = p.parseExpression()
 	}
 
-	if p.peek().kind != tokIn {
-		p.errorf("expected 'in' after for")
-	}
-	p.next()
+	p.expect(tokIn, "'in' after for")
 
-	body := p.ParseExpression()
+	body := p.parseExpression()
 
 	return &ast.ForExpr{
+		Span:  p.spanFrom(pos),
 		Var:   name,
 		Start: start,
 		End:   end,
@@ -287,3 +591,35 @@ func (p *Parser) parseForExpr() ast.Expr {
 		Body:  body,
 	}
 }
+
+func (p *Parser) parseVarExpr() ast.Expr {
+	// skip 'var'
+	start := p.next().span.Start
+
+	vars := []*ast.VarBinding{}
+	for {
+		name := p.expect(tokIdentifier, "variable name")
+		v := &ast.VarBinding{Name: name.value, Type: p.parseTypeAnnotation()}
+		if p.peek().kind == tokEqual {
+			p.next()
+			v.Init = p.parseExpression()
+		}
+		v.Span = p.spanFrom(name.span.Start)
+		vars = append(vars, v)
+
+		if p.peek().kind != tokComma {
+			break
+		}
+		p.next()
+	}
+
+	p.expect(tokIn, "'in' after var")
+
+	body := p.parseExpression()
+
+	return &ast.VarExpr{
+		Span: p.spanFrom(start),
+		Vars: vars,
+		Body: body,
+	}
+}
@@ -7,14 +7,47 @@ import (
 	"github.com/agatan/kaleigo/ast"
 )
 
+var spanType = reflect.TypeOf(ast.Span{})
+
+// clearSpans zeroes all source spans in the given ast node, so that trees can
+// be compared structurally.
+func clearSpans(node interface{}) {
+	clearSpansValue(reflect.ValueOf(node))
+}
+
+func clearSpansValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			clearSpansValue(v.Elem())
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			clearSpansValue(v.Index(i))
+		}
+	case reflect.Struct:
+		if v.Type() == spanType {
+			v.Set(reflect.Zero(spanType))
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			clearSpansValue(v.Field(i))
+		}
+	}
+}
+
 func TestParseExpression(t *testing.T) {
 	p := New("test", "1 + 2 * 3")
-	expr := p.ParseExpression()
+	expr, err := p.ParseExpression()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearSpans(expr)
 	var expected ast.Expr = &ast.BinaryExpr{
-		Op:  '+',
+		Op:  "+",
 		LHS: &ast.NumberExpr{Val: 1.0},
 		RHS: &ast.BinaryExpr{
-			Op:  '*',
+			Op:  "*",
 			LHS: &ast.NumberExpr{Val: 2.0},
 			RHS: &ast.NumberExpr{Val: 3.0},
 		},
@@ -26,7 +59,11 @@ func TestParseExpression(t *testing.T) {
 
 func TestParseExtern(t *testing.T) {
 	p := New("test", "extern pow(x, y)")
-	actual := p.ParseExtern()
+	actual, err := p.ParseExtern()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearSpans(actual)
 	expected := &ast.Prototype{
 		Name: "pow",
 		Args: []string{"x", "y"},
@@ -39,14 +76,18 @@ func TestParseExtern(t *testing.T) {
 
 func TestParseDefinition(t *testing.T) {
 	p := New("test", "def add(x, y) x + y")
-	actual := p.ParseDefinition()
+	actual, err := p.ParseDefinition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearSpans(actual)
 	expected := &ast.Function{
 		Prototype: &ast.Prototype{
 			Name: "add",
 			Args: []string{"x", "y"},
 		},
 		Body: &ast.BinaryExpr{
-			Op:  '+',
+			Op:  "+",
 			LHS: &ast.VariableExpr{Name: "x"},
 			RHS: &ast.VariableExpr{Name: "y"},
 		},
@@ -59,7 +100,11 @@ func TestParseDefinition(t *testing.T) {
 
 func TestParseCall(t *testing.T) {
 	p := New("test", "f()\n")
-	actual := p.ParseExpression()
+	actual, err := p.ParseExpression()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearSpans(actual)
 	expected := &ast.CallExpr{
 		Callee: "f",
 		Args:   []ast.Expr{},
@@ -70,12 +115,40 @@ func TestParseCall(t *testing.T) {
 	}
 }
 
+func TestParseString(t *testing.T) {
+	p := New("test", `putstr("hello,\n" + "world")`)
+	actual, err := p.ParseExpression()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lit := actual.(*ast.CallExpr).Args[0].(*ast.BinaryExpr).LHS
+	if expected := (ast.Span{Start: ast.Pos{Offset: 7, Line: 1, Column: 8}, End: ast.Pos{Offset: 17, Line: 1, Column: 18}}); lit.Loc() != expected {
+		t.Errorf("wrong span of string literal: expected %v, actual %v", expected, lit.Loc())
+	}
+	clearSpans(actual)
+	expected := &ast.CallExpr{
+		Callee: "putstr",
+		Args: []ast.Expr{&ast.BinaryExpr{
+			Op:  "+",
+			LHS: &ast.StringExpr{Val: "hello,\n"},
+			RHS: &ast.StringExpr{Val: "world"},
+		}},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("string literal parsing is wrong: expected %#v, actual %#v", expected, actual)
+	}
+}
+
 func TestParseIf(t *testing.T) {
 	p := New("test", "if 2 < 3 then 1 else 2")
-	actual := p.ParseExpression()
+	actual, err := p.ParseExpression()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearSpans(actual)
 	expected := &ast.IfExpr{
 		Cond: &ast.BinaryExpr{
-			Op:  '<',
+			Op:  "<",
 			LHS: &ast.NumberExpr{Val: 2},
 			RHS: &ast.NumberExpr{Val: 3},
 		},
@@ -90,12 +163,16 @@ func TestParseIf(t *testing.T) {
 
 func TestParseFor(t *testing.T) {
 	p := New("test", "for i = 1, i < n, 1.0 in i")
-	actual := p.ParseExpression()
+	actual, err := p.ParseExpression()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearSpans(actual)
 	expected := &ast.ForExpr{
 		Var:   "i",
 		Start: &ast.NumberExpr{Val: 1.0},
 		End: &ast.BinaryExpr{
-			Op:  '<',
+			Op:  "<",
 			LHS: &ast.VariableExpr{Name: "i"},
 			RHS: &ast.VariableExpr{Name: "n"},
 		},
@@ -107,3 +184,508 @@ func TestParseFor(t *testing.T) {
 		t.Errorf("for expression parsing is wrong")
 	}
 }
+
+func TestParsePosition(t *testing.T) {
+	p := New("test", "def f(x)\n  g(x, 1) + 2")
+	def, err := p.ParseDefinition()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pos := func(offset, line, column int) ast.Pos {
+		return ast.Pos{Offset: offset, Line: line, Column: column}
+	}
+	if expected := (ast.Span{Start: pos(0, 1, 1), End: pos(22, 2, 14)}); def.Span != expected {
+		t.Errorf("wrong definition span: expected %v, actual %v", expected, def.Span)
+	}
+	if expected := (ast.Span{Start: pos(4, 1, 5), End: pos(8, 1, 9)}); def.Prototype.Span != expected {
+		t.Errorf("wrong prototype span: expected %v, actual %v", expected, def.Prototype.Span)
+	}
+	bin := def.Body.(*ast.BinaryExpr)
+	if expected := (ast.Span{Start: pos(11, 2, 3), End: pos(18, 2, 10)}); bin.LHS.Loc() != expected {
+		t.Errorf("wrong call span: expected %v, actual %v", expected, bin.LHS.Loc())
+	}
+	if expected := (ast.Span{Start: pos(11, 2, 3), End: pos(22, 2, 14)}); bin.Span != expected {
+		t.Errorf("wrong binary expression span: expected %v, actual %v", expected, bin.Span)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	p := New("test.kl", "def f(x y) x")
+	_, err := p.Parse()
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("expected one syntax error, actual %#v", err)
+	}
+	e := errs[0]
+	if e.Expected != "',' or ')'" || e.Found != `"y"` {
+		t.Errorf("wrong expected/found tokens: %q, %q", e.Expected, e.Found)
+	}
+	if expected := `test.kl:1:9: expected ',' or ')', found "y"`; e.Error() != expected {
+		t.Errorf("wrong error message: expected %q, actual %q", expected, e.Error())
+	}
+}
+
+func TestParseItemErrors(t *testing.T) {
+	p := New("test.kl", "def f(x) x +; extern g(; def h(x) x; 1 +; extern k(x); def m(x) x")
+	expectedErrs := []bool{true, true, false, true, false, false}
+	for i, expectedErr := range expectedErrs {
+		var err error
+		switch p.NextItem() {
+		case ItemDefinition:
+			_, err = p.ParseDefinition()
+		case ItemExtern:
+			_, err = p.ParseExtern()
+		case ItemExpression:
+			_, err = p.ParseExpression()
+		default:
+			t.Fatalf("item %d: unexpected end of file", i)
+		}
+		if expectedErr {
+			if errs, ok := err.(ErrorList); !ok || len(errs) != 1 {
+				t.Errorf("item %d: expected one syntax error, actual %#v", i, err)
+			}
+			p.synchronize()
+		} else if err != nil {
+			t.Errorf("item %d: unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestParseErrorAtEOF(t *testing.T) {
+	cases := []struct {
+		src   string
+		atEOF bool
+	}{
+		{"def f(x", true},
+		{"1 +", true},
+		{"def f(x y) x", false},
+		{"f(1) + 2$", false},
+	}
+	for _, c := range cases {
+		_, err := New("test.kl", c.src).Parse()
+		errs, ok := err.(ErrorList)
+		if !ok || len(errs) == 0 {
+			t.Errorf("%q: expected syntax errors, actual %#v", c.src, err)
+			continue
+		}
+		if atEOF := errs[0].AtEOF(); atEOF != c.atEOF {
+			t.Errorf("%q: expected AtEOF()=%v, actual %v", c.src, c.atEOF, atEOF)
+		}
+	}
+}
+
+func TestParseLexError(t *testing.T) {
+	p := New("test.kl", "f(1) + 2$")
+	_, err := p.Parse()
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("expected one syntax error, actual %#v", err)
+	}
+	if expected := "test.kl:1:9: unrecognized character: U+0024 '$'"; errs[0].Error() != expected {
+		t.Errorf("wrong error message: expected %q, actual %q", expected, errs[0].Error())
+	}
+}
+
+func TestParseRecovery(t *testing.T) {
+	src := `extern putd(x);
+def f(x) x + ;
+def (x) x
+def g(x) x * 2
+putd(f(1), 2 3);
+$;
+g(3)
+`
+	p := New("test.kl", src)
+	f, err := p.Parse()
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("syntax errors are not reported: %#v", err)
+	}
+	expected := []string{
+		`test.kl:2:14: expected expression, found ";"`,
+		`test.kl:3:5: expected function name, found "("`,
+		`test.kl:5:14: expected ',' or ')', found "3"`,
+		`test.kl:6:1: unrecognized character: U+0024 '$'`,
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, actual %d: %v", len(expected), len(errs), errs)
+	}
+	for i, e := range expected {
+		if errs[i].Error() != e {
+			t.Errorf("wrong error message: expected %q, actual %q", e, errs[i].Error())
+		}
+	}
+
+	if len(f.Externs) != 1 {
+		t.Errorf("extern is lost: %#v", f.Externs)
+	}
+	if len(f.Defs) != 2 || f.Defs[0].Name != "f" || f.Defs[1].Name != "g" {
+		t.Fatalf("definitions are lost: %#v", f.Defs)
+	}
+	if f.Defs[0].Body.ExprKind() != ast.ExprError {
+		t.Errorf("broken function body is not replaced with ast.ErrorExpr: %#v", f.Defs[0].Body)
+	}
+	if f.Defs[1].Body.ExprKind() != ast.ExprBinary {
+		t.Errorf("function after a syntax error is not parsed: %#v", f.Defs[1].Body)
+	}
+	if len(f.Exprs) != 3 {
+		t.Fatalf("expected 3 toplevel expressions, actual %d", len(f.Exprs))
+	}
+	for i, kind := range []ast.ExprType{ast.ExprError, ast.ExprError, ast.ExprCall} {
+		if f.Exprs[i].ExprKind() != kind {
+			t.Errorf("wrong kind of toplevel expression %d: %#v", i, f.Exprs[i])
+		}
+	}
+}
+
+func TestParseComments(t *testing.T) {
+	p := New("test", "# adds x and y\ndef add(x, y) x + y # trailing\n")
+	f, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Comments) != 2 || f.Comments[0].Text != "# adds x and y" || f.Comments[1].Text != "# trailing" {
+		t.Errorf("comments are not collected: %#v", f.Comments)
+	}
+	if len(f.Defs) != 1 {
+		t.Errorf("definition with comments is not parsed: %#v", f.Defs)
+	}
+}
+
+func TestParseUserDefinedOperator(t *testing.T) {
+	p := New("test", "def binary| 5 (a b) a + b\ndef unary~(v) 0 - v\n~1 + 2 | 3 * 4")
+	f, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearSpans(f)
+
+	if len(f.Defs) != 2 {
+		t.Fatalf("expected 2 operator definitions, actual %d", len(f.Defs))
+	}
+	binary := &ast.Prototype{Name: "binary|", Args: []string{"a", "b"}, Kind: ast.ProtoBinary, Precedence: 5}
+	if !reflect.DeepEqual(binary, f.Defs[0].Prototype) {
+		t.Errorf("binary operator prototype parsing is wrong: %#v", f.Defs[0].Prototype)
+	}
+	unary := &ast.Prototype{Name: "unary~", Args: []string{"v"}, Kind: ast.ProtoUnary}
+	if !reflect.DeepEqual(unary, f.Defs[1].Prototype) {
+		t.Errorf("unary operator prototype parsing is wrong: %#v", f.Defs[1].Prototype)
+	}
+
+	var expected ast.Expr = &ast.BinaryExpr{
+		Op: "|",
+		LHS: &ast.BinaryExpr{
+			Op:  "+",
+			LHS: &ast.UnaryExpr{Op: "~", Operand: &ast.NumberExpr{Val: 1}},
+			RHS: &ast.NumberExpr{Val: 2},
+		},
+		RHS: &ast.BinaryExpr{
+			Op:  "*",
+			LHS: &ast.NumberExpr{Val: 3},
+			RHS: &ast.NumberExpr{Val: 4},
+		},
+	}
+	if len(f.Exprs) != 1 || !reflect.DeepEqual(expected, f.Exprs[0]) {
+		t.Errorf("user-defined operator application parsing is wrong: %#v", f.Exprs)
+	}
+}
+
+func TestParseSpacedOperatorDefinition(t *testing.T) {
+	p := New("test", "def binary | 5 (x y) y\ndef unary ~ (v) 0 - v\n1 | ~2")
+	f, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearSpans(f)
+
+	if len(f.Defs) != 2 {
+		t.Fatalf("expected 2 operator definitions, actual %d", len(f.Defs))
+	}
+	binary := &ast.Prototype{Name: "binary|", Args: []string{"x", "y"}, Kind: ast.ProtoBinary, Precedence: 5}
+	if !reflect.DeepEqual(binary, f.Defs[0].Prototype) {
+		t.Errorf("binary operator prototype parsing is wrong: %#v", f.Defs[0].Prototype)
+	}
+	unary := &ast.Prototype{Name: "unary~", Args: []string{"v"}, Kind: ast.ProtoUnary}
+	if !reflect.DeepEqual(unary, f.Defs[1].Prototype) {
+		t.Errorf("unary operator prototype parsing is wrong: %#v", f.Defs[1].Prototype)
+	}
+
+	var expected ast.Expr = &ast.BinaryExpr{
+		Op:  "|",
+		LHS: &ast.NumberExpr{Val: 1},
+		RHS: &ast.UnaryExpr{Op: "~", Operand: &ast.NumberExpr{Val: 2}},
+	}
+	if len(f.Exprs) != 1 || !reflect.DeepEqual(expected, f.Exprs[0]) {
+		t.Errorf("user-defined operator application parsing is wrong: %#v", f.Exprs)
+	}
+}
+
+func TestParseOperatorDefinitionError(t *testing.T) {
+	cases := []struct {
+		src string
+		msg string
+	}{
+		{"def binary+ (a b) a", `test:1:11: cannot redefine built-in operator '+'`},
+		{"def binary| 500 (a b) a", `test:1:13: invalid precedence 500: must be an integer between 1 and 100`},
+		{"def unary~ (a b) a", `test:1:5: unary operator "unary~" must take 1 operand, but 2 given`},
+		{"def unary! (a) a", `test:1:10: cannot redefine built-in operator '!'`},
+		{"def binary (a b) a", `test:1:12: expected operator character, found "("`},
+		{"def binary: (a b) a", `test:1:11: cannot redefine built-in operator ':'`},
+	}
+	for _, c := range cases {
+		_, err := New("test", c.src).Parse()
+		if err == nil || err.Error() != c.msg {
+			t.Errorf("wrong error for %q: expected %q, actual %v", c.src, c.msg, err)
+		}
+	}
+}
+
+func TestParseLeftAssociative(t *testing.T) {
+	p := New("test", "1 - 2 - 3")
+	expr, err := p.ParseExpression()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearSpans(expr)
+	var expected ast.Expr = &ast.BinaryExpr{
+		Op: "-",
+		LHS: &ast.BinaryExpr{
+			Op:  "-",
+			LHS: &ast.NumberExpr{Val: 1.0},
+			RHS: &ast.NumberExpr{Val: 2.0},
+		},
+		RHS: &ast.NumberExpr{Val: 3.0},
+	}
+	if !reflect.DeepEqual(expr, expected) {
+		t.Errorf("binary operators are not left associative: expected %#v, actual %#v", expected, expr)
+	}
+}
+
+func TestParseMultiplicative(t *testing.T) {
+	p := New("test", "a - b * c / d")
+	expr, err := p.ParseExpression()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearSpans(expr)
+	var expected ast.Expr = &ast.BinaryExpr{
+		Op:  "-",
+		LHS: &ast.VariableExpr{Name: "a"},
+		RHS: &ast.BinaryExpr{
+			Op: "/",
+			LHS: &ast.BinaryExpr{
+				Op:  "*",
+				LHS: &ast.VariableExpr{Name: "b"},
+				RHS: &ast.VariableExpr{Name: "c"},
+			},
+			RHS: &ast.VariableExpr{Name: "d"},
+		},
+	}
+	if !reflect.DeepEqual(expr, expected) {
+		t.Errorf("multiplicative operator parsing is wrong: expected %#v, actual %#v", expected, expr)
+	}
+}
+
+func TestParseComparison(t *testing.T) {
+	p := New("test", "a / 2 + 1 >= b % 3 == 1")
+	expr, err := p.ParseExpression()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearSpans(expr)
+	var expected ast.Expr = &ast.BinaryExpr{
+		Op: "==",
+		LHS: &ast.BinaryExpr{
+			Op: ">=",
+			LHS: &ast.BinaryExpr{
+				Op: "+",
+				LHS: &ast.BinaryExpr{
+					Op:  "/",
+					LHS: &ast.VariableExpr{Name: "a"},
+					RHS: &ast.NumberExpr{Val: 2},
+				},
+				RHS: &ast.NumberExpr{Val: 1},
+			},
+			RHS: &ast.BinaryExpr{
+				Op:  "%",
+				LHS: &ast.VariableExpr{Name: "b"},
+				RHS: &ast.NumberExpr{Val: 3},
+			},
+		},
+		RHS: &ast.NumberExpr{Val: 1},
+	}
+	if !reflect.DeepEqual(expr, expected) {
+		t.Errorf("comparison operator parsing is wrong: expected %#v, actual %#v", expected, expr)
+	}
+}
+
+func TestParseLogical(t *testing.T) {
+	p := New("test", "x < 3 && !done(x) || -x")
+	expr, err := p.ParseExpression()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearSpans(expr)
+	var expected ast.Expr = &ast.BinaryExpr{
+		Op: "||",
+		LHS: &ast.BinaryExpr{
+			Op: "&&",
+			LHS: &ast.BinaryExpr{
+				Op:  "<",
+				LHS: &ast.VariableExpr{Name: "x"},
+				RHS: &ast.NumberExpr{Val: 3},
+			},
+			RHS: &ast.UnaryExpr{
+				Op: "!",
+				Operand: &ast.CallExpr{
+					Callee: "done",
+					Args:   []ast.Expr{&ast.VariableExpr{Name: "x"}},
+				},
+			},
+		},
+		RHS: &ast.UnaryExpr{Op: "-", Operand: &ast.VariableExpr{Name: "x"}},
+	}
+	if !reflect.DeepEqual(expr, expected) {
+		t.Errorf("logical operator parsing is wrong: expected %#v, actual %#v", expected, expr)
+	}
+}
+
+func TestParseVar(t *testing.T) {
+	p := New("test", "var a = 1, b in b = a + 1")
+	expr, err := p.ParseExpression()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearSpans(expr)
+	var expected ast.Expr = &ast.VarExpr{
+		Vars: []*ast.VarBinding{
+			{Name: "a", Init: &ast.NumberExpr{Val: 1}},
+			{Name: "b"},
+		},
+		Body: &ast.BinaryExpr{
+			Op:  "=",
+			LHS: &ast.VariableExpr{Name: "b"},
+			RHS: &ast.BinaryExpr{
+				Op:  "+",
+				LHS: &ast.VariableExpr{Name: "a"},
+				RHS: &ast.NumberExpr{Val: 1},
+			},
+		},
+	}
+	if !reflect.DeepEqual(expr, expected) {
+		t.Errorf("var expression parsing is wrong: expected %#v, actual %#v", expected, expr)
+	}
+}
+
+func TestParseTypeAnnotation(t *testing.T) {
+	p := New("test", "def f(x, n: i64, b: bool): i64 var k: i64 = n, y = x in k")
+	actual, err := p.ParseDefinition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearSpans(actual)
+	expected := &ast.Function{
+		Prototype: &ast.Prototype{
+			Name:       "f",
+			Args:       []string{"x", "n", "b"},
+			ArgTypes:   []ast.Type{ast.NoType, ast.TypeI64, ast.TypeBool},
+			ResultType: ast.TypeI64,
+		},
+		Body: &ast.VarExpr{
+			Vars: []*ast.VarBinding{
+				{Name: "k", Type: ast.TypeI64, Init: &ast.VariableExpr{Name: "n"}},
+				{Name: "y", Init: &ast.VariableExpr{Name: "x"}},
+			},
+			Body: &ast.VariableExpr{Name: "k"},
+		},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("type annotation parsing is wrong: expected %#v, actual %#v", expected, actual)
+	}
+}
+
+func TestParseTypeAnnotationError(t *testing.T) {
+	_, err := New("test", "extern f(x: int)").Parse()
+	if expected := `test:1:13: unknown type "int"`; err == nil || err.Error() != expected {
+		t.Errorf("wrong error for an unknown type: expected %q, actual %v", expected, err)
+	}
+}
+
+func TestParseAssign(t *testing.T) {
+	p := New("test", "a = b = c + 1")
+	expr, err := p.ParseExpression()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearSpans(expr)
+	var expected ast.Expr = &ast.BinaryExpr{
+		Op:  "=",
+		LHS: &ast.VariableExpr{Name: "a"},
+		RHS: &ast.BinaryExpr{
+			Op:  "=",
+			LHS: &ast.VariableExpr{Name: "b"},
+			RHS: &ast.BinaryExpr{
+				Op:  "+",
+				LHS: &ast.VariableExpr{Name: "c"},
+				RHS: &ast.NumberExpr{Val: 1},
+			},
+		},
+	}
+	if !reflect.DeepEqual(expr, expected) {
+		t.Errorf("assignment parsing is wrong: expected %#v, actual %#v", expected, expr)
+	}
+}
+
+func TestParseAssignError(t *testing.T) {
+	_, err := New("test", "a + 1 = 2").Parse()
+	if expected := "test:1:1: destination of '=' must be a variable"; err == nil || err.Error() != expected {
+		t.Errorf("wrong error for an invalid assignment: expected %q, actual %v", expected, err)
+	}
+}
+
+func TestParseItemByItem(t *testing.T) {
+	p := New("test", "extern sin(x); def f(x) x;; f(1) + 2")
+
+	if kind := p.NextItem(); kind != ItemExtern {
+		t.Fatalf("expected extern, actual item kind %d", kind)
+	}
+	if _, err := p.ParseExtern(); err != nil {
+		t.Fatal(err)
+	}
+	if kind := p.NextItem(); kind != ItemDefinition {
+		t.Fatalf("expected definition, actual item kind %d", kind)
+	}
+	if _, err := p.ParseDefinition(); err != nil {
+		t.Fatal(err)
+	}
+	if kind := p.NextItem(); kind != ItemExpression {
+		t.Fatalf("expected expression, actual item kind %d", kind)
+	}
+	if _, err := p.ParseExpression(); err != nil {
+		t.Fatal(err)
+	}
+	if kind := p.NextItem(); kind != ItemEOF {
+		t.Fatalf("expected end of file, actual item kind %d", kind)
+	}
+}
+
+func TestParseDeclare(t *testing.T) {
+	p := New("test", "~1 | 2 + 3")
+	p.Declare(&ast.Prototype{Name: "unary~", Args: []string{"v"}, Kind: ast.ProtoUnary})
+	p.Declare(&ast.Prototype{Name: "binary|", Args: []string{"a", "b"}, Kind: ast.ProtoBinary, Precedence: 5})
+	expr, err := p.ParseExpression()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearSpans(expr)
+
+	var expected ast.Expr = &ast.BinaryExpr{
+		Op:  "|",
+		LHS: &ast.UnaryExpr{Op: "~", Operand: &ast.NumberExpr{Val: 1}},
+		RHS: &ast.BinaryExpr{Op: "+", LHS: &ast.NumberExpr{Val: 2}, RHS: &ast.NumberExpr{Val: 3}},
+	}
+	if !reflect.DeepEqual(expected, expr) {
+		t.Errorf("parsing with declared operators is wrong: %#v", expr)
+	}
+}
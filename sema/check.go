@@ -0,0 +1,559 @@
+// Package sema analyzes the semantics of parsed kaleigo programs.
+//
+// Check builds a symbol table of the functions, resolves every name in the program, infers
+// the types of the expressions, and reports all the problems with their positions, before any
+// code is generated.
+package sema
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/agatan/kaleigo/ast"
+)
+
+// Info holds the results of the analysis of a file.
+type Info struct {
+	// Funcs are the functions of the file by name, including the main function.
+	Funcs map[string]*Object
+	// Uses maps the expressions that refer to names to the objects they refer to:
+	// *ast.VariableExpr to variables, and *ast.CallExpr, *ast.UnaryExpr and *ast.BinaryExpr
+	// of user-defined operators to functions.
+	Uses map[ast.Expr]*Object
+	// Types maps the expressions to their types in the default instances, before they are
+	// converted to the types expected by their contexts. Number literals have the types decided
+	// by their contexts.
+	Types map[ast.Expr]ast.Type
+	// Instances are the instances of the functions that are defined or called, including
+	// the default instances of all the definitions.
+	Instances []*Instance
+
+	terms map[ast.Expr]*typeVar
+}
+
+// checker holds the state of the analysis of a file.
+type checker struct {
+	filename string
+	info     *Info
+	funcs    *Scope // the outermost scope
+	errors   ErrorList
+
+	// defTypes are the types of the definitions, including the ones of redefinitions.
+	defTypes map[*ast.Function]*funcType
+	// vars are the type variables created so far, and objects are the variables declared so far.
+	vars    []*typeVar
+	objects []*Object
+	// sites are the calls in the bodies of the definitions.
+	sites map[*ast.Function][]*callSite
+	// def is the definition being checked, and errs are the errors found in the definitions.
+	def  *ast.Function
+	errs map[*ast.Function]ErrorList
+}
+
+// Check analyzes the file. Functions may be referred to before they are defined.
+// The returned error is an ErrorList of all the problems found.
+func Check(f *ast.File) (*Info, error) {
+	c := &checker{
+		filename: f.Name,
+		info: &Info{
+			Funcs: make(map[string]*Object),
+			Uses:  make(map[ast.Expr]*Object),
+			Types: make(map[ast.Expr]ast.Type),
+			terms: make(map[ast.Expr]*typeVar),
+		},
+		funcs:    NewScope(nil),
+		defTypes: make(map[*ast.Function]*funcType),
+		sites:    make(map[*ast.Function][]*callSite),
+		errs:     make(map[*ast.Function]ErrorList),
+	}
+	defs := append(f.Defs[:len(f.Defs):len(f.Defs)], f.CreateMain())
+	c.declare(f.Externs, defs)
+	for _, scc := range c.components(defs) {
+		start := len(c.vars)
+		fts := make([]*funcType, len(scc))
+		for i, def := range scc {
+			c.checkFunction(def)
+			fts[i] = c.defTypes[def]
+		}
+		c.generalize(fts, c.vars[start:])
+	}
+	c.specialize(defs)
+	c.complete()
+
+	// the errors in the definitions are reported in the order of the definitions.
+	for _, def := range defs {
+		c.errors = append(c.errors, c.errs[def]...)
+	}
+	return c.info, c.errors.Err()
+}
+
+func (c *checker) errorf(span ast.Span, format string, args ...interface{}) *Error {
+	e := &Error{
+		Filename: c.filename,
+		Span:     span,
+		Msg:      fmt.Sprintf(format, args...),
+	}
+	if c.def != nil {
+		c.errs[c.def] = append(c.errs[c.def], e)
+	} else {
+		c.errors = append(c.errors, e)
+	}
+	return e
+}
+
+// declare builds the symbol table of the externs and the definitions.
+func (c *checker) declare(externs []*ast.Prototype, defs []*ast.Function) {
+	for _, extern := range externs {
+		params, result := signature(extern)
+		if obj := c.funcs.Lookup(extern.Name); obj != nil {
+			switch {
+			case obj.Arity != len(extern.Args):
+				c.errorf(extern.Span, "external function %q is redeclared with %d arguments", extern.Name, len(extern.Args))
+			case !sameSignature(obj, params, result):
+				c.errorf(extern.Span, "external function %q is redeclared as %s, but declared as %s",
+					extern.Name, signatureString(params, result), signatureString(obj.Params, obj.Type))
+			}
+			continue
+		}
+		// externs are C functions, whose types are fixed.
+		ft := &funcType{params: make([]*typeVar, len(params)), result: c.known(result, extern.Span)}
+		for i, t := range params {
+			ft.params[i] = c.known(t, extern.Span)
+		}
+		c.insertFunc(&Object{Kind: ObjFunction, Name: extern.Name, Decl: extern, Arity: len(extern.Args), Type: result, Params: params, ft: ft})
+	}
+
+	for _, def := range defs {
+		ft := c.annotatedType(def.Prototype)
+		c.defTypes[def] = ft
+		obj := c.funcs.Lookup(def.Name)
+		switch {
+		case obj == nil:
+			c.insertFunc(&Object{Kind: ObjFunction, Name: def.Name, Decl: def, Arity: len(def.Args), Defined: true, ft: ft})
+		case obj.Defined:
+			c.errorf(def.Prototype.Span, "redefinition of function %q", def.Name)
+		case obj.Arity != len(def.Args):
+			c.errorf(def.Prototype.Span, "function %q is defined with %d arguments, but declared with %d", def.Name, len(def.Args), obj.Arity)
+		default:
+			// the types that are not annotated are the ones of the extern.
+			ok := unify(ft.result, obj.ft.result)
+			for i, p := range ft.params {
+				ok = unify(p, obj.ft.params[i]) && ok
+			}
+			if !ok {
+				c.errorf(def.Prototype.Span, "function %q is defined as %s, but declared as %s",
+					def.Name, annotationString(def.Prototype), signatureString(obj.Params, obj.Type))
+				// the body is checked with the annotated types, so that the error is not reported again.
+				c.defTypes[def] = c.annotatedType(def.Prototype)
+			} else {
+				c.defTypes[def] = obj.ft
+			}
+			obj.Decl = def
+			obj.Defined = true
+		}
+	}
+}
+
+// annotatedType returns the type of the function of the definition, where the types that
+// are not annotated are inferred, except the result of the main function, which is f64.
+func (c *checker) annotatedType(p *ast.Prototype) *funcType {
+	typeOf := func(t ast.Type) *typeVar {
+		if t == ast.NoType {
+			return c.newVar(anyKind)
+		}
+		return c.known(t, p.Span)
+	}
+	ft := &funcType{params: make([]*typeVar, len(p.Args)), result: typeOf(p.ResultType)}
+	if p.Name == ast.MainName {
+		ft.result = c.known(ast.TypeF64, p.Span)
+	}
+	for i := range p.Args {
+		ft.params[i] = typeOf(p.ArgType(i))
+	}
+	return ft
+}
+
+func (c *checker) insertFunc(obj *Object) {
+	c.funcs.Insert(obj)
+	c.info.Funcs[obj.Name] = obj
+}
+
+// components returns the strongly connected components of the call graph of the definitions,
+// callees first.
+func (c *checker) components(defs []*ast.Function) [][]*ast.Function {
+	callees := make(map[*ast.Function][]*ast.Function)
+	for _, def := range defs {
+		ast.Inspect(def.Body, func(e ast.Expr) bool {
+			var name string
+			switch e := e.(type) {
+			case *ast.CallExpr:
+				name = e.Callee
+			case *ast.UnaryExpr:
+				name = ast.UnaryFunctionName(e.Op)
+			case *ast.BinaryExpr:
+				name = ast.BinaryFunctionName(e.Op)
+			}
+			if obj := c.funcs.Lookup(name); obj != nil {
+				if callee, ok := obj.Decl.(*ast.Function); ok {
+					callees[def] = append(callees[def], callee)
+				}
+			}
+			return true
+		})
+	}
+
+	// Tarjan's algorithm, which finds the components in reverse topological order.
+	var (
+		sccs    [][]*ast.Function
+		stack   []*ast.Function
+		index   = make(map[*ast.Function]int)
+		lowlink = make(map[*ast.Function]int)
+		onStack = make(map[*ast.Function]bool)
+	)
+	var visit func(def *ast.Function)
+	visit = func(def *ast.Function) {
+		index[def] = len(index)
+		lowlink[def] = index[def]
+		stack = append(stack, def)
+		onStack[def] = true
+		for _, callee := range callees[def] {
+			if _, ok := index[callee]; !ok {
+				visit(callee)
+				if lowlink[callee] < lowlink[def] {
+					lowlink[def] = lowlink[callee]
+				}
+			} else if onStack[callee] && index[callee] < lowlink[def] {
+				lowlink[def] = index[callee]
+			}
+		}
+		if lowlink[def] != index[def] {
+			return
+		}
+		var scc []*ast.Function
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			scc = append(scc, top)
+			if top == def {
+				break
+			}
+		}
+		sccs = append(sccs, scc)
+	}
+	for _, def := range defs {
+		if _, ok := index[def]; !ok {
+			visit(def)
+		}
+	}
+	return sccs
+}
+
+func (c *checker) checkFunction(def *ast.Function) {
+	c.def = def
+	defer func() { c.def = nil }()
+
+	ft := c.defTypes[def]
+	scope := NewScope(c.funcs)
+	for i, arg := range def.Args {
+		c.insertVar(scope, &Object{Kind: ObjParam, Name: arg, Decl: def, tv: ft.params[i]})
+	}
+	// the value of the main function is printed as a double whatever its type is, except strings.
+	if def.Name == ast.MainName {
+		t := c.checkExpr(scope, def.Body, nil)
+		if t.find().typ == ast.TypeString {
+			// the value is the one of the last top-level expression.
+			last := def.Body
+			if b, ok := last.(*ast.BlockExpr); ok && len(b.Exprs) > 0 {
+				last = b.Exprs[len(b.Exprs)-1]
+			}
+			c.typeError(last.Loc(), []*typeVar{t}, "cannot use %s as value of the program", t)
+		}
+		return
+	}
+	t := c.checkExpr(scope, def.Body, ft.result)
+	c.assign(def.Body, t, ft.result, fmt.Sprintf("result of %q", def.Name))
+}
+
+// insertVar declares the variable in the scope.
+func (c *checker) insertVar(scope *Scope, obj *Object) {
+	scope.Insert(obj)
+	c.objects = append(c.objects, obj)
+}
+
+// complete fills the types of the objects and the expressions found by the inference,
+// which are the ones of the default instances.
+func (c *checker) complete() {
+	for _, obj := range c.info.Funcs {
+		obj.Params = make([]ast.Type, len(obj.ft.params))
+		for i, p := range obj.ft.params {
+			obj.Params[i] = p.in(nil)
+		}
+		obj.Type = obj.ft.result.in(nil)
+	}
+	for _, obj := range c.objects {
+		obj.Type = obj.tv.in(nil)
+	}
+	for expr, v := range c.info.terms {
+		c.info.Types[expr] = v.in(nil)
+	}
+}
+
+// lookupFunc resolves the function called by expr.
+func (c *checker) lookupFunc(expr ast.Expr, name string) *Object {
+	obj := c.funcs.Lookup(name)
+	if obj != nil {
+		c.info.Uses[expr] = obj
+	}
+	return obj
+}
+
+// assign reports an error if the value of expr, whose type is t, cannot be used as a value of
+// type want in the context. Booleans are converted to f64 implicitly.
+func (c *checker) assign(expr ast.Expr, t, want *typeVar, context string) {
+	rt, rw := t.find(), want.find()
+	if rt.typ == ast.TypeBool && (rw.typ == ast.TypeF64 || rw.typ == ast.NoType && !rw.kind.allows(ast.TypeBool)) {
+		// want is f64, or a number that must be f64 to hold the converted boolean.
+		constrain(rw, condKind)
+		return
+	}
+	if !unify(t, want) {
+		c.typeError(expr.Loc(), []*typeVar{want, t}, "cannot use %s as %s in %s", t, want, context)
+	}
+}
+
+// number converts a boolean operand of an arithmetic or comparison operator, or the start value
+// of a for loop, to f64, and reports an error if the others are not numbers.
+func (c *checker) number(expr ast.Expr, t *typeVar, context string) *typeVar {
+	r := t.find()
+	if r.typ == ast.TypeBool {
+		return c.known(ast.TypeF64, expr.Loc())
+	}
+	if !constrain(r, numKind) {
+		c.typeError(expr.Loc(), []*typeVar{t}, "cannot use %s as %s in %s", t, numKind, context)
+		return c.invalid()
+	}
+	return t
+}
+
+// variable returns the type of a variable that is not annotated, initialized with a value of
+// type t. Booleans are converted to f64, so that a variable is either a number or a string.
+func (c *checker) variable(expr ast.Expr, t *typeVar) *typeVar {
+	r := t.find()
+	if r.typ == ast.TypeBool {
+		return c.known(ast.TypeF64, expr.Loc())
+	}
+	constrain(r, varKind)
+	return t
+}
+
+// checkArgs checks the arguments passed to the function obj, which may be nil if it is unknown.
+// It returns the result type of the call.
+func (c *checker) checkArgs(scope *Scope, call ast.Expr, obj *Object, name string, args []ast.Expr) *typeVar {
+	var ft *funcType
+	if obj != nil && obj.Arity == len(args) {
+		var vars []*typeVar
+		ft, vars = c.instantiate(obj.ft)
+		c.sites[c.def] = append(c.sites[c.def], &callSite{expr: call, fn: obj, vars: vars})
+	}
+	for i, arg := range args {
+		if ft == nil {
+			c.checkExpr(scope, arg, nil)
+			continue
+		}
+		t := c.checkExpr(scope, arg, ft.params[i])
+		c.assign(arg, t, ft.params[i], fmt.Sprintf("argument %d of %q", i+1, name))
+	}
+	if ft == nil {
+		return c.invalid()
+	}
+	return ft.result
+}
+
+// checkCond checks a condition, which is true if it is neither 0 nor NaN.
+func (c *checker) checkCond(scope *Scope, expr ast.Expr) {
+	t := c.checkExpr(scope, expr, nil)
+	if !constrain(t.find(), condKind) {
+		c.typeError(expr.Loc(), []*typeVar{t}, "cannot use %s as condition", t)
+	}
+}
+
+// checkOperands checks the operands of a binary operator or the branches of an if.
+// A number literal operand has the type of the other operand.
+func (c *checker) checkOperands(scope *Scope, l, r ast.Expr, hint *typeVar) (*typeVar, *typeVar) {
+	if isUntyped(l) && !isUntyped(r) {
+		rt := c.checkExpr(scope, r, hint)
+		return c.checkExpr(scope, l, rt), rt
+	}
+	lt := c.checkExpr(scope, l, hint)
+	return lt, c.checkExpr(scope, r, lt)
+}
+
+// checkExpr checks the expression, records its type and returns it.
+// hint is the type expected by the context, which decides the types of number literals.
+// It may be nil if there is no expectation.
+func (c *checker) checkExpr(scope *Scope, expr ast.Expr, hint *typeVar) *typeVar {
+	t := c.exprType(scope, expr, hint)
+	c.info.terms[expr] = t
+	return t
+}
+
+func (c *checker) exprType(scope *Scope, expr ast.Expr, hint *typeVar) *typeVar {
+	switch e := expr.(type) {
+	case *ast.ErrorExpr:
+		c.errorf(e.Span, "invalid expression")
+		return c.invalid()
+	case *ast.NumberExpr:
+		// an integer has the type of the context if it is a number, and it is f64 otherwise.
+		if hint != nil && e.Val == math.Trunc(e.Val) && math.Abs(e.Val) < 1<<63 {
+			if r := hint.find(); (r.typ == ast.NoType || r.typ == ast.TypeI64) && constrain(r, numKind) {
+				return hint
+			}
+		}
+		return c.known(ast.TypeF64, e.Span)
+	case *ast.StringExpr:
+		return c.known(ast.TypeString, e.Span)
+	case *ast.VariableExpr:
+		obj := scope.Lookup(e.Name)
+		if obj == nil || obj.Kind == ObjFunction {
+			c.errorf(e.Span, "unknown variable name : %q", e.Name)
+			return c.invalid()
+		}
+		c.info.Uses[e] = obj
+		return obj.tv
+
+	case *ast.UnaryExpr:
+		switch e.Op {
+		case "-":
+			return c.number(e.Operand, c.checkExpr(scope, e.Operand, hint), "operand of '-'")
+		case "!":
+			c.checkCond(scope, e.Operand)
+			return c.known(ast.TypeBool, e.Span)
+		}
+		name := ast.UnaryFunctionName(e.Op)
+		obj := c.lookupFunc(e, name)
+		t := c.checkArgs(scope, e, obj, name, []ast.Expr{e.Operand})
+		if obj == nil {
+			c.errorf(e.Span, "unknown unary operator: %q", e.Op)
+		}
+		return t
+
+	case *ast.BinaryExpr:
+		switch {
+		case e.Op == "=":
+			lhs, ok := e.LHS.(*ast.VariableExpr)
+			if !ok {
+				c.errorf(e.Span, "destination of '=' must be a variable")
+				return c.invalid()
+			}
+			want := c.invalid()
+			if obj := scope.Lookup(lhs.Name); obj != nil && obj.Kind != ObjFunction {
+				want = obj.tv
+			}
+			t := c.checkExpr(scope, e.RHS, want)
+			c.checkExpr(scope, lhs, nil)
+			c.assign(e.RHS, t, want, fmt.Sprintf("assignment to %q", lhs.Name))
+			return want
+		case e.Op == "&&" || e.Op == "||":
+			c.checkCond(scope, e.LHS)
+			c.checkCond(scope, e.RHS)
+			return c.known(ast.TypeBool, e.Span)
+		case arithmeticOps[e.Op] || comparisonOps[e.Op]:
+			if !arithmeticOps[e.Op] {
+				hint = nil
+			}
+			lt, rt := c.checkOperands(scope, e.LHS, e.RHS, hint)
+			context := fmt.Sprintf("operand of '%s'", e.Op)
+			l, r := c.number(e.LHS, lt, context), c.number(e.RHS, rt, context)
+			t := l
+			if !unify(l, r) {
+				c.typeError(e.Span, []*typeVar{l, r}, "mismatched types %s and %s in '%s'", lt, rt, e.Op)
+				t = c.invalid()
+			}
+			if comparisonOps[e.Op] {
+				return c.known(ast.TypeBool, e.Span)
+			}
+			return t
+		}
+		name := ast.BinaryFunctionName(e.Op)
+		obj := c.lookupFunc(e, name)
+		t := c.checkArgs(scope, e, obj, name, []ast.Expr{e.LHS, e.RHS})
+		if obj == nil {
+			c.errorf(e.Span, "invalid binary operator: %q", e.Op)
+		}
+		return t
+
+	case *ast.CallExpr:
+		obj := c.lookupFunc(e, e.Callee)
+		switch {
+		case obj == nil:
+			c.errorf(e.Span, "unknown function referenced: %q", e.Callee)
+		case obj.Arity != len(e.Args):
+			c.errorf(e.Span, "incorrect number of arguments passed for %q. %d expected, but %d given", e.Callee, obj.Arity, len(e.Args))
+		}
+		return c.checkArgs(scope, e, obj, e.Callee, e.Args)
+
+	case *ast.BlockExpr:
+		// an empty block evaluates to 0.0
+		if len(e.Exprs) == 0 {
+			return c.known(ast.TypeF64, e.Span)
+		}
+		for _, sub := range e.Exprs[:len(e.Exprs)-1] {
+			c.checkExpr(scope, sub, nil)
+		}
+		return c.checkExpr(scope, e.Exprs[len(e.Exprs)-1], hint)
+
+	case *ast.IfExpr:
+		c.checkCond(scope, e.Cond)
+		tt, et := c.checkOperands(scope, e.Then, e.Else, hint)
+		// a bool and an f64 are unified into f64.
+		rt, re := tt.find(), et.find()
+		if rt.typ == ast.TypeBool && re.typ == ast.TypeF64 || rt.typ == ast.TypeF64 && re.typ == ast.TypeBool {
+			return c.known(ast.TypeF64, e.Span)
+		}
+		if !unify(tt, et) {
+			c.typeError(e.Span, []*typeVar{tt, et}, "mismatched types %s and %s in branches of if", tt, et)
+			return c.invalid()
+		}
+		return tt
+
+	case *ast.ForExpr:
+		// the loop variable has the type of the start value.
+		t := c.number(e.Start, c.checkExpr(scope, e.Start, nil), "start of for loop")
+		inner := NewScope(scope)
+		c.insertVar(inner, &Object{Kind: ObjLocal, Name: e.Var, Decl: e, tv: t})
+		c.checkExpr(inner, e.Body, nil)
+		if e.Step != nil {
+			st := c.checkExpr(inner, e.Step, t)
+			c.assign(e.Step, st, t, "step of for loop")
+		}
+		c.checkCond(inner, e.End)
+		// a for loop evaluates to 0.0
+		return c.known(ast.TypeF64, e.Span)
+
+	case *ast.VarExpr:
+		inner := NewScope(scope)
+		for _, v := range e.Vars {
+			// the initializer is checked before the variable is declared, so that 'var a = a in'
+			// refers to the outer 'a'.
+			var t *typeVar
+			switch {
+			case v.Type != ast.NoType:
+				t = c.known(v.Type, v.Span)
+				if v.Init != nil {
+					it := c.checkExpr(inner, v.Init, t)
+					c.assign(v.Init, it, t, fmt.Sprintf("initialization of %q", v.Name))
+				}
+			case v.Init != nil:
+				t = c.variable(v.Init, c.checkExpr(inner, v.Init, nil))
+			default:
+				t = c.known(ast.TypeF64, v.Span)
+			}
+			c.insertVar(inner, &Object{Kind: ObjLocal, Name: v.Name, Decl: v, tv: t})
+		}
+		return c.checkExpr(inner, e.Body, hint)
+
+	default:
+		panic("internal compiler error")
+	}
+}
@@ -0,0 +1,60 @@
+package sema
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/agatan/kaleigo/ast"
+)
+
+// Error is a semantic error found in a source file.
+type Error struct {
+	Filename string
+	Span     ast.Span
+	Msg      string
+	// Notes point at the other parts of the source involved in the error, e.g. where
+	// the conflicting types of a type mismatch come from.
+	Notes []Note
+}
+
+// Note is a message attached to an error, located at another part of the source.
+type Note struct {
+	Span ast.Span
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString(e.location(e.Span))
+	b.WriteString(e.Msg)
+	for _, n := range e.Notes {
+		fmt.Fprintf(&b, "\n\t%s%s", e.location(n.Span), n.Msg)
+	}
+	return b.String()
+}
+
+func (e *Error) location(span ast.Span) string {
+	if e.Filename == "" {
+		return fmt.Sprintf("%s: ", span.Start)
+	}
+	return fmt.Sprintf("%s:%s: ", e.Filename, span.Start)
+}
+
+// ErrorList is a list of semantic errors in the order they were found.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Err returns nil if the list is empty, and the list itself otherwise.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
@@ -0,0 +1,240 @@
+package sema
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/agatan/kaleigo/ast"
+)
+
+// Types are inferred in the manner of Hindley-Milner: the types of the parameters and
+// the results of functions that are not annotated, and of the expressions, are type variables,
+// which are unified with each other and bound to types as the expressions are checked.
+// The functions are checked in the order of the strongly connected components of the call graph,
+// callees first, and the type variables left unbound in the type of a function are generalized,
+// so that the function is polymorphic, e.g. 'def id(x) x' can be called with any type.
+// Polymorphic functions are specialized into an Instance for every combination of types they
+// are called with.
+
+// typeKind is the set of the types a type variable may be bound to.
+type typeKind uint
+
+const (
+	numKind  typeKind = 1<<ast.TypeF64 | 1<<ast.TypeI64                     // operands of arithmetic
+	condKind typeKind = 1<<ast.TypeF64 | 1<<ast.TypeBool                    // conditions
+	varKind  typeKind = 1<<ast.TypeF64 | 1<<ast.TypeI64 | 1<<ast.TypeString // variables that are not annotated
+	anyKind           = varKind | 1<<ast.TypeBool
+)
+
+// kindTypes are the types in the order they are listed in error messages.
+var kindTypes = []ast.Type{ast.TypeF64, ast.TypeI64, ast.TypeBool, ast.TypeString}
+
+func (k typeKind) allows(t ast.Type) bool {
+	return k&(1<<t) != 0
+}
+
+func (k typeKind) String() string {
+	if k == anyKind {
+		return "any type"
+	}
+	var names []string
+	for _, t := range kindTypes {
+		if k.allows(t) {
+			names = append(names, t.String())
+		}
+	}
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+// typeVar is a type being inferred. Unified type variables form a set, whose representative
+// is bound to a type once the type is known.
+type typeVar struct {
+	parent *typeVar // toward the representative; nil for the representative
+	// the fields below are meaningful only for the representative.
+	typ    ast.Type // bound type; ast.NoType while it is unknown
+	kind   typeKind
+	origin ast.Span // the part of the source the bound type comes from; invalid if it is unknown
+}
+
+// find returns the representative of the set of the type variable.
+func (v *typeVar) find() *typeVar {
+	for v.parent != nil {
+		if v.parent.parent != nil {
+			v.parent = v.parent.parent
+		}
+		v = v.parent
+	}
+	return v
+}
+
+// String describes the type in error messages.
+func (v *typeVar) String() string {
+	r := v.find()
+	if r.typ != ast.NoType {
+		return r.typ.String()
+	}
+	return r.kind.String()
+}
+
+// in returns the type in the instance whose generalized type variables are bound as in subst.
+// Type variables that are bound nowhere are f64.
+func (v *typeVar) in(subst map[*typeVar]ast.Type) ast.Type {
+	r := v.find()
+	if r.typ != ast.NoType {
+		return r.typ
+	}
+	if t, ok := subst[r]; ok {
+		return t
+	}
+	return ast.TypeF64
+}
+
+// constrain restricts the representative r to the types of the kind, and binds it if only one type
+// is left. It returns false if r is bound to, or only allows, types the kind does not allow.
+func constrain(r *typeVar, kind typeKind) bool {
+	if r.typ != ast.NoType {
+		return kind.allows(r.typ)
+	}
+	k := r.kind & kind
+	if k == 0 {
+		return false
+	}
+	r.kind = k
+	for _, t := range kindTypes {
+		if k == 1<<t {
+			// e.g. f64 is the only type that is both a number and a condition.
+			r.typ = t
+		}
+	}
+	return true
+}
+
+// unify makes a and b the same type. It returns false, without changing them, if they are
+// bound to different types or one is bound to a type the other does not allow.
+func unify(a, b *typeVar) bool {
+	ra, rb := a.find(), b.find()
+	if ra == rb {
+		return true
+	}
+	// ra is bound if either is.
+	if ra.typ == ast.NoType {
+		ra, rb = rb, ra
+	}
+	switch {
+	case rb.typ != ast.NoType:
+		if ra.typ != rb.typ {
+			return false
+		}
+	case ra.typ != ast.NoType:
+		if !rb.kind.allows(ra.typ) {
+			return false
+		}
+	default:
+		if !constrain(ra, rb.kind) {
+			return false
+		}
+	}
+	rb.parent = ra
+	return true
+}
+
+// funcType is the type of a function. The type variables in generic are generalized:
+// every call instantiates them with new type variables.
+type funcType struct {
+	params  []*typeVar
+	result  *typeVar
+	generic []*typeVar
+}
+
+// newVar creates a type variable of the kind that is not bound yet.
+func (c *checker) newVar(kind typeKind) *typeVar {
+	v := &typeVar{kind: kind}
+	c.vars = append(c.vars, v)
+	return v
+}
+
+// known creates a type variable bound to the type, which comes from the origin.
+func (c *checker) known(t ast.Type, origin ast.Span) *typeVar {
+	return &typeVar{typ: t, origin: origin}
+}
+
+// invalid creates the type of an expression that has errors. It unifies with any type, so that
+// an error is not reported again by the enclosing expressions.
+func (c *checker) invalid() *typeVar {
+	return c.newVar(anyKind)
+}
+
+// instantiate returns the type of a call of the function, and the type variables the generalized
+// type variables are instantiated with.
+func (c *checker) instantiate(ft *funcType) (*funcType, []*typeVar) {
+	if len(ft.generic) == 0 {
+		return ft, nil
+	}
+	vars := make([]*typeVar, len(ft.generic))
+	m := make(map[*typeVar]*typeVar)
+	for i, g := range ft.generic {
+		vars[i] = c.newVar(g.kind)
+		m[g] = vars[i]
+	}
+	sub := func(v *typeVar) *typeVar {
+		if nv, ok := m[v.find()]; ok {
+			return nv
+		}
+		return v
+	}
+	inst := &funcType{params: make([]*typeVar, len(ft.params)), result: sub(ft.result)}
+	for i, p := range ft.params {
+		inst.params[i] = sub(p)
+	}
+	return inst, vars
+}
+
+// generalize completes the types of the functions of a strongly connected component of the call graph.
+// The type variables created while checking the component that are left unbound are f64, except
+// the ones in the types of the functions, which are generalized.
+func (c *checker) generalize(fts []*funcType, vars []*typeVar) {
+	free := make(map[*typeVar]bool)
+	for _, ft := range fts {
+		for _, v := range append(ft.params[:len(ft.params):len(ft.params)], ft.result) {
+			if r := v.find(); r.typ == ast.NoType && !free[r] {
+				free[r] = true
+				ft.generic = append(ft.generic, r)
+			}
+		}
+	}
+	for _, v := range vars {
+		if r := v.find(); r.typ == ast.NoType && !free[r] {
+			r.typ = ast.TypeF64
+		}
+	}
+}
+
+// typeError reports a type error at the span, with notes where the types of vars come from.
+func (c *checker) typeError(span ast.Span, vars []*typeVar, format string, args ...interface{}) {
+	e := c.errorf(span, format, args...)
+	for _, v := range vars {
+		r := v.find()
+		if r.typ == ast.NoType || !r.origin.Start.IsValid() || contains(span, r.origin) {
+			continue
+		}
+		dup := false
+		for _, n := range e.Notes {
+			dup = dup || n.Span == r.origin
+		}
+		if !dup {
+			e.Notes = append(e.Notes, Note{Span: r.origin, Msg: fmt.Sprintf("%s comes from here", r.typ)})
+		}
+	}
+}
+
+// contains reports whether the span inner is in the span outer.
+func contains(outer, inner ast.Span) bool {
+	return !before(inner.Start, outer.Start) && !before(outer.End, inner.End)
+}
+
+func before(a, b ast.Pos) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+}
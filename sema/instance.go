@@ -0,0 +1,132 @@
+package sema
+
+import (
+	"strings"
+
+	"github.com/agatan/kaleigo/ast"
+)
+
+// Instance is a function specialized to concrete types, which code is generated for.
+// Every function has a default instance named after the function, in which the generalized types
+// are f64, and a polymorphic function has an instance for every other combination of types it is
+// called with.
+type Instance struct {
+	Func *Object
+	// Name is the name of the generated function. The names of the instances other than
+	// the default one are the name of the function followed by the types, e.g. "id.i64".
+	Name   string
+	Params []ast.Type
+	Result ast.Type
+
+	info    *Info
+	subst   map[*typeVar]ast.Type // types of the generalized type variables
+	callees map[ast.Expr]*Instance
+}
+
+// TypeOf returns the type of the expression in the body of the instance.
+func (inst *Instance) TypeOf(expr ast.Expr) ast.Type {
+	v, ok := inst.info.terms[expr]
+	if !ok {
+		return ast.NoType
+	}
+	return v.in(inst.subst)
+}
+
+// Callee returns the instance called by the expression in the body of the instance: a call or
+// an application of a user-defined operator.
+func (inst *Instance) Callee(expr ast.Expr) *Instance {
+	return inst.callees[expr]
+}
+
+// Callees returns the instances called in the body of the instance, in no particular order.
+func (inst *Instance) Callees() []*Instance {
+	seen := make(map[*Instance]bool)
+	var callees []*Instance
+	for _, callee := range inst.callees {
+		if !seen[callee] {
+			seen[callee] = true
+			callees = append(callees, callee)
+		}
+	}
+	return callees
+}
+
+// callSite is a call of a function in the body of a function.
+type callSite struct {
+	expr ast.Expr
+	fn   *Object
+	// vars are the type variables the generalized type variables of fn are instantiated with.
+	vars []*typeVar
+}
+
+// specialize creates the instances of the functions, starting from the default ones of the
+// definitions, and following the calls in their bodies.
+func (c *checker) specialize(defs []*ast.Function) {
+	instances := make(map[string]*Instance)
+	var queue []*Instance
+	get := func(obj *Object, types []ast.Type) *Instance {
+		ft := obj.ft
+		name := obj.Name
+		for _, t := range types {
+			if t != ast.TypeF64 {
+				names := make([]string, len(types)+1)
+				names[0] = obj.Name
+				for i, t := range types {
+					names[i+1] = t.String()
+				}
+				name = strings.Join(names, ".")
+				break
+			}
+		}
+		if inst, ok := instances[name]; ok {
+			return inst
+		}
+		inst := &Instance{
+			Func:    obj,
+			Name:    name,
+			info:    c.info,
+			subst:   make(map[*typeVar]ast.Type),
+			callees: make(map[ast.Expr]*Instance),
+		}
+		for i, g := range ft.generic {
+			inst.subst[g] = types[i]
+		}
+		for _, p := range ft.params {
+			inst.Params = append(inst.Params, p.in(inst.subst))
+		}
+		inst.Result = ft.result.in(inst.subst)
+		instances[name] = inst
+		c.info.Instances = append(c.info.Instances, inst)
+		queue = append(queue, inst)
+		return inst
+	}
+
+	for _, def := range defs {
+		if obj := c.funcs.Lookup(def.Name); obj != nil && obj.Decl == def {
+			get(obj, defaultTypes(len(obj.ft.generic)))
+		}
+	}
+	for len(queue) > 0 {
+		inst := queue[0]
+		queue = queue[1:]
+		def, ok := inst.Func.Decl.(*ast.Function)
+		if !ok {
+			continue
+		}
+		for _, site := range c.sites[def] {
+			types := make([]ast.Type, len(site.vars))
+			for i, v := range site.vars {
+				types[i] = v.in(inst.subst)
+			}
+			inst.callees[site.expr] = get(site.fn, types)
+		}
+	}
+}
+
+func defaultTypes(n int) []ast.Type {
+	types := make([]ast.Type, n)
+	for i := range types {
+		types[i] = ast.TypeF64
+	}
+	return types
+}
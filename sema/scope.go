@@ -0,0 +1,59 @@
+package sema
+
+import "github.com/agatan/kaleigo/ast"
+
+// ObjectKind identifies what an object is.
+type ObjectKind int
+
+const (
+	ObjFunction ObjectKind = iota // function declared by extern or def
+	ObjParam                      // parameter of a function
+	ObjLocal                      // variable of var or for
+)
+
+// Object is a named entity that expressions refer to.
+type Object struct {
+	Kind ObjectKind
+	Name string
+	// Decl is the node that declares the object: the *ast.Prototype of an extern, the *ast.Function
+	// of a definition or a parameter, the *ast.VarBinding or the *ast.ForExpr of a local.
+	Decl ast.Node
+	// Arity is the number of parameters of a function.
+	Arity int
+	// Defined reports whether a function has a definition, rather than being only an extern.
+	Defined bool
+	// Type is the type of a variable, or the result type of a function.
+	Type ast.Type
+	// Params are the types of the parameters of a function.
+	// The types of polymorphic functions and their variables are the ones of the default instances.
+	Params []ast.Type
+
+	tv *typeVar  // type of a variable
+	ft *funcType // type of a function
+}
+
+// Scope maps names to objects. Names in a scope hide the same names in the parent scope.
+type Scope struct {
+	parent  *Scope
+	objects map[string]*Object
+}
+
+// NewScope creates a new scope in the parent scope, which may be nil.
+func NewScope(parent *Scope) *Scope {
+	return &Scope{parent: parent, objects: make(map[string]*Object)}
+}
+
+// Lookup returns the object of the name in the scope or its parents, or nil if there is none.
+func (s *Scope) Lookup(name string) *Object {
+	for ; s != nil; s = s.parent {
+		if obj, ok := s.objects[name]; ok {
+			return obj
+		}
+	}
+	return nil
+}
+
+// Insert inserts the object into the scope, replacing the object of the same name.
+func (s *Scope) Insert(obj *Object) {
+	s.objects[obj.Name] = obj
+}
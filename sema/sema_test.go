@@ -0,0 +1,269 @@
+package sema
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/agatan/kaleigo/ast"
+	"github.com/agatan/kaleigo/parse"
+)
+
+func check(t *testing.T, src string) (*ast.File, *Info, error) {
+	f, err := parse.New("test.kl", src).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := Check(f)
+	return f, info, err
+}
+
+func TestCheck(t *testing.T) {
+	srcs := []string{
+		"def even(n) if n == 0 then 1 else odd(n - 1)\ndef odd(n) if n == 0 then 0 else even(n - 1)\neven(10)",
+		"extern sin(x)\nextern sin(y)\ndef sin(z) z\nsin(1)",
+		"def binary| 5 (a b) a\ndef unary~(v) v\n~1 | 2",
+		"def f(x) var x = x, y = x in for i = y, i < 10 in x = i\nf(1)",
+		"",
+		"def fact(n: i64): i64 if n < 2 then 1 else n * fact(n - 1)\nfact(10)",
+		"def f(b: bool, x: f64) if b then x else b\nf(1 < 2, 3 == 4)",
+		"def g(n: i64) var m: i64 = 0, k = n in for i = n, i > 0, -1 in m = m + i * k % 7; 0\ng(3)",
+	}
+	for _, src := range srcs {
+		if _, _, err := check(t, src); err != nil {
+			t.Errorf("%q: %s", src, err)
+		}
+	}
+}
+
+func TestCheckError(t *testing.T) {
+	cases := []struct {
+		src  string
+		msgs []string
+	}{
+		{"x + y", []string{
+			`test.kl:1:1: unknown variable name : "x"`,
+			`test.kl:1:5: unknown variable name : "y"`,
+		}},
+		{"def f(x) x\nf(1, 2) + g(1)", []string{
+			`test.kl:2:1: incorrect number of arguments passed for "f". 1 expected, but 2 given`,
+			`test.kl:2:11: unknown function referenced: "g"`,
+		}},
+		{"def f(x) x\ndef f(y) y\nextern g(x)\nextern g(x, y)\nextern h(x)\ndef h(x, y) x", []string{
+			`test.kl:4:8: external function "g" is redeclared with 2 arguments`,
+			`test.kl:2:5: redefinition of function "f"`,
+			`test.kl:6:5: function "h" is defined with 2 arguments, but declared with 1`,
+		}},
+		{"def f(x) x\nf + 1; var a in a; a", []string{
+			`test.kl:2:1: unknown variable name : "f"`,
+			`test.kl:2:20: unknown variable name : "a"`,
+		}},
+		{"for i = i, i < 3 in i", []string{
+			`test.kl:1:9: unknown variable name : "i"`,
+		}},
+		{"def f(n: i64, x) n + x * 0.5\ndef g(n: i64): i64 n / 2.5\nif g(1) then 1 else 2", []string{
+			"test.kl:1:18: mismatched types i64 and f64 in '+'\n\ttest.kl:1:5: i64 comes from here",
+			"test.kl:2:20: mismatched types i64 and f64 in '/'\n\ttest.kl:2:5: i64 comes from here",
+			"test.kl:3:4: cannot use i64 as condition\n\ttest.kl:2:5: i64 comes from here",
+		}},
+		{"def f(b: bool) b\nf(1.5); var n: i64 = 0.5 in n = 1; def h(x): bool x + 1", []string{
+			"test.kl:2:51: cannot use f64 or i64 as bool in result of \"h\"\n\ttest.kl:2:40: bool comes from here",
+			"test.kl:2:3: cannot use f64 as bool in argument 1 of \"f\"\n\ttest.kl:1:5: bool comes from here",
+			"test.kl:2:22: cannot use f64 as i64 in initialization of \"n\"\n\ttest.kl:2:13: i64 comes from here",
+		}},
+		{"extern f(x: i64)\ndef f(y): bool y\nextern g(x)\nextern g(x: bool): bool\nextern h(x: i64)\ndef h(y) y", []string{
+			`test.kl:4:8: external function "g" is redeclared as (bool): bool, but declared as (f64): f64`,
+			`test.kl:2:5: function "f" is defined as (_): bool, but declared as (i64): f64`,
+			"test.kl:6:10: cannot use i64 as f64 in result of \"h\"\n\ttest.kl:5:8: f64 comes from here",
+		}},
+		{"def f(n: i64) if n == 0 then n else 1.5\ndef g(n: i64) for i = n, 1, 0.5 in unknown", []string{
+			"test.kl:1:15: mismatched types i64 and f64 in branches of if\n\ttest.kl:1:5: i64 comes from here",
+			`test.kl:2:36: unknown variable name : "unknown"`,
+			"test.kl:2:29: cannot use f64 as i64 in step of for loop\n\ttest.kl:2:5: i64 comes from here",
+		}},
+		{"extern putstr(s: str)\nputstr(1); \"a\" + 1; -\"a\"; if \"a\" then 1 else 2; var s = \"a\" in s = 2; \"end\"", []string{
+			"test.kl:2:8: cannot use f64 as str in argument 1 of \"putstr\"\n\ttest.kl:1:8: str comes from here",
+			"test.kl:2:12: cannot use str as f64 or i64 in operand of '+'",
+			"test.kl:2:22: cannot use str as f64 or i64 in operand of '-'",
+			"test.kl:2:30: cannot use str as condition",
+			"test.kl:2:68: cannot use f64 as str in assignment to \"s\"\n\ttest.kl:2:57: str comes from here",
+			"test.kl:2:71: cannot use str as value of the program",
+		}},
+		{"def f(x) x + 1\ndef g(n: i64) n\ng(f(1.5))", []string{
+			"test.kl:3:3: cannot use f64 as i64 in argument 1 of \"g\"\n\ttest.kl:2:5: i64 comes from here",
+		}},
+	}
+	for _, c := range cases {
+		_, _, err := check(t, c.src)
+		list, ok := err.(ErrorList)
+		if !ok {
+			t.Errorf("%q: expected ErrorList, but got %v", c.src, err)
+			continue
+		}
+		if len(list) != len(c.msgs) {
+			t.Errorf("%q: expected %d errors, but got %d:\n%s", c.src, len(c.msgs), len(list), list)
+			continue
+		}
+		for i, e := range list {
+			if e.Error() != c.msgs[i] {
+				t.Errorf("%q: expected %q, but got %q", c.src, c.msgs[i], e.Error())
+			}
+		}
+	}
+}
+
+func TestCheckUses(t *testing.T) {
+	f, info, err := check(t, "extern g(x)\ndef f(x) var y = x in g(y)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := f.Defs[0]
+	v := def.Body.(*ast.VarExpr)
+	call := v.Body.(*ast.CallExpr)
+
+	if obj := info.Uses[v.Vars[0].Init]; obj == nil || obj.Kind != ObjParam || obj.Decl != def {
+		t.Errorf("x is resolved to %+v", obj)
+	}
+	if obj := info.Uses[call.Args[0]]; obj == nil || obj.Kind != ObjLocal || obj.Decl != v.Vars[0] {
+		t.Errorf("y is resolved to %+v", obj)
+	}
+	if obj := info.Uses[call]; obj == nil || obj != info.Funcs["g"] || obj.Defined || obj.Arity != 1 {
+		t.Errorf("g is resolved to %+v", obj)
+	}
+	if obj := info.Funcs["f"]; obj == nil || !obj.Defined || obj.Decl != def {
+		t.Errorf("f is %+v", obj)
+	}
+	if _, ok := info.Funcs[ast.MainName]; !ok {
+		t.Errorf("main function is not found")
+	}
+}
+
+func TestCheckTypes(t *testing.T) {
+	f, info, err := check(t, "def f(n: i64, x): bool var m = n * 2 in x < 1 && m > 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := f.Defs[0]
+	v := def.Body.(*ast.VarExpr)
+	mul := v.Vars[0].Init.(*ast.BinaryExpr)
+	and := v.Body.(*ast.BinaryExpr)
+	lt := and.LHS.(*ast.BinaryExpr)
+
+	types := []struct {
+		expr ast.Expr
+		typ  ast.Type
+	}{
+		{mul, ast.TypeI64},
+		{mul.RHS, ast.TypeI64},
+		{lt, ast.TypeBool},
+		{lt.LHS, ast.TypeF64},
+		{lt.RHS, ast.TypeF64},
+		{and.RHS.(*ast.BinaryExpr).LHS, ast.TypeI64},
+		{and, ast.TypeBool},
+	}
+	for _, c := range types {
+		if typ := info.Types[c.expr]; typ != c.typ {
+			t.Errorf("type of %#v is %s, but expected %s", c.expr, typ, c.typ)
+		}
+	}
+	if obj := info.Funcs["f"]; obj.Type != ast.TypeBool || !reflect.DeepEqual(obj.Params, []ast.Type{ast.TypeI64, ast.TypeF64}) {
+		t.Errorf("signature of f is %s", signatureString(obj.Params, obj.Type))
+	}
+}
+
+func TestCheckStrings(t *testing.T) {
+	src := `extern strconcat(a: str, b: str): str
+extern strlength(s: str): i64
+def greet(name) strconcat("hello, ", name)
+def id(x) x
+def twice(s) var t = s in strconcat(t, t)
+strlength(greet(id("kaleigo"))) + strlength(twice(""))`
+	f, info, err := check(t, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"greet", "twice"} {
+		obj := info.Funcs[name]
+		if s := signatureString(obj.Params, obj.Type); s != "(str): str" {
+			t.Errorf("type of %s is %s, but expected (str): str", name, s)
+		}
+	}
+	lit := f.Defs[0].Body.(*ast.CallExpr).Args[0]
+	if typ := info.Types[lit]; typ != ast.TypeString {
+		t.Errorf("type of string literal is %s", typ)
+	}
+	found := false
+	for _, inst := range info.Instances {
+		found = found || inst.Name == "id.str"
+	}
+	if !found {
+		t.Errorf("instance id.str is not found")
+	}
+}
+
+func TestInfer(t *testing.T) {
+	src := `def id(x) x
+def half(x) x / 2
+def add(x, n: i64) x + n
+def f(n: i64): i64 half(id(n))
+def g(b) id(b) && b
+g(1 < 2)`
+	f, info, err := check(t, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sigs := map[string]string{
+		"id":   "(f64): f64",
+		"half": "(f64): f64",
+		"add":  "(i64, i64): i64",
+		"f":    "(i64): i64",
+		"g":    "(f64): bool",
+	}
+	for name, sig := range sigs {
+		obj := info.Funcs[name]
+		if s := signatureString(obj.Params, obj.Type); s != sig {
+			t.Errorf("type of %s is %s, but expected %s", name, s, sig)
+		}
+	}
+
+	instances := make(map[string]*Instance)
+	for _, inst := range info.Instances {
+		instances[inst.Name] = inst
+	}
+	expected := map[string]string{
+		"id": "(f64): f64", "half": "(f64): f64", "add": "(i64, i64): i64", "f": "(i64): i64", "g": "(f64): bool",
+		ast.MainName: "(): f64", "id.i64": "(i64): i64", "half.i64": "(i64): i64", "g.bool": "(bool): bool", "id.bool": "(bool): bool",
+	}
+	if len(instances) != len(expected) {
+		t.Errorf("expected %d instances, but got %d: %v", len(expected), len(instances), instances)
+	}
+	for name, sig := range expected {
+		inst, ok := instances[name]
+		if !ok {
+			t.Errorf("instance %s is not found", name)
+			continue
+		}
+		if s := signatureString(inst.Params, inst.Result); s != sig {
+			t.Errorf("type of instance %s is %s, but expected %s", name, s, sig)
+		}
+	}
+
+	half := f.Defs[1].Body.(*ast.BinaryExpr)
+	if typ := instances["half.i64"].TypeOf(half.RHS); typ != ast.TypeI64 {
+		t.Errorf("type of 2 in half.i64 is %s", typ)
+	}
+	if typ := instances["half"].TypeOf(half.RHS); typ != ast.TypeF64 {
+		t.Errorf("type of 2 in half is %s", typ)
+	}
+	call := f.Defs[3].Body.(*ast.CallExpr)
+	if callee := instances["f"].Callee(call); callee != instances["half.i64"] {
+		t.Errorf("f calls %+v", callee)
+	}
+	if callee := instances["f"].Callee(call.Args[0]); callee != instances["id.i64"] {
+		t.Errorf("f calls %+v", callee)
+	}
+	if callees := instances["f"].Callees(); len(callees) != 2 {
+		t.Errorf("f calls %d instances: %v", len(callees), callees)
+	}
+}
@@ -0,0 +1,81 @@
+package sema
+
+import (
+	"strings"
+
+	"github.com/agatan/kaleigo/ast"
+)
+
+// valueType returns the type of values annotated with t. Values that are not annotated are f64.
+func valueType(t ast.Type) ast.Type {
+	if t == ast.NoType {
+		return ast.TypeF64
+	}
+	return t
+}
+
+// signature returns the types of the parameters and the result of the prototype.
+func signature(p *ast.Prototype) ([]ast.Type, ast.Type) {
+	params := make([]ast.Type, len(p.Args))
+	for i := range params {
+		params[i] = valueType(p.ArgType(i))
+	}
+	return params, valueType(p.ResultType)
+}
+
+func sameSignature(obj *Object, params []ast.Type, result ast.Type) bool {
+	if obj.Type != result || len(obj.Params) != len(params) {
+		return false
+	}
+	for i, t := range params {
+		if obj.Params[i] != t {
+			return false
+		}
+	}
+	return true
+}
+
+// signatureString formats the types of a function as "(i64, f64): f64".
+func signatureString(params []ast.Type, result ast.Type) string {
+	names := make([]string, len(params))
+	for i, t := range params {
+		names[i] = t.String()
+	}
+	return "(" + strings.Join(names, ", ") + "): " + result.String()
+}
+
+// annotationString formats the annotated types of the prototype like signatureString,
+// where the types that are not annotated are "_".
+func annotationString(p *ast.Prototype) string {
+	name := func(t ast.Type) string {
+		if t == ast.NoType {
+			return "_"
+		}
+		return t.String()
+	}
+	names := make([]string, len(p.Args))
+	for i := range names {
+		names[i] = name(p.ArgType(i))
+	}
+	return "(" + strings.Join(names, ", ") + "): " + name(p.ResultType)
+}
+
+// arithmeticOps are the built-in operators whose result has the type of their operands.
+var arithmeticOps = map[string]bool{"+": true, "-": true, "*": true, "/": true, "%": true}
+
+// comparisonOps are the built-in operators that compare their operands into a bool.
+var comparisonOps = map[string]bool{"<": true, ">": true, "<=": true, ">=": true, "==": true, "!=": true}
+
+// isUntyped reports whether the expression consists only of number literals, so that its type
+// is decided by the context: it is i64 where an i64 is expected and it is an integer, and f64 otherwise.
+func isUntyped(expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.NumberExpr:
+		return true
+	case *ast.UnaryExpr:
+		return e.Op == "-" && isUntyped(e.Operand)
+	case *ast.BinaryExpr:
+		return arithmeticOps[e.Op] && isUntyped(e.LHS) && isUntyped(e.RHS)
+	}
+	return false
+}
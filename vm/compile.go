@@ -0,0 +1,352 @@
+package vm
+
+import (
+	"math"
+
+	"github.com/agatan/kaleigo/ast"
+	"github.com/agatan/kaleigo/builtins"
+)
+
+// compiler translates an ast.File into a Program.
+type compiler struct {
+	prog     *Program
+	filename string
+	consts   map[uint64]int32 // indices of the constants by their bits
+	funcs    map[string]int32 // indices of the definitions in prog.Funcs
+	externs  map[string]int32 // indices of the externs in prog.Externs
+
+	// state of the function being compiled
+	fun    *Function
+	scopes map[string]int32 // local slots of the variables in scope
+}
+
+// Compile compiles the file into a program, whose main function evaluates all of toplevel expressions.
+// Like codegen, it reports unknown variables and functions, and calls with wrong numbers of arguments.
+// Externs that package builtins does not provide are reported too.
+func Compile(fileast *ast.File) (*Program, error) {
+	c := &compiler{
+		prog:     &Program{},
+		filename: fileast.Name,
+		consts:   make(map[uint64]int32),
+		funcs:    make(map[string]int32),
+		externs:  make(map[string]int32),
+	}
+
+	// functions are registered before their bodies are compiled, so that they can call each other.
+	main := fileast.CreateMain()
+	defs := append(fileast.Defs[:len(fileast.Defs):len(fileast.Defs)], main)
+	for _, def := range defs {
+		c.funcs[def.Name] = int32(len(c.prog.Funcs))
+		c.prog.Funcs = append(c.prog.Funcs, &Function{Name: def.Name, Arity: len(def.Args)})
+	}
+	c.prog.Main = int(c.funcs[main.Name])
+
+	// externs of defined functions are forward declarations, and refer to the definitions.
+	// The others must be resolved by the virtual machine, so they are checked here.
+	for _, extern := range fileast.Externs {
+		if _, ok := c.funcs[extern.Name]; ok {
+			continue
+		}
+		if _, err := builtins.Resolve(extern.Name, len(extern.Args)); err != nil {
+			return nil, c.errorf(extern.Pos(), "%v", err)
+		}
+		if _, ok := c.externs[extern.Name]; ok {
+			continue
+		}
+		c.externs[extern.Name] = int32(len(c.prog.Externs))
+		c.prog.Externs = append(c.prog.Externs, &Extern{Name: extern.Name, Arity: len(extern.Args)})
+	}
+
+	for i, def := range defs {
+		if err := c.compileFunction(c.prog.Funcs[i], def); err != nil {
+			return nil, err
+		}
+	}
+	return c.prog, nil
+}
+
+// errorf returns an error located at pos.
+func (c *compiler) errorf(pos ast.Pos, format string, args ...interface{}) error {
+	return ast.Errorf(c.filename, pos, format, args...)
+}
+
+func (c *compiler) compileFunction(f *Function, def *ast.Function) error {
+	c.fun = f
+	c.scopes = make(map[string]int32)
+	for _, arg := range def.Args {
+		c.scopes[arg] = c.newLocal(arg)
+	}
+	if err := c.compileExpr(def.Body); err != nil {
+		return err
+	}
+	c.emit(OpReturn, 0)
+	return nil
+}
+
+// emit appends an instruction to the current function, and returns its address.
+func (c *compiler) emit(op Opcode, arg int32) int32 {
+	c.fun.Code = append(c.fun.Code, Instr{Op: op, Arg: arg})
+	return int32(len(c.fun.Code) - 1)
+}
+
+// patch sets the destination of the jump instruction at addr to the next instruction.
+func (c *compiler) patch(addr int32) {
+	c.fun.Code[addr].Arg = int32(len(c.fun.Code))
+}
+
+func (c *compiler) constant(v float64) int32 {
+	bits := math.Float64bits(v)
+	if i, ok := c.consts[bits]; ok {
+		return i
+	}
+	i := int32(len(c.prog.Consts))
+	c.prog.Consts = append(c.prog.Consts, v)
+	c.consts[bits] = i
+	return i
+}
+
+// newLocal allocates a new local slot in the current function.
+func (c *compiler) newLocal(name string) int32 {
+	c.fun.Locals = append(c.fun.Locals, name)
+	return int32(len(c.fun.Locals) - 1)
+}
+
+// bind binds the name to the slot, and returns a function that restores the previous binding.
+func (c *compiler) bind(name string, slot int32) (restore func()) {
+	old, exists := c.scopes[name]
+	c.scopes[name] = slot
+	return func() {
+		if exists {
+			c.scopes[name] = old
+		} else {
+			delete(c.scopes, name)
+		}
+	}
+}
+
+var binaryOps = map[string]Opcode{
+	"+":  OpAdd,
+	"-":  OpSub,
+	"*":  OpMul,
+	"/":  OpDiv,
+	"%":  OpRem,
+	"<":  OpLT,
+	">":  OpGT,
+	"<=": OpLE,
+	">=": OpGE,
+	"==": OpEQ,
+	"!=": OpNE,
+}
+
+// compileExpr emits the code that pushes the value of the expression.
+func (c *compiler) compileExpr(expr ast.Expr) error {
+	switch e := expr.(type) {
+	case *ast.ErrorExpr:
+		return c.errorf(e.Pos(), "invalid expression")
+	case *ast.NumberExpr:
+		c.emit(OpConst, c.constant(e.Val))
+	case *ast.StringExpr:
+		return c.errorf(e.Pos(), "strings are not supported by the virtual machine")
+	case *ast.VariableExpr:
+		slot, ok := c.scopes[e.Name]
+		if !ok {
+			return c.errorf(e.Pos(), "unknown variable name : %q", e.Name)
+		}
+		c.emit(OpLoad, slot)
+	case *ast.UnaryExpr:
+		if err := c.compileExpr(e.Operand); err != nil {
+			return err
+		}
+		switch e.Op {
+		case "-":
+			c.emit(OpNeg, 0)
+			return nil
+		case "!":
+			c.emit(OpNot, 0)
+			return nil
+		}
+		// user-defined unary operator
+		f, ok := c.funcs[ast.UnaryFunctionName(e.Op)]
+		if !ok {
+			return c.errorf(e.Pos(), "unknown unary operator: %q", e.Op)
+		}
+		c.emit(OpCall, f)
+
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case "&&", "||":
+			return c.compileLogical(e)
+		case "=":
+			return c.compileAssign(e)
+		}
+		if err := c.compileExpr(e.LHS); err != nil {
+			return err
+		}
+		if err := c.compileExpr(e.RHS); err != nil {
+			return err
+		}
+		if op, ok := binaryOps[e.Op]; ok {
+			c.emit(op, 0)
+			return nil
+		}
+		// user-defined binary operator
+		f, ok := c.funcs[ast.BinaryFunctionName(e.Op)]
+		if !ok {
+			return c.errorf(e.Pos(), "invalid binary operator: %q", e.Op)
+		}
+		c.emit(OpCall, f)
+
+	case *ast.CallExpr:
+		op, index, arity := OpCall, int32(0), 0
+		if f, ok := c.funcs[e.Callee]; ok {
+			index, arity = f, c.prog.Funcs[f].Arity
+		} else if ext, ok := c.externs[e.Callee]; ok {
+			op, index, arity = OpCallExtern, ext, c.prog.Externs[ext].Arity
+		} else {
+			return c.errorf(e.Pos(), "unknown function referenced: %q", e.Callee)
+		}
+		if arity != len(e.Args) {
+			return c.errorf(e.Pos(), "incorrect number of arguments passed for %q. %d expected, but %d given", e.Callee, arity, len(e.Args))
+		}
+		for _, arg := range e.Args {
+			if err := c.compileExpr(arg); err != nil {
+				return err
+			}
+		}
+		c.emit(op, index)
+
+	case *ast.BlockExpr:
+		// a block leaves only the value of the last expression on the stack.
+		if len(e.Exprs) == 0 {
+			c.emit(OpConst, c.constant(0.0))
+		}
+		for i, e := range e.Exprs {
+			if i > 0 {
+				c.emit(OpPop, 0)
+			}
+			if err := c.compileExpr(e); err != nil {
+				return err
+			}
+		}
+
+	case *ast.IfExpr:
+		if err := c.compileExpr(e.Cond); err != nil {
+			return err
+		}
+		toElse := c.emit(OpJumpIfFalse, 0)
+		if err := c.compileExpr(e.Then); err != nil {
+			return err
+		}
+		toEnd := c.emit(OpJump, 0)
+		c.patch(toElse)
+		if err := c.compileExpr(e.Else); err != nil {
+			return err
+		}
+		c.patch(toEnd)
+
+	case *ast.ForExpr:
+		if err := c.compileExpr(e.Start); err != nil {
+			return err
+		}
+		slot := c.newLocal(e.Var)
+		c.emit(OpStore, slot)
+		restore := c.bind(e.Var, slot)
+
+		// the step is kept in a slot that no name is bound to while the end condition is evaluated.
+		stepSlot := c.newLocal(e.Var + ".step")
+		loop := int32(len(c.fun.Code))
+		if err := c.compileExpr(e.Body); err != nil {
+			return err
+		}
+		c.emit(OpPop, 0)
+		if e.Step != nil {
+			if err := c.compileExpr(e.Step); err != nil {
+				return err
+			}
+		} else {
+			c.emit(OpConst, c.constant(1.0))
+		}
+		c.emit(OpStore, stepSlot)
+		if err := c.compileExpr(e.End); err != nil {
+			return err
+		}
+		c.emit(OpLoad, slot)
+		c.emit(OpLoad, stepSlot)
+		c.emit(OpAdd, 0)
+		c.emit(OpStore, slot)
+		c.emit(OpJumpIfTrue, loop)
+
+		restore()
+		c.emit(OpConst, c.constant(0.0))
+
+	case *ast.VarExpr:
+		restores := make([]func(), len(e.Vars))
+		for i, v := range e.Vars {
+			// the initializer is compiled before the name is bound to the new slot.
+			if v.Init != nil {
+				if err := c.compileExpr(v.Init); err != nil {
+					return err
+				}
+			} else {
+				c.emit(OpConst, c.constant(0.0))
+			}
+			slot := c.newLocal(v.Name)
+			c.emit(OpStore, slot)
+			restores[i] = c.bind(v.Name, slot)
+		}
+
+		if err := c.compileExpr(e.Body); err != nil {
+			return err
+		}
+
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+
+	default:
+		panic("internal compiler error")
+	}
+	return nil
+}
+
+// compileAssign compiles an assignment to a mutable variable. The result is the assigned value.
+func (c *compiler) compileAssign(e *ast.BinaryExpr) error {
+	lhs, ok := e.LHS.(*ast.VariableExpr)
+	if !ok {
+		return c.errorf(e.Pos(), "destination of '=' must be a variable")
+	}
+	if err := c.compileExpr(e.RHS); err != nil {
+		return err
+	}
+	slot, ok := c.scopes[lhs.Name]
+	if !ok {
+		return c.errorf(lhs.Pos(), "unknown variable name : %q", lhs.Name)
+	}
+	c.emit(OpDup, 0)
+	c.emit(OpStore, slot)
+	return nil
+}
+
+// compileLogical compiles short-circuit evaluation of "&&" and "||".
+// The right hand side is evaluated only if the left hand side does not decide the result.
+// The result is 0.0 or 1.0.
+func (c *compiler) compileLogical(e *ast.BinaryExpr) error {
+	if err := c.compileExpr(e.LHS); err != nil {
+		return err
+	}
+	// the value of the expression when the right hand side is skipped.
+	jump, short := OpJumpIfFalse, 0.0
+	if e.Op == "||" {
+		jump, short = OpJumpIfTrue, 1.0
+	}
+	toShort := c.emit(jump, 0)
+	if err := c.compileExpr(e.RHS); err != nil {
+		return err
+	}
+	c.emit(OpBool, 0)
+	toEnd := c.emit(OpJump, 0)
+	c.patch(toShort)
+	c.emit(OpConst, c.constant(short))
+	c.patch(toEnd)
+	return nil
+}
@@ -0,0 +1,68 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Disassemble writes the program in a human readable form, e.g.
+//
+//	extern 0 putd/1
+//
+//	func 1 f/1 (main)
+//	  0000  load    0      ; x
+//	  0001  const   0      ; 1
+//	  0002  add
+//	  0003  ret
+func (p *Program) Disassemble(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for i, ext := range p.Externs {
+		fmt.Fprintf(bw, "extern %d %s/%d\n", i, ext.Name, ext.Arity)
+	}
+	for i, f := range p.Funcs {
+		if i > 0 || len(p.Externs) > 0 {
+			fmt.Fprintln(bw)
+		}
+		fmt.Fprintf(bw, "func %d %s/%d", i, f.Name, f.Arity)
+		if i == p.Main {
+			fmt.Fprint(bw, " (main)")
+		}
+		fmt.Fprintln(bw)
+		for pc, in := range f.Code {
+			if !in.Op.hasOperand() {
+				fmt.Fprintf(bw, "  %04d  %s\n", pc, in.Op)
+				continue
+			}
+			fmt.Fprintf(bw, "  %04d  %-6s  %-5d  ; %s\n", pc, in.Op, in.Arg, p.comment(f, in))
+		}
+	}
+	return bw.Flush()
+}
+
+// comment describes the operand of the instruction.
+func (p *Program) comment(f *Function, in Instr) string {
+	i := int(in.Arg)
+	switch in.Op {
+	case OpConst:
+		if i < len(p.Consts) {
+			return strconv.FormatFloat(p.Consts[i], 'g', -1, 64)
+		}
+	case OpLoad, OpStore:
+		if i < len(f.Locals) {
+			return f.Locals[i]
+		}
+	case OpJump, OpJumpIfFalse, OpJumpIfTrue:
+		return fmt.Sprintf("-> %04d", i)
+	case OpCall:
+		if i < len(p.Funcs) {
+			return p.Funcs[i].Name
+		}
+	case OpCallExtern:
+		if i < len(p.Externs) {
+			return p.Externs[i].Name
+		}
+	}
+	return "?"
+}
@@ -0,0 +1,87 @@
+package vm
+
+import "fmt"
+
+// Opcode is an operation of the virtual machine.
+type Opcode byte
+
+// Opcodes. The comments describe the operand and the effect on the stack.
+const (
+	OpConst       Opcode = iota // const index; push the constant
+	OpLoad                      // local slot; push the local variable
+	OpStore                     // local slot; pop a value into the local variable
+	OpDup                       // duplicate the top of the stack
+	OpPop                       // discard the top of the stack
+	OpNeg                       // negate the top of the stack
+	OpNot                       // 0.0 if the top of the stack is true as a condition, 1.0 otherwise
+	OpBool                      // 1.0 if the top of the stack is true as a condition, 0.0 otherwise
+	OpAdd                       // pop r and l, and push l + r
+	OpSub                       // pop r and l, and push l - r
+	OpMul                       // pop r and l, and push l * r
+	OpDiv                       // pop r and l, and push l / r
+	OpRem                       // pop r and l, and push fmod(l, r)
+	OpLT                        // pop r and l, and push l < r as 0.0 or 1.0
+	OpGT                        // pop r and l, and push l > r as 0.0 or 1.0
+	OpLE                        // pop r and l, and push l <= r as 0.0 or 1.0
+	OpGE                        // pop r and l, and push l >= r as 0.0 or 1.0
+	OpEQ                        // pop r and l, and push l == r as 0.0 or 1.0
+	OpNE                        // pop r and l, and push l != r as 0.0 or 1.0
+	OpJump                      // address; jump to the address
+	OpJumpIfFalse               // address; pop a condition, and jump to the address if it is false
+	OpJumpIfTrue                // address; pop a condition, and jump to the address if it is true
+	OpCall                      // function index; call the function with the arguments on the stack
+	OpCallExtern                // extern index; call the extern with the arguments on the stack
+	OpReturn                    // return the top of the stack to the caller
+
+	numOpcodes
+)
+
+var opNames = [...]string{
+	OpConst:       "const",
+	OpLoad:        "load",
+	OpStore:       "store",
+	OpDup:         "dup",
+	OpPop:         "pop",
+	OpNeg:         "neg",
+	OpNot:         "not",
+	OpBool:        "bool",
+	OpAdd:         "add",
+	OpSub:         "sub",
+	OpMul:         "mul",
+	OpDiv:         "div",
+	OpRem:         "rem",
+	OpLT:          "lt",
+	OpGT:          "gt",
+	OpLE:          "le",
+	OpGE:          "ge",
+	OpEQ:          "eq",
+	OpNE:          "ne",
+	OpJump:        "jump",
+	OpJumpIfFalse: "jumpf",
+	OpJumpIfTrue:  "jumpt",
+	OpCall:        "call",
+	OpCallExtern:  "callx",
+	OpReturn:      "ret",
+}
+
+func (op Opcode) String() string {
+	if op < numOpcodes {
+		return opNames[op]
+	}
+	return fmt.Sprintf("op(%d)", byte(op))
+}
+
+// hasOperand reports whether the instruction of op uses its operand.
+func (op Opcode) hasOperand() bool {
+	switch op {
+	case OpConst, OpLoad, OpStore, OpJump, OpJumpIfFalse, OpJumpIfTrue, OpCall, OpCallExtern:
+		return true
+	}
+	return false
+}
+
+// Instr is an instruction of the virtual machine.
+type Instr struct {
+	Op  Opcode
+	Arg int32 // operand; 0 if the opcode has no operand
+}
@@ -0,0 +1,246 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Program is a compiled kaleigo program.
+// It can be serialized with Encode and loaded with Decode.
+type Program struct {
+	Consts  []float64
+	Externs []*Extern
+	Funcs   []*Function
+	Main    int // index of the main function in Funcs
+}
+
+// Extern is an external function, which is resolved by the virtual machine when the program runs.
+type Extern struct {
+	Name  string
+	Arity int
+}
+
+// Function is a compiled function.
+// Its local variable slots start with the arguments.
+type Function struct {
+	Name   string
+	Arity  int
+	Locals []string // names of the local variables, for disassembly
+	Code   []Instr
+}
+
+// magic is the first bytes of an encoded program, followed by the format version.
+const (
+	magic   = "KLBC"
+	version = 1
+)
+
+// Encode writes the program in the binary format.
+// All integers are little endian, and strings are prefixed by their length.
+func (p *Program) Encode(w io.Writer) error {
+	e := &encoder{w: bufio.NewWriter(w)}
+	e.bytes([]byte(magic))
+	e.uint32(version)
+
+	e.uint32(uint32(len(p.Consts)))
+	for _, c := range p.Consts {
+		e.uint64(math.Float64bits(c))
+	}
+	e.uint32(uint32(len(p.Externs)))
+	for _, ext := range p.Externs {
+		e.string(ext.Name)
+		e.uint32(uint32(ext.Arity))
+	}
+	e.uint32(uint32(len(p.Funcs)))
+	for _, f := range p.Funcs {
+		e.string(f.Name)
+		e.uint32(uint32(f.Arity))
+		e.uint32(uint32(len(f.Locals)))
+		for _, l := range f.Locals {
+			e.string(l)
+		}
+		e.uint32(uint32(len(f.Code)))
+		for _, in := range f.Code {
+			e.bytes([]byte{byte(in.Op)})
+			e.uint32(uint32(in.Arg))
+		}
+	}
+	e.uint32(uint32(p.Main))
+
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+type encoder struct {
+	w   *bufio.Writer
+	buf [8]byte
+	err error
+}
+
+func (e *encoder) bytes(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (e *encoder) uint32(v uint32) {
+	binary.LittleEndian.PutUint32(e.buf[:4], v)
+	e.bytes(e.buf[:4])
+}
+
+func (e *encoder) uint64(v uint64) {
+	binary.LittleEndian.PutUint64(e.buf[:8], v)
+	e.bytes(e.buf[:8])
+}
+
+func (e *encoder) string(s string) {
+	e.uint32(uint32(len(s)))
+	e.bytes([]byte(s))
+}
+
+// errBadFormat is returned by Decode for input that is not an encoded program.
+var errBadFormat = errors.New("not a kaleigo bytecode file")
+
+// maxLength limits the lengths in an encoded program, to reject broken input
+// before allocating memory for it.
+const maxLength = 1 << 24
+
+// Decode reads a program written by Encode, and checks that it is well-formed.
+func Decode(r io.Reader) (*Program, error) {
+	d := &decoder{r: bufio.NewReader(r)}
+	head := make([]byte, len(magic))
+	d.bytes(head)
+	if d.err != nil || string(head) != magic {
+		return nil, errBadFormat
+	}
+	if v := d.uint32(); d.err == nil && v != version {
+		return nil, fmt.Errorf("unsupported bytecode version %d", v)
+	}
+
+	p := &Program{}
+	p.Consts = make([]float64, d.length())
+	for i := range p.Consts {
+		p.Consts[i] = math.Float64frombits(d.uint64())
+	}
+	p.Externs = make([]*Extern, d.length())
+	for i := range p.Externs {
+		p.Externs[i] = &Extern{Name: d.string(), Arity: int(d.uint32())}
+	}
+	p.Funcs = make([]*Function, d.length())
+	for i := range p.Funcs {
+		f := &Function{Name: d.string(), Arity: int(d.uint32())}
+		f.Locals = make([]string, d.length())
+		for j := range f.Locals {
+			f.Locals[j] = d.string()
+		}
+		f.Code = make([]Instr, d.length())
+		for j := range f.Code {
+			var op [1]byte
+			d.bytes(op[:])
+			f.Code[j] = Instr{Op: Opcode(op[0]), Arg: int32(d.uint32())}
+		}
+		p.Funcs[i] = f
+	}
+	p.Main = int(d.uint32())
+
+	if d.err != nil {
+		if d.err == io.EOF || d.err == io.ErrUnexpectedEOF {
+			return nil, errBadFormat
+		}
+		return nil, d.err
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+type decoder struct {
+	r   *bufio.Reader
+	buf [8]byte
+	err error
+}
+
+func (d *decoder) bytes(b []byte) {
+	if d.err == nil {
+		_, d.err = io.ReadFull(d.r, b)
+	}
+}
+
+func (d *decoder) uint32() uint32 {
+	d.bytes(d.buf[:4])
+	if d.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(d.buf[:4])
+}
+
+func (d *decoder) uint64() uint64 {
+	d.bytes(d.buf[:8])
+	if d.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(d.buf[:8])
+}
+
+// length reads the length of a list or a string.
+func (d *decoder) length() int {
+	n := d.uint32()
+	if n > maxLength {
+		d.err = errBadFormat
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) string() string {
+	b := make([]byte, d.length())
+	d.bytes(b)
+	return string(b)
+}
+
+// validate checks that all operands of the instructions are in range, so that
+// the virtual machine can run the program without checking them.
+func (p *Program) validate() error {
+	if p.Main < 0 || p.Main >= len(p.Funcs) || p.Funcs[p.Main].Arity != 0 {
+		return fmt.Errorf("invalid main function index %d", p.Main)
+	}
+	for _, f := range p.Funcs {
+		if f.Arity < 0 || f.Arity > len(f.Locals) {
+			return fmt.Errorf("%s: invalid number of arguments %d", f.Name, f.Arity)
+		}
+		if len(f.Code) == 0 || f.Code[len(f.Code)-1].Op != OpReturn {
+			return fmt.Errorf("%s: function does not end with %s", f.Name, OpReturn)
+		}
+		for pc, in := range f.Code {
+			var limit int
+			switch in.Op {
+			case OpConst:
+				limit = len(p.Consts)
+			case OpLoad, OpStore:
+				limit = len(f.Locals)
+			case OpJump, OpJumpIfFalse, OpJumpIfTrue:
+				limit = len(f.Code)
+			case OpCall:
+				limit = len(p.Funcs)
+			case OpCallExtern:
+				limit = len(p.Externs)
+			default:
+				if in.Op >= numOpcodes {
+					return fmt.Errorf("%s:%04d: invalid opcode %d", f.Name, pc, byte(in.Op))
+				}
+				continue
+			}
+			if in.Arg < 0 || int(in.Arg) >= limit {
+				return fmt.Errorf("%s:%04d: operand of %s out of range: %d", f.Name, pc, in.Op, in.Arg)
+			}
+		}
+	}
+	return nil
+}
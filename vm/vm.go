@@ -0,0 +1,193 @@
+package vm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+
+	"github.com/agatan/kaleigo/builtins"
+)
+
+// maxFrames limits the depth of calls, so that infinite recursion fails instead of exhausting memory.
+const maxFrames = 1 << 20
+
+// errStackOverflow is returned when a program exceeds maxFrames.
+var errStackOverflow = errors.New("stack overflow")
+
+// frame is the state of a function call.
+type frame struct {
+	fun  *Function
+	pc   int
+	base int // index of the first local variable in the stack
+}
+
+// VM is a stack based virtual machine that runs compiled programs.
+type VM struct {
+	out *bufio.Writer
+}
+
+// New creates a new virtual machine. The output of putd and putchard is written to out.
+func New(out io.Writer) *VM {
+	return &VM{out: bufio.NewWriter(out)}
+}
+
+// truthy reports whether v is true as a condition, i.e. it is neither 0.0 nor NaN.
+func truthy(v float64) bool {
+	return v != 0.0 && !math.IsNaN(v)
+}
+
+// boolean converts b to 0.0 or 1.0.
+func boolean(b bool) float64 {
+	if b {
+		return 1.0
+	}
+	return 0.0
+}
+
+// Run runs the main function of the program, and returns its value.
+// Externs are resolved to the functions in package builtins. Compile has checked them already,
+// so only a decoded program can fail to resolve.
+func (m *VM) Run(p *Program) (result float64, err error) {
+	defer func() {
+		if ferr := m.out.Flush(); err == nil {
+			err = ferr
+		}
+	}()
+	// Decode does not check the stack usage of the code, so a broken program may underflow the stack.
+	defer func() {
+		if e := recover(); e != nil {
+			rerr, ok := e.(runtime.Error)
+			if !ok {
+				panic(e)
+			}
+			result, err = 0, fmt.Errorf("broken program: %v", rerr)
+		}
+	}()
+
+	externs := make([]*builtins.Func, len(p.Externs))
+	for i, ext := range p.Externs {
+		f, err := builtins.Resolve(ext.Name, ext.Arity)
+		if err != nil {
+			return 0, err
+		}
+		externs[i] = f
+	}
+
+	// the stack holds the local variables of all frames, each followed by the operands of the frame.
+	stack := make([]float64, 0, 1024)
+	frames := make([]frame, 0, 64)
+
+	call := func(f *Function) error {
+		if len(frames) == maxFrames {
+			return errStackOverflow
+		}
+		base := len(stack) - f.Arity
+		for len(stack) < base+len(f.Locals) {
+			stack = append(stack, 0.0)
+		}
+		frames = append(frames, frame{fun: f, base: base})
+		return nil
+	}
+	if err := call(p.Funcs[p.Main]); err != nil {
+		return 0, err
+	}
+	fr := &frames[0]
+
+	for {
+		in := fr.fun.Code[fr.pc]
+		fr.pc++
+		top := len(stack) - 1
+
+		switch in.Op {
+		case OpConst:
+			stack = append(stack, p.Consts[in.Arg])
+		case OpLoad:
+			stack = append(stack, stack[fr.base+int(in.Arg)])
+		case OpStore:
+			stack[fr.base+int(in.Arg)] = stack[top]
+			stack = stack[:top]
+		case OpDup:
+			stack = append(stack, stack[top])
+		case OpPop:
+			stack = stack[:top]
+		case OpNeg:
+			stack[top] = -stack[top]
+		case OpNot:
+			stack[top] = boolean(!truthy(stack[top]))
+		case OpBool:
+			stack[top] = boolean(truthy(stack[top]))
+
+		case OpAdd, OpSub, OpMul, OpDiv, OpRem, OpLT, OpGT, OpLE, OpGE, OpEQ, OpNE:
+			l, r := stack[top-1], stack[top]
+			stack = stack[:top]
+			stack[top-1] = arith(in.Op, l, r)
+
+		case OpJump:
+			fr.pc = int(in.Arg)
+		case OpJumpIfFalse:
+			if !truthy(stack[top]) {
+				fr.pc = int(in.Arg)
+			}
+			stack = stack[:top]
+		case OpJumpIfTrue:
+			if truthy(stack[top]) {
+				fr.pc = int(in.Arg)
+			}
+			stack = stack[:top]
+
+		case OpCall:
+			if err := call(p.Funcs[in.Arg]); err != nil {
+				return 0, err
+			}
+			fr = &frames[len(frames)-1]
+		case OpCallExtern:
+			f := externs[in.Arg]
+			base := len(stack) - f.Arity
+			v := f.Call(m.out, stack[base:])
+			stack = append(stack[:base], v)
+
+		case OpReturn:
+			v := stack[top]
+			stack = append(stack[:fr.base], v)
+			frames = frames[:len(frames)-1]
+			if len(frames) == 0 {
+				return v, nil
+			}
+			fr = &frames[len(frames)-1]
+
+		default:
+			return 0, fmt.Errorf("%s:%04d: invalid opcode %d", fr.fun.Name, fr.pc-1, byte(in.Op))
+		}
+	}
+}
+
+// arith applies the arithmetic or comparison operator.
+func arith(op Opcode, l, r float64) float64 {
+	switch op {
+	case OpAdd:
+		return l + r
+	case OpSub:
+		return l - r
+	case OpMul:
+		return l * r
+	case OpDiv:
+		return l / r
+	case OpRem:
+		return math.Mod(l, r)
+	case OpLT:
+		return boolean(!(l >= r))
+	case OpGT:
+		return boolean(!(l <= r))
+	case OpLE:
+		return boolean(!(l > r))
+	case OpGE:
+		return boolean(!(l < r))
+	case OpEQ:
+		return boolean(l == r)
+	default: // OpNE
+		return boolean(l != r)
+	}
+}
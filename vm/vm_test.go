@@ -0,0 +1,192 @@
+package vm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/agatan/kaleigo/interp"
+	"github.com/agatan/kaleigo/parse"
+)
+
+func compile(t *testing.T, src string) *Program {
+	f, err := parse.New("test", src).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Compile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+var programs = []string{
+	"1 + 2 * 3",
+	"10 - 4 - 3",
+	"7 / 2",
+	"7 % 4",
+	"-(1 + 2)",
+	"1 < 2; 2 <= 1; 3 == 3; 3 != 3; 2 > 1; 1 >= 2",
+	"!0; !3",
+	"!(0/0); (0/0) || !(0/0)",
+	"1 && 0; 0 || 2; 2 && 3; 0 || 0",
+	"if 1 < 2 then 10 else 20",
+	"var a = 1, b in b = a + 1",
+	"var x = 2 in (var x = x * 3 in x) + x",
+	"def f(x) x * x\nf(3) + f(4)",
+	"def binary| 5 (a b) if a then 1 else if b then 1 else 0\n0 | 1 + 1",
+	"def unary~(v) 0 - v\n~2 * 3",
+	"extern pow(x, y)\npow(2, 10)",
+	"extern f(x)\ndef f(x) x + 1\nf(2)",
+	"extern sin(x)\ndef sin(x) x * 2\nsin(2)",
+	"def fib(x) if x < 3 then 1 else fib(x-1) + fib(x-2)\nfib(15)",
+	"def binary& 1 (x y) y\n" +
+		"def fibi(x) var a = 1, b = 1, c in (for i = 3, i < x in c = a + b & a = b & b = c) & b\nfibi(11)",
+	"def even(n) if n == 0 then 1 else odd(n - 1)\ndef odd(n) if n == 0 then 0 else even(n - 1)\neven(10) + odd(7)",
+	"extern putd(x)\nfor i = 0, i < 3, 0.5 in putd(i)",
+	"extern putchard(c)\ndef binary& 1 (x y) y\ndef side(x) putchard(x) & 1\n0 && side(65); 1 && side(66); 1 || side(67); 0 || side(68)",
+	"",
+}
+
+// TestRunAgainstInterp checks that the virtual machine agrees with the tree-walking interpreter.
+func TestRunAgainstInterp(t *testing.T) {
+	for _, src := range programs {
+		f, err := parse.New("test", src).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expectedOut bytes.Buffer
+		expected, err := interp.New(&expectedOut).Run(f)
+		if err != nil {
+			t.Fatalf("%q: %s", src, err)
+		}
+
+		var out bytes.Buffer
+		actual, err := New(&out).Run(compile(t, src))
+		if err != nil {
+			t.Errorf("%q: %s", src, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("%q: expected %f, actual %f", src, expected, actual)
+		}
+		if out.String() != expectedOut.String() {
+			t.Errorf("%q: expected output %q, actual %q", src, expectedOut.String(), out.String())
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	cases := []struct {
+		src string
+		msg string
+	}{
+		{"x + 1", `test:1:1: unknown variable name : "x"`},
+		{"f(1)", `test:1:1: unknown function referenced: "f"`},
+		{"def f(x) x\n1 + f(1, 2)", `test:2:5: incorrect number of arguments passed for "f". 1 expected, but 2 given`},
+		{"def f(x) (var y in y) + y", `test:1:25: unknown variable name : "y"`},
+		{"def f(x) y = 1", `test:1:10: unknown variable name : "y"`},
+		{"extern printf(x)", `test:1:8: unresolved external function: "printf"`},
+		{"extern sin(x, y)", `test:1:8: external function "sin" takes 1 arguments, but declared with 2`},
+	}
+	for _, c := range cases {
+		f, err := parse.New("test", c.src).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Compile(f)
+		if err == nil || err.Error() != c.msg {
+			t.Errorf("wrong error for %q: expected %q, actual %v", c.src, c.msg, err)
+		}
+	}
+}
+
+func TestRunError(t *testing.T) {
+	cases := []struct {
+		src string
+		msg string
+	}{
+		{"def f(x) f(x + 1)\nf(0)", `stack overflow`},
+	}
+	for _, c := range cases {
+		_, err := New(&bytes.Buffer{}).Run(compile(t, c.src))
+		if err == nil || err.Error() != c.msg {
+			t.Errorf("wrong error for %q: expected %q, actual %v", c.src, c.msg, err)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	for _, src := range programs {
+		p := compile(t, src)
+		var buf bytes.Buffer
+		if err := p.Encode(&buf); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Decode(&buf)
+		if err != nil {
+			t.Fatalf("%q: %s", src, err)
+		}
+
+		var expected, actual bytes.Buffer
+		p.Disassemble(&expected)
+		decoded.Disassemble(&actual)
+		if expected.String() != actual.String() {
+			t.Errorf("%q: decoded program differs:\n%s\nexpected:\n%s", src, actual.String(), expected.String())
+		}
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	var buf bytes.Buffer
+	if err := compile(t, "def f(x) x\nf(1)").Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	cases := []struct {
+		name  string
+		input []byte
+		msg   string
+	}{
+		{"empty", nil, "not a kaleigo bytecode file"},
+		{"bad magic", []byte("ELF\x7f"), "not a kaleigo bytecode file"},
+		{"truncated", encoded[:len(encoded)-3], "not a kaleigo bytecode file"},
+		{"bad main", append(append([]byte{}, encoded[:len(encoded)-4]...), 9, 0, 0, 0), "invalid main function index 9"},
+	}
+	for _, c := range cases {
+		_, err := Decode(bytes.NewReader(c.input))
+		if err == nil || err.Error() != c.msg {
+			t.Errorf("%s: expected %q, actual %v", c.name, c.msg, err)
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	p := compile(t, "extern putd(x)\ndef f(x) if x < 1 then putd(x) else 1\nf(2)")
+	var buf bytes.Buffer
+	if err := p.Disassemble(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `extern 0 putd/1
+
+func 0 f/1
+  0000  load    0      ; x
+  0001  const   0      ; 1
+  0002  lt
+  0003  jumpf   7      ; -> 0007
+  0004  load    0      ; x
+  0005  callx   0      ; putd
+  0006  jump    8      ; -> 0008
+  0007  const   0      ; 1
+  0008  ret
+
+func 1 __kaleigo_main/0 (main)
+  0000  const   1      ; 2
+  0001  call    0      ; f
+  0002  ret
+`
+	if buf.String() != expected {
+		t.Errorf("wrong disassembly:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
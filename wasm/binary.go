@@ -0,0 +1,138 @@
+package wasm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Section ids of the binary format.
+const (
+	sectionType     = 1
+	sectionImport   = 2
+	sectionFunction = 3
+	sectionExport   = 7
+	sectionCode     = 10
+)
+
+// Encodings of the binary format.
+const (
+	valueF64     = 0x7c
+	blockEmpty   = 0x40
+	funcTypeForm = 0x60
+	externFunc   = 0x00
+)
+
+// WriteBinary writes the module in the WebAssembly binary format.
+func (m *Module) WriteBinary(w io.Writer) error {
+	var b bytes.Buffer
+	b.WriteString("\x00asm")
+	b.Write([]byte{1, 0, 0, 0})
+
+	writeSection(&b, sectionType, len(m.types), func(s *bytes.Buffer) {
+		for _, arity := range m.types {
+			s.WriteByte(funcTypeForm)
+			writeUint(s, uint32(arity))
+			for i := 0; i < arity; i++ {
+				s.WriteByte(valueF64)
+			}
+			writeUint(s, 1)
+			s.WriteByte(valueF64)
+		}
+	})
+
+	writeSection(&b, sectionImport, len(m.imports), func(s *bytes.Buffer) {
+		for _, f := range m.imports {
+			writeName(s, ImportModule)
+			writeName(s, f.name)
+			s.WriteByte(externFunc)
+			writeUint(s, f.typ)
+		}
+	})
+
+	writeSection(&b, sectionFunction, len(m.funcs), func(s *bytes.Buffer) {
+		for _, f := range m.funcs {
+			writeUint(s, f.typ)
+		}
+	})
+
+	writeSection(&b, sectionExport, 1, func(s *bytes.Buffer) {
+		writeName(s, m.function(m.main).name)
+		s.WriteByte(externFunc)
+		writeUint(s, m.main)
+	})
+
+	writeSection(&b, sectionCode, len(m.funcs), func(s *bytes.Buffer) {
+		for _, f := range m.funcs {
+			var body bytes.Buffer
+			if len(f.locals) == 0 {
+				writeUint(&body, 0)
+			} else {
+				// all the locals are f64, so a single entry declares them.
+				writeUint(&body, 1)
+				writeUint(&body, uint32(len(f.locals)))
+				body.WriteByte(valueF64)
+			}
+			for _, in := range f.code {
+				writeInstr(&body, in)
+			}
+			body.WriteByte(byte(opEnd))
+
+			writeUint(s, uint32(body.Len()))
+			body.WriteTo(s)
+		}
+	})
+
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// writeSection writes a section of count entries, which are written by contents.
+// Empty sections are omitted.
+func writeSection(b *bytes.Buffer, id byte, count int, contents func(*bytes.Buffer)) {
+	if count == 0 {
+		return
+	}
+	var s bytes.Buffer
+	writeUint(&s, uint32(count))
+	contents(&s)
+
+	b.WriteByte(id)
+	writeUint(b, uint32(s.Len()))
+	s.WriteTo(b)
+}
+
+func writeInstr(b *bytes.Buffer, in instr) {
+	b.WriteByte(byte(in.op))
+	switch in.op {
+	case opIf:
+		b.WriteByte(valueF64)
+	case opLoop:
+		b.WriteByte(blockEmpty)
+	case opBrIf, opCall, opLocalGet, opLocalSet, opLocalTee:
+		writeUint(b, in.index)
+	case opF64Const:
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(in.value))
+		b.Write(buf[:])
+	}
+}
+
+// writeUint writes v in unsigned LEB128.
+func writeUint(b *bytes.Buffer, v uint32) {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			b.WriteByte(c)
+			return
+		}
+		b.WriteByte(c | 0x80)
+	}
+}
+
+func writeName(b *bytes.Buffer, name string) {
+	writeUint(b, uint32(len(name)))
+	b.WriteString(name)
+}
@@ -0,0 +1,424 @@
+package wasm
+
+import "github.com/agatan/kaleigo/ast"
+
+// compiler holds the state of compilation of a file.
+type compiler struct {
+	filename string
+	module   *Module
+	funcs    map[string]uint32 // function indices by kaleigo name
+	fmod     uint32            // function index of the import of fmodName
+
+	// state of the function being compiled
+	fn     *function
+	values map[string]uint32 // local indices of the variables in scope
+}
+
+// Compile compiles the file into a module.
+// It reports unknown variables and functions, and calls with wrong numbers of arguments,
+// as codegen does.
+func Compile(fileast *ast.File) (*Module, error) {
+	c := &compiler{
+		filename: fileast.Name,
+		module:   &Module{},
+		funcs:    make(map[string]uint32),
+	}
+	m := c.module
+
+	main := fileast.CreateMain()
+	defs := append(fileast.Defs[:len(fileast.Defs):len(fileast.Defs)], main)
+	defined := make(map[string]bool)
+	for _, def := range defs {
+		if defined[def.Name] {
+			return nil, c.errorf(def.Prototype.Pos(), "redefinition of function %q", def.Name)
+		}
+		defined[def.Name] = true
+	}
+
+	// imports come first in the function index space. Externs of defined functions refer
+	// to the definitions, and are not imported.
+	arities := make(map[string]int)
+	for _, extern := range fileast.Externs {
+		if arity, ok := arities[extern.Name]; ok {
+			if arity != len(extern.Args) {
+				return nil, c.errorf(extern.Pos(), "external function %q is redeclared with %d arguments", extern.Name, len(extern.Args))
+			}
+			continue
+		}
+		arities[extern.Name] = len(extern.Args)
+		if !defined[extern.Name] {
+			c.funcs[extern.Name] = c.addImport(extern.Name, extern.Args)
+		}
+	}
+	// fmod is not in funcs, so that it does not collide with user functions of any name.
+	if usesRem(defs) {
+		c.fmod = c.addImport(fmodName, []string{"x", "y"})
+	}
+
+	for _, def := range defs {
+		if arity, ok := arities[def.Name]; ok && arity != len(def.Args) {
+			return nil, c.errorf(def.Prototype.Pos(), "function %q is defined with %d arguments, but declared with %d", def.Name, len(def.Args), arity)
+		}
+		c.funcs[def.Name] = uint32(len(m.imports) + len(m.funcs))
+		m.funcs = append(m.funcs, &function{
+			name:   def.Name,
+			typ:    m.typeIndex(len(def.Args)),
+			params: def.Args,
+		})
+	}
+	m.main = c.funcs[main.Name]
+
+	for i, def := range defs {
+		if err := c.compileFunction(m.funcs[i], def); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// addImport adds a function import, and returns its function index.
+func (c *compiler) addImport(name string, params []string) uint32 {
+	c.module.imports = append(c.module.imports, &function{
+		name:   name,
+		typ:    c.module.typeIndex(len(params)),
+		params: params,
+	})
+	return uint32(len(c.module.imports) - 1)
+}
+
+// usesRem reports whether any of the functions uses '%', which needs the imported fmod.
+func usesRem(defs []*ast.Function) bool {
+	for _, def := range defs {
+		if exprUsesRem(def.Body) {
+			return true
+		}
+	}
+	return false
+}
+
+func exprUsesRem(expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.UnaryExpr:
+		return exprUsesRem(e.Operand)
+	case *ast.BinaryExpr:
+		return e.Op == "%" || exprUsesRem(e.LHS) || exprUsesRem(e.RHS)
+	case *ast.CallExpr:
+		for _, arg := range e.Args {
+			if exprUsesRem(arg) {
+				return true
+			}
+		}
+	case *ast.BlockExpr:
+		for _, e := range e.Exprs {
+			if exprUsesRem(e) {
+				return true
+			}
+		}
+	case *ast.IfExpr:
+		return exprUsesRem(e.Cond) || exprUsesRem(e.Then) || exprUsesRem(e.Else)
+	case *ast.ForExpr:
+		return exprUsesRem(e.Start) || exprUsesRem(e.End) || e.Step != nil && exprUsesRem(e.Step) || exprUsesRem(e.Body)
+	case *ast.VarExpr:
+		for _, v := range e.Vars {
+			if v.Init != nil && exprUsesRem(v.Init) {
+				return true
+			}
+		}
+		return exprUsesRem(e.Body)
+	}
+	return false
+}
+
+// errorf returns an error located at pos.
+func (c *compiler) errorf(pos ast.Pos, format string, args ...interface{}) error {
+	return ast.Errorf(c.filename, pos, format, args...)
+}
+
+func (c *compiler) compileFunction(fn *function, def *ast.Function) error {
+	c.fn = fn
+	c.values = make(map[string]uint32)
+	for i, arg := range def.Args {
+		c.values[arg] = uint32(i)
+	}
+	return c.compileExpr(def.Body)
+}
+
+// emit appends an instruction to the function being compiled.
+func (c *compiler) emit(op opcode, index uint32) {
+	c.fn.code = append(c.fn.code, instr{op: op, index: index})
+}
+
+// emitConst appends an f64.const instruction.
+func (c *compiler) emitConst(v float64) {
+	c.fn.code = append(c.fn.code, instr{op: opF64Const, value: v})
+}
+
+// emitTruthy converts the f64 on the stack into an i32 condition, which is true if the value is
+// neither zero nor NaN.
+func (c *compiler) emitTruthy() {
+	c.emit(opF64Abs, 0)
+	c.emitConst(0)
+	c.emit(opF64Gt, 0)
+}
+
+// newLocal adds a local variable to the function being compiled, and returns its index.
+func (c *compiler) newLocal(name string) uint32 {
+	c.fn.locals = append(c.fn.locals, name)
+	return uint32(len(c.fn.params) + len(c.fn.locals) - 1)
+}
+
+// bind binds the name to the local, and returns a function that restores the previous binding.
+func (c *compiler) bind(name string, index uint32) (restore func()) {
+	old, exists := c.values[name]
+	c.values[name] = index
+	return func() {
+		if exists {
+			c.values[name] = old
+		} else {
+			delete(c.values, name)
+		}
+	}
+}
+
+// comparisons are the instructions of the comparison operators. The ones other than "==" negate
+// the opposite comparison, which is false if either operand is NaN.
+var comparisons = map[string][]opcode{
+	"<":  {opF64Ge, opI32Eqz},
+	">":  {opF64Le, opI32Eqz},
+	"<=": {opF64Gt, opI32Eqz},
+	">=": {opF64Lt, opI32Eqz},
+	"==": {opF64Eq},
+	"!=": {opF64Ne},
+}
+
+var arithmetics = map[string]opcode{
+	"+": opF64Add,
+	"-": opF64Sub,
+	"*": opF64Mul,
+	"/": opF64Div,
+}
+
+// compileExpr appends the instructions that push the value of the expression.
+func (c *compiler) compileExpr(expr ast.Expr) error {
+	switch e := expr.(type) {
+	case *ast.ErrorExpr:
+		return c.errorf(e.Pos(), "invalid expression")
+	case *ast.NumberExpr:
+		c.emitConst(e.Val)
+	case *ast.StringExpr:
+		return c.errorf(e.Pos(), "strings are not supported in WebAssembly")
+	case *ast.VariableExpr:
+		index, ok := c.values[e.Name]
+		if !ok {
+			return c.errorf(e.Pos(), "unknown variable name : %q", e.Name)
+		}
+		c.emit(opLocalGet, index)
+	case *ast.UnaryExpr:
+		if err := c.compileExpr(e.Operand); err != nil {
+			return err
+		}
+		switch e.Op {
+		case "-":
+			c.emit(opF64Neg, 0)
+			return nil
+		case "!":
+			c.emitTruthy()
+			c.emit(opI32Eqz, 0)
+			c.emit(opF64ConvertI32, 0)
+			return nil
+		}
+		// user-defined unary operator
+		index, ok := c.funcs[ast.UnaryFunctionName(e.Op)]
+		if !ok {
+			return c.errorf(e.Pos(), "unknown unary operator: %q", e.Op)
+		}
+		c.emit(opCall, index)
+
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case "&&", "||":
+			return c.compileLogical(e)
+		case "=":
+			return c.compileAssign(e)
+		}
+		if err := c.compileExpr(e.LHS); err != nil {
+			return err
+		}
+		if err := c.compileExpr(e.RHS); err != nil {
+			return err
+		}
+		if op, ok := arithmetics[e.Op]; ok {
+			c.emit(op, 0)
+			return nil
+		}
+		if e.Op == "%" {
+			c.emit(opCall, c.fmod)
+			return nil
+		}
+		if ops, ok := comparisons[e.Op]; ok {
+			for _, op := range ops {
+				c.emit(op, 0)
+			}
+			c.emit(opF64ConvertI32, 0)
+			return nil
+		}
+		// user-defined binary operator
+		index, ok := c.funcs[ast.BinaryFunctionName(e.Op)]
+		if !ok {
+			return c.errorf(e.Pos(), "invalid binary operator: %q", e.Op)
+		}
+		c.emit(opCall, index)
+
+	case *ast.CallExpr:
+		index, ok := c.funcs[e.Callee]
+		if !ok {
+			return c.errorf(e.Pos(), "unknown function referenced: %q", e.Callee)
+		}
+		if arity := len(c.module.function(index).params); arity != len(e.Args) {
+			return c.errorf(e.Pos(), "incorrect number of arguments passed for %q. %d expected, but %d given", e.Callee, arity, len(e.Args))
+		}
+		for _, arg := range e.Args {
+			if err := c.compileExpr(arg); err != nil {
+				return err
+			}
+		}
+		c.emit(opCall, index)
+
+	case *ast.BlockExpr:
+		// every expression pushes one f64, and the ones before the last are dropped.
+		if len(e.Exprs) == 0 {
+			c.emitConst(0)
+		}
+		for i, e := range e.Exprs {
+			if i > 0 {
+				c.emit(opDrop, 0)
+			}
+			if err := c.compileExpr(e); err != nil {
+				return err
+			}
+		}
+
+	case *ast.IfExpr:
+		if err := c.compileExpr(e.Cond); err != nil {
+			return err
+		}
+		c.emitTruthy()
+		c.emit(opIf, 0)
+		if err := c.compileExpr(e.Then); err != nil {
+			return err
+		}
+		c.emit(opElse, 0)
+		if err := c.compileExpr(e.Else); err != nil {
+			return err
+		}
+		c.emit(opEnd, 0)
+
+	case *ast.ForExpr:
+		if err := c.compileExpr(e.Start); err != nil {
+			return err
+		}
+		v := c.newLocal(e.Var)
+		c.emit(opLocalSet, v)
+		restore := c.bind(e.Var, v)
+
+		// the step is kept in a local that no name is bound to while the end condition is evaluated.
+		step := c.newLocal(e.Var + ".step")
+		c.emit(opLoop, 0)
+		if err := c.compileExpr(e.Body); err != nil {
+			return err
+		}
+		c.emit(opDrop, 0)
+		if e.Step != nil {
+			if err := c.compileExpr(e.Step); err != nil {
+				return err
+			}
+		} else {
+			c.emitConst(1)
+		}
+		c.emit(opLocalSet, step)
+		if err := c.compileExpr(e.End); err != nil {
+			return err
+		}
+		c.emitTruthy()
+		c.emit(opLocalGet, v)
+		c.emit(opLocalGet, step)
+		c.emit(opF64Add, 0)
+		c.emit(opLocalSet, v)
+		c.emit(opBrIf, 0)
+		c.emit(opEnd, 0)
+
+		restore()
+		c.emitConst(0)
+
+	case *ast.VarExpr:
+		restores := make([]func(), len(e.Vars))
+		for i, v := range e.Vars {
+			// the initializer is compiled while the name still refers to the outer local.
+			if v.Init != nil {
+				if err := c.compileExpr(v.Init); err != nil {
+					return err
+				}
+			} else {
+				c.emitConst(0)
+			}
+			index := c.newLocal(v.Name)
+			c.emit(opLocalSet, index)
+			restores[i] = c.bind(v.Name, index)
+		}
+
+		if err := c.compileExpr(e.Body); err != nil {
+			return err
+		}
+
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+
+	default:
+		panic("internal compiler error")
+	}
+	return nil
+}
+
+// compileAssign compiles an assignment to a mutable variable. The result is the assigned value.
+func (c *compiler) compileAssign(e *ast.BinaryExpr) error {
+	lhs, ok := e.LHS.(*ast.VariableExpr)
+	if !ok {
+		return c.errorf(e.Pos(), "destination of '=' must be a variable")
+	}
+	if err := c.compileExpr(e.RHS); err != nil {
+		return err
+	}
+	index, ok := c.values[lhs.Name]
+	if !ok {
+		return c.errorf(lhs.Pos(), "unknown variable name : %q", lhs.Name)
+	}
+	c.emit(opLocalTee, index)
+	return nil
+}
+
+// compileLogical compiles short-circuit evaluation of "&&" and "||".
+// The right hand side is evaluated only if the left hand side does not decide the result.
+// The result is 0.0 or 1.0.
+func (c *compiler) compileLogical(e *ast.BinaryExpr) error {
+	if err := c.compileExpr(e.LHS); err != nil {
+		return err
+	}
+	c.emitTruthy()
+	c.emit(opIf, 0)
+	if e.Op == "||" {
+		c.emitConst(1)
+		c.emit(opElse, 0)
+	}
+	if err := c.compileExpr(e.RHS); err != nil {
+		return err
+	}
+	c.emitTruthy()
+	c.emit(opF64ConvertI32, 0)
+	if e.Op == "&&" {
+		c.emit(opElse, 0)
+		c.emitConst(0)
+	}
+	c.emit(opEnd, 0)
+	return nil
+}
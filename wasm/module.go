@@ -0,0 +1,117 @@
+// Package wasm compiles kaleigo programs into WebAssembly modules.
+//
+// Every kaleigo value is an f64. Externs become function imports from the "env" module,
+// and __kaleigo_main is exported. lib/runtime.js provides putd, putchard and the math
+// functions to the modules in JavaScript hosts.
+package wasm
+
+// ImportModule is the module name of all imported functions.
+const ImportModule = "env"
+
+// fmodName is the imported function that implements '%', which WebAssembly has no instruction for.
+// It is distinct from the fmod of the C math library, which externs may import.
+const fmodName = "__kaleigo_fmod"
+
+// opcode is a WebAssembly instruction opcode.
+type opcode byte
+
+// Opcodes of the instructions used by the compiler.
+const (
+	opLoop          opcode = 0x03
+	opIf            opcode = 0x04
+	opElse          opcode = 0x05
+	opEnd           opcode = 0x0b
+	opBrIf          opcode = 0x0d
+	opCall          opcode = 0x10
+	opDrop          opcode = 0x1a
+	opLocalGet      opcode = 0x20
+	opLocalSet      opcode = 0x21
+	opLocalTee      opcode = 0x22
+	opF64Const      opcode = 0x44
+	opI32Eqz        opcode = 0x45
+	opF64Eq         opcode = 0x61
+	opF64Ne         opcode = 0x62
+	opF64Lt         opcode = 0x63
+	opF64Gt         opcode = 0x64
+	opF64Le         opcode = 0x65
+	opF64Ge         opcode = 0x66
+	opF64Abs        opcode = 0x99
+	opF64Neg        opcode = 0x9a
+	opF64Add        opcode = 0xa0
+	opF64Sub        opcode = 0xa1
+	opF64Mul        opcode = 0xa2
+	opF64Div        opcode = 0xa3
+	opF64ConvertI32 opcode = 0xb8 // f64.convert_i32_u
+)
+
+var opNames = map[opcode]string{
+	opLoop:          "loop",
+	opIf:            "if (result f64)",
+	opElse:          "else",
+	opEnd:           "end",
+	opBrIf:          "br_if",
+	opCall:          "call",
+	opDrop:          "drop",
+	opLocalGet:      "local.get",
+	opLocalSet:      "local.set",
+	opLocalTee:      "local.tee",
+	opF64Const:      "f64.const",
+	opI32Eqz:        "i32.eqz",
+	opF64Eq:         "f64.eq",
+	opF64Ne:         "f64.ne",
+	opF64Lt:         "f64.lt",
+	opF64Gt:         "f64.gt",
+	opF64Le:         "f64.le",
+	opF64Ge:         "f64.ge",
+	opF64Abs:        "f64.abs",
+	opF64Neg:        "f64.neg",
+	opF64Add:        "f64.add",
+	opF64Sub:        "f64.sub",
+	opF64Mul:        "f64.mul",
+	opF64Div:        "f64.div",
+	opF64ConvertI32: "f64.convert_i32_u",
+}
+
+// instr is an instruction. Only the immediate of the opcode is used.
+type instr struct {
+	op    opcode
+	index uint32  // local index, function index or label depth
+	value float64 // value of f64.const
+}
+
+// Module is a WebAssembly module compiled from a kaleigo program.
+// All functions take and return f64 values, so a function type is identified by its arity.
+type Module struct {
+	types   []int // arities of the function types
+	imports []*function
+	funcs   []*function
+	main    uint32 // function index of the main function
+}
+
+// function is an imported or defined function.
+type function struct {
+	name   string
+	typ    uint32   // index in Module.types
+	params []string // names of the parameters
+	locals []string // names of the local variables other than the parameters
+	code   []instr  // body, without the final end
+}
+
+// typeIndex returns the index of the function type of the arity, adding it if needed.
+func (m *Module) typeIndex(arity int) uint32 {
+	for i, a := range m.types {
+		if a == arity {
+			return uint32(i)
+		}
+	}
+	m.types = append(m.types, arity)
+	return uint32(len(m.types) - 1)
+}
+
+// function returns the function of the index, in the index space of imports followed by definitions.
+func (m *Module) function(index uint32) *function {
+	if int(index) < len(m.imports) {
+		return m.imports[index]
+	}
+	return m.funcs[int(index)-len(m.imports)]
+}
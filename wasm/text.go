@@ -0,0 +1,125 @@
+package wasm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// isIDChar reports whether c can be used in identifiers of the text format.
+func isIDChar(c byte) bool {
+	switch {
+	case '0' <= c && c <= '9', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-./:<=>?@\\^_`|~", c) >= 0
+}
+
+// namer gives unique identifiers of the text format to kaleigo names.
+type namer map[string]bool
+
+func (n namer) name(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !isIDChar(c) {
+			b[i] = '_'
+		}
+	}
+	base := "$" + string(b)
+	if base == "$" {
+		base = "$_"
+	}
+	id := base
+	for i := 2; n[id]; i++ {
+		id = fmt.Sprintf("%s_%d", base, i)
+	}
+	n[id] = true
+	return id
+}
+
+// literal returns the text format of the f64 constant.
+func literal(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "nan"
+	case math.IsInf(v, 1):
+		return "inf"
+	case math.IsInf(v, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func signature(arity int) string {
+	return strings.Repeat(" (param f64)", arity) + " (result f64)"
+}
+
+// WriteText writes the module in the WebAssembly text format.
+func (m *Module) WriteText(w io.Writer) error {
+	var b bytes.Buffer
+	b.WriteString("(module\n")
+
+	for i, arity := range m.types {
+		fmt.Fprintf(&b, "  (type (;%d;) (func%s))\n", i, signature(arity))
+	}
+
+	funcNames := make(namer)
+	ids := make([]string, len(m.imports)+len(m.funcs))
+	for i := range ids {
+		ids[i] = funcNames.name(m.function(uint32(i)).name)
+	}
+
+	for i, f := range m.imports {
+		fmt.Fprintf(&b, "  (import %q %q (func %s (type %d)))\n", ImportModule, f.name, ids[i], f.typ)
+	}
+
+	for i, f := range m.funcs {
+		localNames := make(namer)
+		locals := make([]string, 0, len(f.params)+len(f.locals))
+		fmt.Fprintf(&b, "  (func %s (type %d)", ids[len(m.imports)+i], f.typ)
+		for _, p := range f.params {
+			id := localNames.name(p)
+			locals = append(locals, id)
+			fmt.Fprintf(&b, " (param %s f64)", id)
+		}
+		b.WriteString(" (result f64)\n")
+		for _, l := range f.locals {
+			id := localNames.name(l)
+			locals = append(locals, id)
+			fmt.Fprintf(&b, "    (local %s f64)\n", id)
+		}
+
+		depth := 2
+		for _, in := range f.code {
+			if in.op == opElse || in.op == opEnd {
+				depth--
+			}
+			b.WriteString(strings.Repeat("  ", depth))
+			b.WriteString(opNames[in.op])
+			switch in.op {
+			case opBrIf:
+				fmt.Fprintf(&b, " %d", in.index)
+			case opCall:
+				fmt.Fprintf(&b, " %s", ids[in.index])
+			case opLocalGet, opLocalSet, opLocalTee:
+				fmt.Fprintf(&b, " %s", locals[in.index])
+			case opF64Const:
+				fmt.Fprintf(&b, " %s", literal(in.value))
+			}
+			b.WriteString("\n")
+			if in.op == opIf || in.op == opElse || in.op == opLoop {
+				depth++
+			}
+		}
+		b.WriteString("  )\n")
+	}
+
+	fmt.Fprintf(&b, "  (export %q (func %s))\n", m.function(m.main).name, ids[m.main])
+	b.WriteString(")\n")
+
+	_, err := b.WriteTo(w)
+	return err
+}
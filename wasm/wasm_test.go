@@ -0,0 +1,203 @@
+package wasm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/agatan/kaleigo/interp"
+	"github.com/agatan/kaleigo/parse"
+)
+
+func compile(src string) (*Module, error) {
+	f, err := parse.New("test.kl", src).Parse()
+	if err != nil {
+		return nil, err
+	}
+	return Compile(f)
+}
+
+func TestWriteText(t *testing.T) {
+	src := `extern putd(x)
+def binary| 5 (a b) if a || b then 1 else 0
+def f(x) var y = x % 2 in y = y * 2
+putd(f(1) | 0)`
+	expected := `(module
+  (type (;0;) (func (param f64) (result f64)))
+  (type (;1;) (func (param f64) (param f64) (result f64)))
+  (type (;2;) (func (result f64)))
+  (import "env" "putd" (func $putd (type 0)))
+  (import "env" "__kaleigo_fmod" (func $__kaleigo_fmod (type 1)))
+  (func $binary| (type 1) (param $a f64) (param $b f64) (result f64)
+    local.get $a
+    f64.abs
+    f64.const 0
+    f64.gt
+    if (result f64)
+      f64.const 1
+    else
+      local.get $b
+      f64.abs
+      f64.const 0
+      f64.gt
+      f64.convert_i32_u
+    end
+    f64.abs
+    f64.const 0
+    f64.gt
+    if (result f64)
+      f64.const 1
+    else
+      f64.const 0
+    end
+  )
+  (func $f (type 0) (param $x f64) (result f64)
+    (local $y f64)
+    local.get $x
+    f64.const 2
+    call $__kaleigo_fmod
+    local.set $y
+    local.get $y
+    f64.const 2
+    f64.mul
+    local.tee $y
+  )
+  (func $__kaleigo_main (type 2) (result f64)
+    f64.const 1
+    call $f
+    f64.const 0
+    call $binary|
+    call $putd
+  )
+  (export "__kaleigo_main" (func $__kaleigo_main))
+)
+`
+	m, err := compile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := m.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expected {
+		t.Errorf("generated text is wrong:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestWriteBinary(t *testing.T) {
+	m, err := compile("def f(x) x\n2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := m.WriteBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00,
+		// types: (f64) -> f64, () -> f64
+		0x01, 0x0a, 0x02, 0x60, 0x01, 0x7c, 0x01, 0x7c, 0x60, 0x00, 0x01, 0x7c,
+		// functions
+		0x03, 0x03, 0x02, 0x00, 0x01,
+		// export "__kaleigo_main"
+		0x07, 0x12, 0x01, 0x0e, '_', '_', 'k', 'a', 'l', 'e', 'i', 'g', 'o', '_', 'm', 'a', 'i', 'n', 0x00, 0x01,
+		// code: local.get 0; f64.const 2
+		0x0a, 0x12, 0x02,
+		0x04, 0x00, 0x20, 0x00, 0x0b,
+		0x0b, 0x00, 0x44, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x0b,
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("expected % x, but got % x", expected, buf.Bytes())
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	cases := []struct {
+		src string
+		msg string
+	}{
+		{"x + 1", `test.kl:1:1: unknown variable name : "x"`},
+		{"f(1)", `test.kl:1:1: unknown function referenced: "f"`},
+		{"def f(x) x\n1 + f(1, 2)", `test.kl:2:5: incorrect number of arguments passed for "f". 1 expected, but 2 given`},
+		{"def f(x) x\ndef f(y) y", `test.kl:2:5: redefinition of function "f"`},
+		{"extern sin(x)\ndef sin(x, y) x", `test.kl:2:5: function "sin" is defined with 2 arguments, but declared with 1`},
+		{"1 = 2", `test.kl:1:1: destination of '=' must be a variable`},
+	}
+	for _, c := range cases {
+		_, err := compile(c.src)
+		if err == nil || err.Error() != c.msg {
+			t.Errorf("wrong error for %q: expected %q, actual %v", c.src, c.msg, err)
+		}
+	}
+}
+
+// TestRunWithNode runs the modules with lib/runtime.js, and checks that they print the same
+// as the interpreter.
+func TestRunWithNode(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node not found")
+	}
+	dir, err := ioutil.TempDir("", "wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	programs := []string{
+		"putd(1 + 2 * 3); putd(10 - 4 - 3); putd(7 / 2); putd(7 % 4); putd(-(1 + 2)); putd(-0)",
+		"putd(1 < 2); putd(2 <= 1); putd(3 == 3); putd(3 != 3); putd(!0); putd(!3)",
+		"putd(!(0/0)); putd((0/0) || !(0/0))",
+		"putd(0/0); putd(-(0/0))",
+		"putd(1 && 0); putd(0 || 2); putd(2 && 3); putd(0 || 0)",
+		"putd(var x = 2 in (var x = x * 3 in x) + x)",
+		"var x = 1 in putd(x + (x = 5))",
+		"def fib(x) if x < 3 then 1 else fib(x-1) + fib(x-2)\nputd(fib(15))",
+		"def binary& 1 (x y) y\n" +
+			"def fibi(x) var a = 1, b = 1, c in (for i = 3, i < x in c = a + b & a = b & b = c) & b\nputd(fibi(11))",
+		"def even(n) if n == 0 then 1 else odd(n - 1)\ndef odd(n) if n == 0 then 0 else even(n - 1)\nputd(even(10) + odd(7))",
+		"for i = 0, i < 3, 0.5 in putd(i)",
+		"def unary~(v) 0 - v\ndef int(double) ~double\nputd(int(4))",
+		"extern putchard(c)\ndef binary& 1 (x y) y\ndef side(x) putchard(x) & 1\n0 && side(65); 1 && side(66); 1 || side(67); 0 || side(68)",
+		"extern pow(x, y)\nextern sqrt(x)\nputd(pow(2, 10) + sqrt(16)); putd(pow(10, 22))",
+		"def fmod(a) a * 100\nputd(5 % 3); putd(fmod(2))",
+		"extern fmod(x, y)\nputd(fmod(7, 4) + 5 % 3)",
+	}
+	for i, src := range programs {
+		src = "extern putd(x)\n" + src
+		f, err := parse.New("test.kl", src).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected bytes.Buffer
+		if _, err := interp.New(&expected).Run(f); err != nil {
+			t.Fatalf("%q: %s", src, err)
+		}
+
+		m, err := Compile(f)
+		if err != nil {
+			t.Errorf("%q: %s", src, err)
+			continue
+		}
+		var bin bytes.Buffer
+		if err := m.WriteBinary(&bin); err != nil {
+			t.Fatal(err)
+		}
+		wasmfile := filepath.Join(dir, "test.wasm")
+		if err := ioutil.WriteFile(wasmfile, bin.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command(node, "../lib/runtime.js", wasmfile).CombinedOutput()
+		if err != nil {
+			t.Errorf("program %d: %s\n%s", i, err, out)
+			continue
+		}
+		if string(out) != expected.String() {
+			t.Errorf("%q: expected output %q, actual %q", src, expected.String(), out)
+		}
+	}
+}